@@ -2,9 +2,9 @@ package client
 
 import (
 	"context"
-	"encoding/hex"
-	"fmt"
+	"errors"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/eclipse/paho.golang/autopaho"
@@ -22,50 +22,140 @@ type ClientConfig struct {
 	WriteToDisk       bool
 	OutputFileName    string
 	Debug             bool
+	Dispatcher        DispatcherConfig
+	SinkRetry         RetryPolicy // retries of failed writes to the output file
+	OnHandlerError    func(error) // called when a received message cannot be written out (defaults to logging the error)
+	// OnPublish is called, in the mqtt read loop, for each message received before it is dispatched to the handler.
+	// Returning true consumes the message. It must not block.
+	OnPublish func(m *paho.Publish) bool
 }
 
 type Client struct {
 	ServerUrl   *url.URL
 	AuthHandler *Sm9Auth
-	User        *User
+	User        *User // set before Connect; use UpdateUser to replace it afterwards
 	Cm          *autopaho.ConnectionManager
 	handler     *handler
+	dispatcher  *dispatcher
 	Cancel      context.CancelFunc
 	Config      *ClientConfig
+	Logger      Logger   // if nil, records at info level and above are written to stdout
+	Metrics     *Metrics // if nil, no metrics are recorded
+	events      events
+
+	userMu sync.RWMutex // guards User once connected
+	connMu sync.Mutex   // guards Cm and Cancel, which are replaced when the user is updated
+}
+
+// logger returns the Logger the client should use
+func (c *Client) logger() Logger {
+	if c.Logger == nil {
+		return defaultLogger
+	}
+	return c.Logger
+}
+
+// user returns the identity the client authenticates as
+func (c *Client) user() *User {
+	c.userMu.RLock()
+	defer c.userMu.RUnlock()
+	return c.User
+}
+
+// connection returns the current connection manager
+func (c *Client) connection() *autopaho.ConnectionManager {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.Cm
 }
 
 func (c *Client) Connect() error {
 	// Create a handler that will deal with incoming messages
-	c.handler = NewHandler(c.Config.WriteToDisk, c.Config.OutputFileName, c.Config.WriteToStdOut)
+	h, err := NewHandler(c.Config.WriteToDisk, c.Config.OutputFileName, c.Config.WriteToStdOut)
+	if err != nil {
+		return err
+	}
+	h.log = c.logger()
+	h.retry = c.Config.SinkRetry
+	h.onError = c.Config.OnHandlerError
+	c.handler = h
 
+	// Messages are handed to workers so that a slow handler does not hold up the mqtt read loop
+	c.dispatcher = newDispatcher(c.Config.Dispatcher, func(m *paho.Publish) {
+		start := time.Now()
+		c.handler.handle(m)
+		c.Metrics.handled(time.Since(start))
+	})
+
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if err := c.start(); err != nil {
+		c.dispatcher.close()
+		c.handler.Close()
+		return err
+	}
+	return nil
+}
+
+// start opens a new connection to the broker, setting Cm and Cancel. connMu must be held.
+func (c *Client) start() error {
 	cliCfg := autopaho.ClientConfig{
 		BrokerUrls:        []*url.URL{c.ServerUrl},
 		KeepAlive:         c.Config.Keepalive,
 		ConnectRetryDelay: time.Duration(c.Config.ConnectRetryDelay) * time.Millisecond,
 		OnConnectionUp: func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
-			fmt.Println("mqtt connection up")
+			c.Metrics.connect(true)
+			c.emit(Event{Type: EventUp})
+			c.logger().Info("mqtt connection up", "server", c.ServerUrl.String())
 			if _, err := cm.Subscribe(context.Background(), &paho.Subscribe{
 				Subscriptions: map[string]paho.SubscribeOptions{
 					c.Config.Topic: {QoS: c.Config.Qos},
 				},
 			}); err != nil {
-				fmt.Printf("failed to subscribe (%s). This is likely to mean no messages will be received.", err)
+				c.logger().Error("failed to subscribe, this is likely to mean no messages will be received", "topic", c.Config.Topic, "err", err)
 				return
 			}
-			fmt.Println("mqtt subscription made")
+			c.logger().Info("mqtt subscription made", "topic", c.Config.Topic)
+		},
+		OnConnectError: func(err error) {
+			// Only a rejection part way through the AUTH exchange is an authentication failure; refusals before it,
+			// such as a broker that is unavailable, and failures to dial are reported as the connection being down
+			if c.AuthHandler.finish(false) {
+				c.emit(Event{Type: EventAuthFailed, Err: err})
+			} else {
+				c.emit(Event{Type: EventDown, Err: err})
+			}
+			c.Metrics.connect(false)
+			c.logger().Warn("error whilst attempting connection", "err", err)
 		},
-		OnConnectError: func(err error) { fmt.Printf("error whilst attempting connection: %s\n", err) },
 		ClientConfig: paho.ClientConfig{
 			ClientID: c.Config.ClientID,
 			Router: paho.NewSingleHandlerRouter(func(m *paho.Publish) {
-				c.handler.handle(m)
+				if c.Config.OnPublish != nil && c.Config.OnPublish(m) {
+					return
+				}
+				queued := c.dispatcher.dispatch(m)
+				c.Metrics.received(!queued)
+				if !queued {
+					c.logger().Warn("message dropped, dispatcher queue full", "topic", m.Topic)
+				}
 			}),
-			OnClientError: func(err error) { fmt.Printf("server requested disconnect: %s\n", err) },
+			OnClientError: func(err error) {
+				c.Metrics.connectionLost()
+				c.emit(Event{Type: EventDown, Err: err})
+				c.logger().Warn("client error", "err", err)
+			},
 			OnServerDisconnect: func(d *paho.Disconnect) {
+				c.Metrics.connectionLost()
+				e := Event{Type: EventDown, ReasonCode: d.ReasonCode}
+				if d.Properties != nil {
+					e.Reason = d.Properties.ReasonString
+				}
+				c.emit(e)
 				if d.Properties != nil {
-					fmt.Printf("server requested disconnect: %s\n", d.Properties.ReasonString)
+					c.logger().Warn("server requested disconnect", "reason_code", d.ReasonCode, "reason", d.Properties.ReasonString)
 				} else {
-					fmt.Printf("server requested disconnect; reason code: %d\n", d.ReasonCode)
+					c.logger().Warn("server requested disconnect", "reason_code", d.ReasonCode)
 				}
 			},
 			AuthHandler: c.AuthHandler,
@@ -73,20 +163,22 @@ func (c *Client) Connect() error {
 	}
 
 	cliCfg.SetConnectPacketConfigurator(func(connect *paho.Connect) *paho.Connect {
+		c.emit(Event{Type: EventConnecting})
+		user := c.user()
 		connect.Properties = &paho.ConnectProperties{
-			AuthMethod: "sm9",
+			AuthMethod: AuthMethodSM9,
 			AuthData:   []byte(c.AuthHandler.GetRandom1(8)),
 			User: []paho.UserProperty{
 				{
-					Key:   "uid",
-					Value: string(c.User.Uid),
+					Key:   PropertyUid,
+					Value: string(user.Uid),
 				},
 				{
-					Key:   "hid",
-					Value: hex.EncodeToString([]byte{c.User.Hid}),
+					Key:   PropertyHid,
+					Value: FormatHid(user.Identity().EncryptionHid()),
 				},
 				{
-					Key:   "deviceName",
+					Key:   PropertyDeviceName,
 					Value: c.Config.ClientName,
 				},
 			},
@@ -96,8 +188,8 @@ func (c *Client) Connect() error {
 	})
 
 	if c.Config.Debug {
-		cliCfg.Debug = logger{prefix: "autoPaho"}
-		cliCfg.PahoDebug = logger{prefix: "paho"}
+		cliCfg.Debug = pahoLogger{log: c.logger(), component: "autoPaho"}
+		cliCfg.PahoDebug = pahoLogger{log: c.logger(), component: "paho"}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -105,6 +197,7 @@ func (c *Client) Connect() error {
 
 	connection, err := autopaho.NewConnection(ctx, cliCfg)
 	if err != nil {
+		cancel()
 		return err
 	}
 
@@ -112,30 +205,92 @@ func (c *Client) Connect() error {
 	return nil
 }
 
+// UpdateUser replaces the identity the client authenticates as, for example once its keys have been renewed. The
+// user is validated first. If the client is connected, the connection is closed and a new one made so that the
+// client authenticates with the new keys; MQTT v5 re-authentication is not used as the connection manager does not
+// support it.
+func (c *Client) UpdateUser(u *User) error {
+	if u == nil {
+		return errors.New("user required")
+	}
+	if err := u.Validate(); err != nil {
+		return err
+	}
+
+	c.userMu.Lock()
+	c.User = u
+	c.userMu.Unlock()
+
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.Cm == nil {
+		return nil
+	}
+
+	c.logger().Info("reconnecting to authenticate with updated keys", "uid", string(u.Uid), "version", u.KeyVersion)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Cm.Disconnect(ctx); err != nil {
+		c.logger().Warn("disconnect before re-authenticating failed", "err", err)
+	}
+	c.Cancel()
+	c.Metrics.disconnected()
+	c.emit(Event{Type: EventDown, Reason: "re-authenticating with updated keys"})
+	return c.start()
+}
+
+// AwaitConnection waits until the connection is up or ctx is done
+func (c *Client) AwaitConnection(ctx context.Context) error {
+	return c.connection().AwaitConnection(ctx)
+}
+
 func (c *Client) Subscribe(topic string) error {
 	subPacket := &paho.Subscribe{
 		Subscriptions: map[string]paho.SubscribeOptions{
 			topic: {QoS: c.Config.Qos},
 		},
 	}
-	if _, err := c.Cm.Subscribe(context.Background(), subPacket); err != nil {
-		fmt.Printf("failed to subscribe (%s). This is likely to mean no messages will be received.", err)
+	_, err := c.connection().Subscribe(context.Background(), subPacket)
+	c.Metrics.subscribe(err == nil)
+	if err != nil {
+		c.logger().Error("failed to subscribe, this is likely to mean no messages will be received", "topic", topic, "err", err)
 		return err
 	}
 
-	fmt.Printf("Subscribed to %s", topic)
+	c.logger().Info("subscribed", "topic", topic)
+	return nil
+}
+
+// Unsubscribe removes a subscription made with Subscribe
+func (c *Client) Unsubscribe(topic string) error {
+	_, err := c.connection().Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: []string{topic}})
+	if err != nil {
+		c.logger().Error("failed to unsubscribe", "topic", topic, "err", err)
+		return err
+	}
+
+	c.logger().Info("unsubscribed", "topic", topic)
 	return nil
 }
 
 func (c *Client) Publish(topic, payload string) error {
+	return c.PublishMessage(topic, 0, false, []byte(payload))
+}
+
+// PublishMessage publishes payload with the QoS and retain flag given, waiting for the broker's acknowledgement if the
+// QoS is above 0
+func (c *Client) PublishMessage(topic string, qos byte, retain bool, payload []byte) error {
 	pubPacket := &paho.Publish{
 		Topic:   topic,
-		QoS:     byte(0),
-		Payload: []byte(payload),
+		QoS:     qos,
+		Retain:  retain,
+		Payload: payload,
 	}
 
-	if _, err := c.Cm.Publish(context.Background(), pubPacket); err != nil {
-		fmt.Println(err)
+	_, err := c.connection().Publish(context.Background(), pubPacket)
+	c.Metrics.publish(err == nil)
+	if err != nil {
+		c.logger().Error("failed to publish", "topic", topic, "err", err)
 		return err
 	}
 
@@ -143,30 +298,23 @@ func (c *Client) Publish(topic, payload string) error {
 }
 
 func (c *Client) Disconnect() error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
 	defer c.handler.Close()
+	defer c.dispatcher.close() // runs before the handler is closed so queued messages are still written out
 	defer c.Cancel()
+	defer c.Metrics.disconnected()
+	defer c.emit(Event{Type: EventDown, Reason: "disconnect requested"})
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 	return c.Cm.Disconnect(ctx)
 }
 
-// logger implements the paho.Logger interface
-type logger struct {
-	prefix string
-}
-
-// Println is the library provided NOOPLogger's
-// implementation of the required interface function()
-func (l logger) Println(v ...interface{}) {
-	fmt.Println(append([]interface{}{l.prefix + ":"}, v...)...)
-}
-
-// Printf is the library provided NOOPLogger's
-// implementation of the required interface function(){}
-func (l logger) Printf(format string, v ...interface{}) {
-	if len(format) > 0 && format[len(format)-1] != '\n' {
-		format = format + "\n" // some log calls in paho do not add \n
+// DispatcherStats returns the counters of the message dispatcher (zero before Connect is called)
+func (c *Client) DispatcherStats() DispatcherStats {
+	if c.dispatcher == nil {
+		return DispatcherStats{}
 	}
-	fmt.Printf(l.prefix+":"+format, v...)
+	return c.dispatcher.stats()
 }
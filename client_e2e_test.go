@@ -0,0 +1,259 @@
+package client_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/metrics"
+	"github.com/opensvn/auth-client/mqtttest"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	e2eTimeout = 5 * time.Second
+	e2eTick    = 10 * time.Millisecond
+)
+
+func newTestClient(t *testing.T, broker *mqtttest.Broker, uid string) *client.Client {
+	conf, err := broker.UserConfig(uid)
+	assert.Nil(t, err)
+	user := client.NewUser(conf)
+	assert.NotNil(t, user)
+
+	c := &client.Client{
+		ServerUrl: broker.URL(),
+		User:      user,
+		Logger:    client.NopLogger(),
+		Config: &client.ClientConfig{
+			ClientID:          uid,
+			ClientName:        "test device",
+			Topic:             "devices/" + uid + "/in",
+			Keepalive:         30,
+			ConnectRetryDelay: 50,
+			WriteToDisk:       true,
+			OutputFileName:    filepath.Join(t.TempDir(), "received.txt"),
+		},
+	}
+	c.AuthHandler = client.NewSm9Auth(c)
+	return c
+}
+
+// waitFor returns the first event of the given type, failing the test if none arrives in time
+func waitFor(t *testing.T, events <-chan client.Event, typ client.EventType) client.Event {
+	deadline := time.After(e2eTimeout)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == typ {
+				return e
+			}
+		case <-deadline:
+			t.Fatalf("no %s event", typ)
+			return client.Event{}
+		}
+	}
+}
+
+func TestClientEndToEnd(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	c := newTestClient(t, broker, "device1")
+	events := c.Events()
+	assert.Nil(t, c.Connect())
+	waitFor(t, events, client.EventUp)
+
+	ok, failed := broker.Handshakes()
+	assert.Equal(t, 1, ok)
+	assert.Equal(t, 0, failed)
+
+	// Messages routed by the broker reach the output file
+	assert.Eventually(t, func() bool { return broker.Subscribed("devices/device1/in") }, e2eTimeout, e2eTick)
+	assert.Equal(t, 1, broker.Publish("devices/device1/in", []byte(`{"Count":7}`)))
+
+	// and messages published by the client reach the broker
+	assert.Nil(t, c.Publish("devices/device1/out", "hello"))
+	select {
+	case m := <-broker.Received():
+		assert.Equal(t, "device1", m.ClientID)
+		assert.Equal(t, "devices/device1/out", m.Topic)
+		assert.Equal(t, "hello", string(m.Payload))
+	case <-time.After(e2eTimeout):
+		t.Fatal("publish not received by the broker")
+	}
+
+	assert.Eventually(t, func() bool { return c.DispatcherStats().Processed == 1 }, e2eTimeout, e2eTick)
+	assert.Nil(t, c.Disconnect())
+	waitFor(t, events, client.EventDown)
+
+	written, err := ioutil.ReadFile(c.Config.OutputFileName)
+	assert.Nil(t, err)
+	assert.Equal(t, "000000007 {\"Count\":7}\n", string(written))
+}
+
+func TestClientHandshakeTampered(t *testing.T) {
+	t.Run("challenge", func(t *testing.T) {
+		broker := mqtttest.NewBroker()
+		defer broker.Close()
+		broker.SetTamperAuth(func(a *packets.Auth, fromClient bool) {
+			if !fromClient {
+				a.Properties.AuthData = []byte(strings.Repeat("00", 128))
+			}
+		})
+
+		c := newTestClient(t, broker, "device1")
+		events := c.Events()
+		assert.Nil(t, c.Connect())
+		defer c.Disconnect()
+
+		e := waitFor(t, events, client.EventAuthFailed)
+		assert.NotNil(t, e.Err)
+		assert.False(t, c.Status().Connected())
+	})
+
+	t.Run("response", func(t *testing.T) {
+		broker := mqtttest.NewBroker()
+		defer broker.Close()
+		broker.SetTamperAuth(func(a *packets.Auth, fromClient bool) {
+			if fromClient {
+				a.Properties.AuthData = []byte("00")
+			}
+		})
+
+		c := newTestClient(t, broker, "device1")
+		events := c.Events()
+		assert.Nil(t, c.Connect())
+		defer c.Disconnect()
+
+		// The broker rejects the connection after the client has answered the challenge
+		e := waitFor(t, events, client.EventAuthFailed)
+		assert.NotNil(t, e.Err)
+		assert.Eventually(t, func() bool {
+			_, failed := broker.Handshakes()
+			return failed > 0
+		}, e2eTimeout, e2eTick)
+		ok, _ := broker.Handshakes()
+		assert.Equal(t, 0, ok)
+	})
+
+	t.Run("wrong keys", func(t *testing.T) {
+		broker := mqtttest.NewBroker()
+		defer broker.Close()
+		other := mqtttest.NewBroker()
+		other.Close()
+
+		c := newTestClient(t, other, "device1")
+		c.ServerUrl = broker.URL()
+		events := c.Events()
+		assert.Nil(t, c.Connect())
+		defer c.Disconnect()
+
+		waitFor(t, events, client.EventAuthFailed)
+	})
+
+	t.Run("no encrypt private key", func(t *testing.T) {
+		broker := mqtttest.NewBroker()
+		defer broker.Close()
+
+		conf, err := broker.UserConfig("device1")
+		assert.Nil(t, err)
+		conf.EncryptPrivateKey = ""
+		c := newTestClient(t, broker, "device1")
+		c.User = client.NewUser(conf)
+		events := c.Events()
+		assert.Nil(t, c.Connect())
+		defer c.Disconnect()
+
+		// Connecting without validating the user fails the exchange rather than panicking
+		e := waitFor(t, events, client.EventAuthFailed)
+		assert.Contains(t, e.Err.Error(), "encrypt private key missing")
+		assert.False(t, c.Status().Connected())
+	})
+}
+
+func TestClientRefused(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	broker.SetRefuse(packets.ConnackServerUnavailable)
+
+	c := newTestClient(t, broker, "device1")
+	events := c.Events()
+	assert.Nil(t, c.Connect())
+	defer c.Disconnect()
+
+	// A refusal before the AUTH exchange is not an authentication failure
+	deadline := time.After(e2eTimeout)
+	for downs := 0; downs < 2; {
+		select {
+		case e := <-events:
+			assert.NotEqual(t, client.EventAuthFailed, e.Type)
+			if e.Type == client.EventDown {
+				assert.NotNil(t, e.Err)
+				downs++
+			}
+		case <-deadline:
+			t.Fatal("no down events")
+		}
+	}
+}
+
+func TestClientHandshakeMetrics(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	broker.SetRefuse(packets.ConnackServerUnavailable)
+
+	c := newTestClient(t, broker, "device1")
+	c.Metrics = client.NewMetrics(metrics.NewRegistry())
+	events := c.Events()
+	assert.Nil(t, c.Connect())
+	defer c.Disconnect()
+
+	// Connections refused before the broker begins an AUTH exchange are not handshakes
+	assert.Eventually(t, func() bool {
+		return c.Metrics.Connects.WithLabelValues("failure").Value() >= 2
+	}, e2eTimeout, e2eTick)
+	assert.Equal(t, 0.0, c.Metrics.Handshakes.WithLabelValues("failure").Value())
+
+	broker.SetRefuse(0)
+	waitFor(t, events, client.EventUp)
+	assert.Eventually(t, func() bool {
+		return c.Metrics.Handshakes.WithLabelValues("success").Value() == 1
+	}, e2eTimeout, e2eTick)
+	assert.Equal(t, 0.0, c.Metrics.Handshakes.WithLabelValues("failure").Value())
+}
+
+func TestClientUpdateUser(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	c := newTestClient(t, broker, "device1")
+	events := c.Events()
+	assert.Nil(t, c.Connect())
+	defer c.Disconnect()
+	waitFor(t, events, client.EventUp)
+
+	// Keys that fail validation are refused and the connection left alone
+	assert.NotNil(t, c.UpdateUser(&client.User{Uid: []byte("device1")}))
+	assert.True(t, c.Status().Connected())
+
+	conf, err := broker.UserConfig("device1")
+	assert.Nil(t, err)
+	conf.KeyVersion = 2
+	renewed := client.NewUser(conf)
+	assert.Nil(t, c.UpdateUser(renewed))
+	assert.Equal(t, renewed, c.User)
+
+	// The client reconnects, authenticating with the new keys, and subscribes again
+	e := waitFor(t, events, client.EventDown)
+	assert.Equal(t, "re-authenticating with updated keys", e.Reason)
+	waitFor(t, events, client.EventUp)
+	ok, _ := broker.Handshakes()
+	assert.Equal(t, 2, ok)
+	assert.Eventually(t, func() bool { return broker.Subscribed("devices/device1/in") }, e2eTimeout, e2eTick)
+	assert.Nil(t, c.Publish("devices/device1/out", "after renewal"))
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"time"
+
+	"github.com/opensvn/auth-client/metrics"
+)
+
+// Metrics holds the instruments updated by a Client. Metrics are optional; a Client with a nil Metrics records nothing.
+type Metrics struct {
+	Connects          *metrics.CounterVec // connection attempts by result
+	Connected         *metrics.Gauge      // 1 while the mqtt connection is up
+	ConnectionLosses  *metrics.Counter    // connections dropped by either side
+	Handshakes        *metrics.CounterVec // sm9 handshakes by result
+	HandshakeDuration *metrics.Histogram  // time from CONNECT to the end of the sm9 handshake
+	Publishes         *metrics.CounterVec // publish calls by result
+	Subscribes        *metrics.CounterVec // subscribe calls by result
+	MessagesReceived  *metrics.Counter    // messages received from the broker
+	MessagesDropped   *metrics.Counter    // messages discarded by the dispatcher
+	HandlerDuration   *metrics.Histogram  // time taken to handle each message
+}
+
+// NewMetrics creates the client metrics and registers them with r
+func NewMetrics(r *metrics.Registry) *Metrics {
+	return &Metrics{
+		Connects:          r.NewCounterVec("authclient_connects_total", "MQTT connection attempts by result.", "result"),
+		Connected:         r.NewGauge("authclient_connected", "1 if the MQTT connection is up, 0 otherwise."),
+		ConnectionLosses:  r.NewCounter("authclient_connection_losses_total", "MQTT connections lost after being established."),
+		Handshakes:        r.NewCounterVec("authclient_sm9_handshakes_total", "SM9 enhanced authentication handshakes by result.", "result"),
+		HandshakeDuration: r.NewHistogram("authclient_sm9_handshake_duration_seconds", "Duration of SM9 enhanced authentication handshakes.", nil),
+		Publishes:         r.NewCounterVec("authclient_publishes_total", "Publish calls by result.", "result"),
+		Subscribes:        r.NewCounterVec("authclient_subscribes_total", "Subscribe calls by result.", "result"),
+		MessagesReceived:  r.NewCounter("authclient_messages_received_total", "Messages received from the broker."),
+		MessagesDropped:   r.NewCounter("authclient_messages_dropped_total", "Messages dropped because the dispatcher queue was full."),
+		HandlerDuration:   r.NewHistogram("authclient_handler_duration_seconds", "Time taken to handle a received message.", nil),
+	}
+}
+
+// result converts an outcome to the value of the result label
+func result(ok bool) string {
+	if ok {
+		return "success"
+	}
+	return "failure"
+}
+
+// The helpers below may be called on a nil *Metrics
+
+func (m *Metrics) connect(ok bool) {
+	if m == nil {
+		return
+	}
+	m.Connects.WithLabelValues(result(ok)).Inc()
+	if ok {
+		m.Connected.Set(1)
+	}
+}
+
+func (m *Metrics) connectionLost() {
+	if m == nil {
+		return
+	}
+	m.ConnectionLosses.Inc()
+	m.Connected.Set(0)
+}
+
+func (m *Metrics) disconnected() {
+	if m == nil {
+		return
+	}
+	m.Connected.Set(0)
+}
+
+func (m *Metrics) handshake(ok bool, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.Handshakes.WithLabelValues(result(ok)).Inc()
+	m.HandshakeDuration.Observe(d.Seconds())
+}
+
+func (m *Metrics) publish(ok bool) {
+	if m == nil {
+		return
+	}
+	m.Publishes.WithLabelValues(result(ok)).Inc()
+}
+
+func (m *Metrics) subscribe(ok bool) {
+	if m == nil {
+		return
+	}
+	m.Subscribes.WithLabelValues(result(ok)).Inc()
+}
+
+func (m *Metrics) received(dropped bool) {
+	if m == nil {
+		return
+	}
+	m.MessagesReceived.Inc()
+	if dropped {
+		m.MessagesDropped.Inc()
+	}
+}
+
+func (m *Metrics) handled(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.HandlerDuration.Observe(d.Seconds())
+}
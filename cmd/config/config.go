@@ -1,6 +1,11 @@
 package config
 
-import "github.com/opensvn/auth-client"
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/opensvn/auth-client"
+)
 
 type MqttConfig struct {
 	ServerAddr        string `yaml:"server_addr"`         // MQTT server URL
@@ -14,17 +19,100 @@ type MqttConfig struct {
 	WriteToStdOut     bool   `yaml:"write_to_stdout"`     // If true received messages will be written to stdout
 	WriteToDisk       bool   `yaml:"write_to_disk"`       // if true received messages will be written to below file
 	OutputFileName    string `yaml:"output_filename"`     // filename to save messages to
+	SinkRetryAttempts int    `yaml:"sink_retry_attempts"` // attempts made to write a message to the file
+	SinkRetryDelay    uint16 `yaml:"sink_retry_delay"`    // milliseconds before the first retry (doubles each time)
 	Debug             bool   `yaml:"debug"`               // autopaho and paho debug output requested
+
+	Dispatcher DispatcherConfig `yaml:"dispatcher"` // how received messages are passed to the handler
+}
+
+type DispatcherConfig struct {
+	Workers         int    `yaml:"workers"`           // number of goroutines handling messages
+	QueueSize       int    `yaml:"queue_size"`        // messages that may be waiting per queue
+	OrderedPerTopic bool   `yaml:"ordered_per_topic"` // if true messages on a topic are handled in order
+	Overflow        string `yaml:"overflow"`          // block, drop_oldest or drop_newest
+}
+
+// IdentityConfig is a further identity the device connects as, alongside user, for example a sub-device of a gateway.
+// Each has its own connection to the broker; settings left empty are taken from mqtt.
+type IdentityConfig struct {
+	client.UserConfig `yaml:",inline"`
+
+	ClientID       string `yaml:"client_id"`       // defaults to mqtt.client_id followed by "-" and the uid
+	ClientName     string `yaml:"client_name"`     // defaults to mqtt.client_name
+	DeviceType     string `yaml:"device_type"`     // defaults to mqtt.device_type
+	Topic          string `yaml:"topic"`           // defaults to mqtt.topic
+	OutputFileName string `yaml:"output_filename"` // defaults to mqtt.output_filename with "-" and the uid before the extension
+}
+
+// OutputFile returns the file the identity's messages are written to: its output_filename or, by default, that of m
+// with "-" and the uid inserted before the extension, so that identities do not truncate each other's file
+func (ic *IdentityConfig) OutputFile(m *MqttConfig) string {
+	if ic.OutputFileName != "" {
+		return ic.OutputFileName
+	}
+	ext := filepath.Ext(m.OutputFileName)
+	return strings.TrimSuffix(m.OutputFileName, ext) + "-" + ic.Uid + ext
+}
+
+// GatewayConfig enables gateway mode, in which sub-devices connect locally and are forwarded over the connection of user
+type GatewayConfig struct {
+	Listen      []string `yaml:"listen"`       // tcp://host:port or unix:///path addresses for sub-devices (disabled if empty)
+	TopicPrefix string   `yaml:"topic_prefix"` // prepended to sub-device topics upstream, {uid} replaced by its uid
+	Devices     []string `yaml:"devices"`      // uids of the sub-devices allowed to connect (any holding keys from the PKG if empty)
 }
 
 type AddrConfig struct {
-	Ra       string `yaml:"ra"`
-	Platform string `yaml:"platform"`
+	Ra       string    `yaml:"ra"`       // http:// or https:// URL, or host:port for plain http
+	Platform string    `yaml:"platform"` // http:// or https:// URL, or host:port for plain http
+	Token    string    `yaml:"token"`    // bearer token sent to the RA and platform, which must then be https
+	TLS      TLSConfig `yaml:"tls"`      // used for https endpoints
+}
+
+type TLSConfig struct {
+	CAFile     string   `yaml:"ca_file"`     // PEM CA bundle trusted in place of the system roots
+	Pins       []string `yaml:"pins"`        // hex SHA-256 digests of pinned server public keys
+	CertFile   string   `yaml:"cert_file"`   // PEM client certificate
+	KeyFile    string   `yaml:"key_file"`    // PEM client certificate key
+	ServerName string   `yaml:"server_name"` // overrides the name checked against the server certificate
+}
+
+type ProvisionConfig struct {
+	PollInterval    uint16 `yaml:"poll_interval"`     // seconds before the first query for issued keys
+	PollMaxInterval uint16 `yaml:"poll_max_interval"` // longest wait, in seconds, between queries
+	PollJitter      uint8  `yaml:"poll_jitter"`       // percentage of each wait that is randomised
+	Timeout         uint32 `yaml:"timeout"`           // seconds to wait for keys to be issued (0 waits forever)
+	RenewBefore     uint32 `yaml:"renew_before"`      // seconds before expiry to renew keys (0 renews with a fifth of their lifetime left)
+	PKGUid          string `yaml:"pkg_uid"`           // identity of the key generation centre registration is encrypted to (pkg if empty)
+	PKGHid          byte   `yaml:"pkg_hid"`           // encrypt hid of the key generation centre (1 if zero)
+}
+
+type KeyStoreConfig struct {
+	Type           string            `yaml:"type"`            // file, encrypted or a registered token (keys stay in this file if empty)
+	Path           string            `yaml:"path"`            // file holding the keys of the file and encrypted stores
+	PassphraseFile string            `yaml:"passphrase_file"` // file holding the passphrase of the encrypted store (or set AUTHCLIENT_KEYSTORE_PASSPHRASE)
+	PIN            string            `yaml:"pin"`             // user PIN of a token
+	Params         map[string]string `yaml:"params"`          // passed to the token
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`  // debug, info, warn or error (debug is implied by mqtt.debug)
+	Format string `yaml:"format"` // text or json
+}
+
+type MonitorConfig struct {
+	Addr string `yaml:"addr"` // listen address of the local http server exposing /metrics and /healthz (disabled if empty)
 }
 
 // Config holds the configuration
 type Config struct {
-	Mqtt MqttConfig        `yaml:"mqtt"`
-	User client.UserConfig `yaml:"user"`
-	Addr AddrConfig        `yaml:"addr"`
+	Mqtt       MqttConfig        `yaml:"mqtt"`
+	User       client.UserConfig `yaml:"user"`
+	Identities []IdentityConfig  `yaml:"identities"`
+	Gateway    GatewayConfig     `yaml:"gateway"`
+	Addr       AddrConfig        `yaml:"addr"`
+	Provision  ProvisionConfig   `yaml:"provision"`
+	KeyStore   KeyStoreConfig    `yaml:"key_store"`
+	Log        LogConfig         `yaml:"log"`
+	Monitor    MonitorConfig     `yaml:"monitor"`
 }
@@ -1,9 +1,15 @@
 package config
 
 import (
+	"errors"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/opensvn/auth-client"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/yaml.v3"
 )
@@ -21,3 +27,323 @@ func TestParseConfig(t *testing.T) {
 	assert.NotEmpty(t, conf.Addr.Ra)
 	assert.NotEmpty(t, conf.Addr.Platform)
 }
+
+func TestSave(t *testing.T) {
+	original := `# device configuration
+mqtt:
+  server_addr: "tcp://127.0.0.1:1883" # the broker
+  topic: 'weather'
+  vendor_option: 42
+user:
+  uid: "device1"
+  sign_private_key: "old"
+  key_version: 1
+`
+	path := filepath.Join(t.TempDir(), "config.yml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(original), 0644))
+
+	conf := &Config{}
+	assert.Nil(t, yaml.Unmarshal([]byte(original), conf))
+	conf.Mqtt.Topic = "news"
+	conf.User.SignPrivateKey = "new"
+	conf.User.KeyVersion = 0        // omitted as empty, so must be removed
+	conf.Addr.TLS.Pins = []string{} // empty collections are read back empty rather than nil
+	conf.KeyStore.Params = map[string]string{}
+	assert.Nil(t, Save(path, conf))
+
+	buf, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	out := string(buf)
+	assert.Contains(t, out, "# device configuration")
+	assert.Contains(t, out, `server_addr: "tcp://127.0.0.1:1883" # the broker`)
+	assert.Contains(t, out, "topic: 'news'")
+	assert.Contains(t, out, "vendor_option: 42")
+	assert.Contains(t, out, `sign_private_key: "new"`)
+	assert.NotContains(t, out, "key_version")
+	assert.Contains(t, out, "key_store:")
+
+	assertSameConfig(t, conf, buf)
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	backup, err := ioutil.ReadFile(path + ".bak")
+	assert.Nil(t, err)
+	assert.Equal(t, original, string(backup))
+	info, err = os.Stat(path + ".bak")
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	t.Run("new file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yml")
+		assert.Nil(t, Save(path, conf))
+		_, err := os.Stat(path + ".bak")
+		assert.True(t, os.IsNotExist(err))
+
+		buf, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		assertSameConfig(t, conf, buf)
+	})
+}
+
+// assertSameConfig checks that buf holds conf, comparing encodings as empty collections are read back empty rather
+// than nil
+func assertSameConfig(t *testing.T, conf *Config, buf []byte) {
+	saved := &Config{}
+	assert.Nil(t, yaml.Unmarshal(buf, saved))
+	want, err := yaml.Marshal(conf)
+	assert.Nil(t, err)
+	got, err := yaml.Marshal(saved)
+	assert.Nil(t, err)
+	assert.Equal(t, string(want), string(got))
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.yml")
+	assert.Nil(t, ioutil.WriteFile(base, []byte(`
+mqtt:
+  server_addr: "tcp://broker:1883"
+  topic: "weather"
+user:
+  uid: "device1"
+identities:
+  - uid: "sub1"
+    client_id: "c1"
+key_store:
+  params: {slot: "1"}
+`), 0600))
+	overlay := filepath.Join(dir, "overlay.yml")
+	assert.Nil(t, ioutil.WriteFile(overlay, []byte(`
+mqtt:
+  topic: "news"
+key_store:
+  params: {label: "keys"}
+`), 0600))
+
+	t.Run("layers", func(t *testing.T) {
+		conf, err := Load(Layers{
+			Files: []string{base, overlay},
+			Env:   []string{"AUTHCLIENT_MQTT_QOS=1", "AUTHCLIENT_GATEWAY_DEVICES=a, b", "AUTHCLIENT_CONFIG=ignored", "PATH=/bin"},
+			Set:   []string{"mqtt.qos=2", "user.hid=1", "addr.token=secret"},
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, "tcp://broker:1883", conf.Mqtt.ServerAddr)
+		assert.Equal(t, "news", conf.Mqtt.Topic)
+		assert.Equal(t, byte(2), conf.Mqtt.Qos)
+		assert.Equal(t, uint16(10), conf.Mqtt.Keepalive, "default")
+		assert.Equal(t, []string{"a", "b"}, conf.Gateway.Devices)
+		assert.Equal(t, map[string]string{"slot": "1", "label": "keys"}, conf.KeyStore.Params)
+		assert.Equal(t, "c1", conf.Identities[0].ClientID)
+		assert.Equal(t, "secret", conf.Addr.Token)
+	})
+
+	t.Run("no defaults", func(t *testing.T) {
+		conf, err := Load(Layers{Base: &Config{}, Files: []string{base}})
+		assert.Nil(t, err)
+		assert.Equal(t, uint16(0), conf.Mqtt.Keepalive)
+	})
+
+	t.Run("errors name the key", func(t *testing.T) {
+		bad := filepath.Join(dir, "bad.yml")
+		assert.Nil(t, ioutil.WriteFile(bad, []byte("mqtt:\n  qos: high\n  keep_alive: 30\nidentities:\n  - uid: sub1\n    hid: x\n"), 0600))
+		_, err := Load(Layers{
+			Files: []string{bad},
+			Env:   []string{"AUTHCLIENT_PROVISION_TIMEOUT=soon"},
+			Set:   []string{"mqtt.nope=1"},
+		})
+		var errs Errors
+		assert.True(t, errors.As(err, &errs), "%v", err)
+		assert.Len(t, errs, 5)
+		assert.EqualError(t, errs[0], "mqtt.qos ("+bad+":2): cannot unmarshal !!str `high` into uint8")
+		assert.EqualError(t, errs[1], "mqtt.keep_alive ("+bad+":3): unknown key")
+		assert.True(t, errors.Is(errs[1], ErrUnknownKey))
+		assert.EqualError(t, errs[2], "identities[0].hid ("+bad+":6): cannot unmarshal !!str `x` into uint8")
+		assert.EqualError(t, errs[3], "provision.timeout (AUTHCLIENT_PROVISION_TIMEOUT): cannot unmarshal !!str `soon` into uint32")
+		var keyErr *KeyError
+		assert.True(t, errors.As(errs[4], &keyErr))
+		assert.Equal(t, "mqtt.nope", keyErr.Key)
+		assert.True(t, errors.Is(errs[4], ErrUnknownKey))
+	})
+
+	t.Run("keys", func(t *testing.T) {
+		keys := Keys()
+		assert.Contains(t, keys, "mqtt.dispatcher.overflow")
+		assert.Contains(t, keys, "user.encrypt_private_key")
+		assert.Contains(t, keys, "addr.tls.pins")
+		assert.NotContains(t, keys, "identities")
+		assert.Equal(t, "AUTHCLIENT_KEY_STORE_PASSPHRASE_FILE", EnvName("key_store.passphrase_file"))
+	})
+}
+
+func TestMarshalRedacted(t *testing.T) {
+	conf := Default()
+	conf.User.Uid = "device1"
+	conf.User.SignPrivateKey = "0342"
+	conf.Identities = []IdentityConfig{{UserConfig: client.UserConfig{Uid: "sub1", EncryptPrivateKey: "0381"}}}
+	conf.Addr.Token = "secret"
+
+	buf, err := MarshalRedacted(conf)
+	assert.Nil(t, err)
+	out := string(buf)
+	assert.NotContains(t, out, "0342")
+	assert.NotContains(t, out, "0381")
+	assert.NotContains(t, out, "secret")
+	assert.Contains(t, out, "sign_private_key: <redacted>")
+	assert.Contains(t, out, `pin: ""`, "empty secrets are shown as unset")
+	assert.Contains(t, out, "uid: device1")
+}
+
+func TestSaveKeys(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`
+mqtt:
+  topic: "weather" # unchanged
+user:
+  uid: "device1"
+identities:
+  - uid: "sub1"
+`), 0600))
+
+	issued := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Nil(t, SaveKeys([]string{path}, &client.UserConfig{Uid: "sub1", SignPrivateKey: "0342", KeyVersion: 2, IssuedAt: issued}))
+	assert.NotNil(t, SaveKeys([]string{path}, &client.UserConfig{Uid: "device2", SignPrivateKey: "0342"}))
+
+	conf, err := Load(Layers{Base: &Config{}, Files: []string{path}})
+	assert.Nil(t, err)
+	assert.Equal(t, "weather", conf.Mqtt.Topic)
+	assert.Equal(t, "", conf.User.SignPrivateKey)
+	assert.Equal(t, "0342", conf.Identities[0].SignPrivateKey)
+	assert.Equal(t, 2, conf.Identities[0].KeyVersion)
+	assert.True(t, issued.Equal(conf.Identities[0].IssuedAt))
+
+	buf, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(buf), `topic: "weather" # unchanged`)
+
+	// Only the key fields are written, so the defaults still apply to everything the file leaves out
+	assert.Nil(t, SaveKeys([]string{path}, &client.UserConfig{Uid: "device1", EncryptPrivateKey: "0381"}))
+	conf, err = Load(Layers{Files: []string{path}})
+	assert.Nil(t, err)
+	def := Default()
+	assert.Equal(t, def.Mqtt.ServerAddr, conf.Mqtt.ServerAddr)
+	assert.Equal(t, def.Mqtt.Keepalive, conf.Mqtt.Keepalive)
+	assert.Equal(t, def.Mqtt.Dispatcher, conf.Mqtt.Dispatcher)
+	assert.Equal(t, def.Log, conf.Log)
+	assert.Equal(t, def.Provision, conf.Provision)
+	assert.Equal(t, "0381", conf.User.EncryptPrivateKey)
+	buf, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(buf), "server_addr")
+	assert.NotContains(t, string(buf), "key_version: 0")
+
+	// With layered files, the keys go to the file defining the identity
+	overlay := filepath.Join(dir, "overlay.yml")
+	assert.Nil(t, ioutil.WriteFile(overlay, []byte(`
+identities:
+  - uid: "sub2" # added by the overlay
+`), 0600))
+	files := []string{path, overlay}
+	assert.Nil(t, SaveKeys(files, &client.UserConfig{Uid: "sub2", SignPrivateKey: "0342"}))
+	assert.Nil(t, SaveKeys(files, &client.UserConfig{Uid: "device1", SignPrivateKey: "0342"}))
+	base, err := Load(Layers{Base: &Config{}, Files: []string{path}})
+	assert.Nil(t, err)
+	assert.Equal(t, "0342", base.User.SignPrivateKey)
+	assert.Equal(t, "sub1", base.Identities[0].Uid)
+	layered, err := Load(Layers{Base: &Config{}, Files: []string{overlay}})
+	assert.Nil(t, err)
+	assert.Equal(t, "", layered.User.Uid)
+	assert.Equal(t, "0342", layered.Identities[0].SignPrivateKey)
+	buf, err = ioutil.ReadFile(overlay)
+	assert.Nil(t, err)
+	assert.Contains(t, string(buf), `uid: "sub2" # added by the overlay`)
+
+	// A uid set by the environment or command line is defined by no file, so keys for it cannot be saved there. This
+	// is found out before the keys are issued; keys kept in a key store leave nothing to save.
+	env, err := Load(Layers{Files: files, Env: []string{EnvPrefix + "USER_UID=device9"}})
+	assert.Nil(t, err)
+	assert.NotNil(t, CheckSaveKeys(files, env.User.Uid))
+	assert.Nil(t, CheckSaveKeys(files, "sub2"))
+	assert.NotNil(t, SaveKeys(files, &client.UserConfig{Uid: env.User.Uid, SignPrivateKey: "0342"}))
+	assert.Nil(t, SaveKeys(files, &client.UserConfig{Uid: env.User.Uid}))
+	after, err := ioutil.ReadFile(overlay)
+	assert.Nil(t, err)
+	assert.Equal(t, buf, after)
+}
+
+func TestValidate(t *testing.T) {
+	conf, err := Load(Layers{Files: []string{"config.yml"}})
+	assert.Nil(t, err)
+	assert.Nil(t, conf.Validate())
+
+	conf.Mqtt.ServerAddr = "http://broker:1883"
+	conf.Mqtt.Topic = ""
+	conf.Mqtt.Qos = 3
+	conf.Mqtt.Keepalive = 0
+	conf.Mqtt.WriteToDisk = true
+	conf.Mqtt.OutputFileName = ""
+	conf.User.EncryptMasterPublicKey = "xyz"
+	conf.User.SignMasterPublicKey = "0342"
+	conf.Identities = []IdentityConfig{
+		{UserConfig: client.UserConfig{Uid: conf.User.Uid, Hid: 1}, Topic: "a/#/b"},
+	}
+	conf.Addr.Ra = ""
+	conf.Addr.Platform = "ftp://platform"
+	conf.Addr.Token = "secret"
+	conf.Addr.TLS.Pins = []string{"abcd", strings.Repeat("AB:", 31) + "AB"}
+	conf.Gateway.Listen = []string{"tcp://:1883", "udp://:1"}
+	conf.Gateway.TopicPrefix = "dev-{uid}"
+	conf.Log.Level = "loud"
+
+	err = conf.Validate()
+	var errs Errors
+	assert.True(t, errors.As(err, &errs), "%v", err)
+	keys := map[string]bool{}
+	for _, e := range errs {
+		var keyErr *KeyError
+		assert.True(t, errors.As(e, &keyErr), "%v", e)
+		keys[keyErr.Key] = true
+	}
+	for _, key := range []string{
+		"mqtt.server_addr", "mqtt.topic", "mqtt.qos", "mqtt.keepalive", "mqtt.output_filename",
+		"user.encrypt_master_public_key", "user.sign_master_public_key",
+		"identities[0].encrypt_master_public_key", "identities[0].sign_master_public_key", "identities[0].uid",
+		"identities[0].topic", "addr.ra", "addr.platform", "addr.token", "addr.tls.pins[0]",
+		"gateway.listen[1]", "gateway.topic_prefix", "log.level",
+	} {
+		assert.True(t, keys[key], "%s not reported in\n%v", key, err)
+	}
+	assert.Len(t, errs, 18)
+	assert.Contains(t, err.Error(), "mqtt.qos: must be 0, 1 or 2, not 3")
+}
+
+func TestIdentityOutputFile(t *testing.T) {
+	conf, err := Load(Layers{Files: []string{"config.yml"}})
+	assert.Nil(t, err)
+	conf.Mqtt.WriteToDisk = true
+
+	identity := func(uid, outputFile string) IdentityConfig {
+		uc := conf.User
+		uc.Uid = uid
+		return IdentityConfig{UserConfig: uc, OutputFileName: outputFile}
+	}
+	conf.Identities = []IdentityConfig{identity("sub1", ""), identity("sub2", "sub2.txt")}
+	assert.Equal(t, "msg-sub1.txt", conf.Identities[0].OutputFile(&conf.Mqtt))
+	assert.Equal(t, "sub2.txt", conf.Identities[1].OutputFile(&conf.Mqtt))
+	assert.Nil(t, conf.Validate())
+
+	// Identities must not share a file, as each truncates it on connecting
+	conf.Identities = append(conf.Identities, identity("sub3", "./msg.txt"), identity("sub4", "msg-sub1.txt"))
+	err = conf.Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `identities[2].output_filename: "msg.txt" is also the output file of user`)
+	assert.Contains(t, err.Error(), `identities[3].output_filename: "msg-sub1.txt" is also the output file of identities[0]`)
+	var errs Errors
+	assert.True(t, errors.As(err, &errs))
+	assert.Len(t, errs, 2)
+
+	conf.Mqtt.WriteToDisk = false
+	assert.Nil(t, conf.Validate())
+}
@@ -0,0 +1,360 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the names of the environment variables overriding configuration keys. The rest of the name is the
+// dotted key in upper case with underscores for dots, e.g. AUTHCLIENT_MQTT_SERVER_ADDR for mqtt.server_addr.
+const EnvPrefix = "AUTHCLIENT_"
+
+// Default returns the configuration that the layers of Load are applied over
+func Default() *Config {
+	return &Config{
+		Mqtt: MqttConfig{
+			ServerAddr:        "tcp://127.0.0.1:1883",
+			Keepalive:         10,
+			ConnectRetryDelay: 10,
+			WriteToStdOut:     true,
+			OutputFileName:    "msg.txt",
+			SinkRetryAttempts: 3,
+			SinkRetryDelay:    100,
+			Dispatcher: DispatcherConfig{
+				Workers:   1,
+				QueueSize: 64,
+				Overflow:  "block",
+			},
+		},
+		Gateway: GatewayConfig{TopicPrefix: "devices/{uid}/"},
+		Provision: ProvisionConfig{
+			PollInterval:    3,
+			PollMaxInterval: 60,
+			PollJitter:      20,
+			Timeout:         3600,
+			PKGUid:          "pkg",
+			PKGHid:          1,
+		},
+		KeyStore: KeyStoreConfig{Path: "config/keys.json"},
+		Log:      LogConfig{Level: "info", Format: "text"},
+	}
+}
+
+// Layers are the sources of a configuration, in increasing order of precedence
+type Layers struct {
+	Base  *Config  // the configuration the layers are applied over, Default() if nil
+	Files []string // YAML files, each overriding the keys it sets in those before it
+	Env   []string // KEY=value pairs, usually os.Environ(); those named EnvPrefix followed by a key are applied
+	Set   []string // key=value pairs, usually from the command line, with dotted keys such as mqtt.qos
+}
+
+// KeyError reports a configuration key whose value cannot be used
+type KeyError struct {
+	Key    string // dotted, with the index of list entries in brackets, e.g. identities[1].hid
+	Source string // where the value came from: a file and line, an environment variable or the command line
+	Err    error
+}
+
+func (e *KeyError) Error() string {
+	if e.Source == "" {
+		return e.Key + ": " + e.Err.Error()
+	}
+	return e.Key + " (" + e.Source + "): " + e.Err.Error()
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// Errors lists every problem found in a configuration
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// ErrUnknownKey is the error of a KeyError for a key Config does not define
+var ErrUnknownKey = errors.New("unknown key")
+
+// Load builds a configuration from its layers. Keys that Config does not define are reported, whether in the files or
+// in Set, as are values that cannot be used, each as a *KeyError in the returned Errors.
+func Load(l Layers) (*Config, error) {
+	conf := l.Base
+	if conf == nil {
+		conf = Default()
+	}
+
+	var errs Errors
+	for _, path := range l.Files {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var doc yaml.Node
+		if err := yaml.Unmarshal(buf, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if len(doc.Content) == 1 {
+			errs = append(errs, decode(doc.Content[0], reflect.ValueOf(conf).Elem(), "", path)...)
+		}
+	}
+
+	envKeys := map[string]string{}
+	for _, key := range Keys() {
+		envKeys[EnvName(key)] = key
+	}
+	for _, kv := range l.Env {
+		name, value := splitPair(kv)
+		if key, ok := envKeys[name]; ok {
+			if err := setKey(conf, key, value); err != nil {
+				errs = append(errs, &KeyError{Key: key, Source: name, Err: err})
+			}
+		}
+	}
+
+	for _, kv := range l.Set {
+		key, value := splitPair(kv)
+		if err := setKey(conf, key, value); err != nil {
+			errs = append(errs, &KeyError{Key: key, Source: "command line", Err: err})
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return conf, nil
+}
+
+func splitPair(kv string) (string, string) {
+	i := strings.IndexByte(kv, '=')
+	if i < 0 {
+		return kv, ""
+	}
+	return kv[:i], kv[i+1:]
+}
+
+// EnvName returns the environment variable overriding the dotted key
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// Keys returns the dotted keys that can be set from the environment or command line: every key of Config except the
+// lists of structures, such as identities, which only files can set
+func Keys() []string {
+	var keys []string
+	walkKeys(reflect.TypeOf(Config{}), "", func(key string, _ []int) {
+		keys = append(keys, key)
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// walkKeys calls fn with the dotted key and field index of each settable value under the struct type t
+func walkKeys(t reflect.Type, prefix string, fn func(key string, index []int)) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name, inline := yamlName(f)
+		key := prefix + name
+		switch {
+		case inline:
+			walkKeys(f.Type, prefix, func(key string, index []int) {
+				fn(key, append([]int{i}, index...))
+			})
+		case f.Type.Kind() == reflect.Struct && f.Type.NumField() > 0 && f.Type.Field(0).PkgPath == "":
+			walkKeys(f.Type, key+".", func(key string, index []int) {
+				fn(key, append([]int{i}, index...))
+			})
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Struct:
+		default:
+			fn(key, []int{i})
+		}
+	}
+}
+
+// yamlName returns the key of a struct field and whether it is inlined
+func yamlName(f reflect.StructField) (string, bool) {
+	tag := strings.Split(f.Tag.Get("yaml"), ",")
+	if len(tag) > 1 && tag[1] == "inline" {
+		return "", true
+	}
+	if tag[0] == "" {
+		return strings.ToLower(f.Name), false
+	}
+	return tag[0], false
+}
+
+// setKey sets the dotted key of conf from its text form. Strings are taken as they are, lists of strings may be
+// comma separated, and other values are parsed as YAML, e.g. [a, b] or {k: v}.
+func setKey(conf *Config, key, value string) error {
+	var index []int
+	walkKeys(reflect.TypeOf(*conf), "", func(k string, i []int) {
+		if k == key {
+			index = i
+		}
+	})
+	if index == nil {
+		return ErrUnknownKey
+	}
+
+	v := reflect.ValueOf(conf).Elem().FieldByIndex(index)
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(value, "["):
+		var list []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+		return nil
+	}
+
+	ptr := reflect.New(v.Type())
+	if err := yaml.Unmarshal([]byte(value), ptr.Interface()); err != nil {
+		return typeError(err)
+	}
+	v.Set(ptr.Elem())
+	return nil
+}
+
+// decode sets v from the YAML node, reporting the values that cannot be decoded by their dotted keys
+func decode(node *yaml.Node, v reflect.Value, prefix, path string) []error {
+	switch {
+	case v.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		var errs []error
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i].Value, node.Content[i+1]
+			f, ok := fieldByKey(v, key)
+			if !ok {
+				errs = append(errs, &KeyError{
+					Key:    prefix + key,
+					Source: path + ":" + strconv.Itoa(node.Content[i].Line),
+					Err:    ErrUnknownKey,
+				})
+				continue
+			}
+			errs = append(errs, decode(value, f, prefix+key+".", path)...)
+		}
+		return errs
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct && node.Kind == yaml.SequenceNode:
+		var errs []error
+		list := reflect.MakeSlice(v.Type(), len(node.Content), len(node.Content))
+		for i, item := range node.Content {
+			errs = append(errs, decode(item, list.Index(i), fmt.Sprintf("%s[%d].", strings.TrimSuffix(prefix, "."), i), path)...)
+		}
+		v.Set(list)
+		return errs
+	}
+
+	ptr := reflect.New(v.Type())
+	ptr.Elem().Set(v)
+	if err := node.Decode(ptr.Interface()); err != nil {
+		return []error{&KeyError{
+			Key:    strings.TrimSuffix(prefix, "."),
+			Source: path + ":" + strconv.Itoa(node.Line),
+			Err:    typeError(err),
+		}}
+	}
+	v.Set(ptr.Elem())
+	return nil
+}
+
+// fieldByKey returns the field of the struct value stored under the YAML key, looking into inlined structs
+func fieldByKey(v reflect.Value, key string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name, inline := yamlName(f)
+		if inline {
+			if fv, ok := fieldByKey(v.Field(i), key); ok {
+				return fv, true
+			}
+			continue
+		}
+		if name == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// typeError strips the line number and prefix yaml.v3 gives errors, which are reported by key instead
+func typeError(err error) error {
+	var te *yaml.TypeError
+	if errors.As(err, &te) && len(te.Errors) > 0 {
+		msg := te.Errors[0]
+		if i := strings.Index(msg, ": "); strings.HasPrefix(msg, "line ") && i >= 0 {
+			msg = msg[i+2:]
+		}
+		return errors.New(msg)
+	}
+	return err
+}
+
+// secretKeys are the keys whose values MarshalRedacted hides, wherever they appear
+var secretKeys = map[string]bool{
+	"encrypt_private_key": true,
+	"sign_private_key":    true,
+	"token":               true,
+	"pin":                 true,
+}
+
+// Redacted replaces the value of secrets that are set
+const Redacted = "<redacted>"
+
+// MarshalRedacted returns conf as YAML with private keys, tokens and PINs replaced by Redacted
+func MarshalRedacted(conf *Config) ([]byte, error) {
+	var node yaml.Node
+	if err := node.Encode(conf); err != nil {
+		return nil, err
+	}
+	redact(&node)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func redact(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			value := node.Content[i+1]
+			if secretKeys[node.Content[i].Value] && value.Kind == yaml.ScalarNode && value.Value != "" {
+				value.Value = Redacted
+				value.Tag = "!!str"
+				value.Style = 0
+			}
+		}
+	}
+	for _, child := range node.Content {
+		redact(child)
+	}
+}
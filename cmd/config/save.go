@@ -0,0 +1,265 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/internal/atomicfile"
+	"gopkg.in/yaml.v3"
+)
+
+// filePerm is the mode the configuration is written with, as it may hold private keys
+const filePerm = 0600
+
+// Save writes conf to the file at path. The values are merged into the existing file so that its comments, layout and
+// any keys not known to Config are kept. The previous contents are kept in path+".bak", and the new contents replace
+// them atomically, so a crash leaves either the old or the new file.
+func Save(path string, conf *Config) error {
+	var src yaml.Node
+	if err := src.Encode(conf); err != nil {
+		return err
+	}
+	doc := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{&src}}
+
+	old, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		var dst yaml.Node
+		if err := yaml.Unmarshal(old, &dst); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if dst.Kind == yaml.DocumentNode && len(dst.Content) == 1 {
+			merge(dst.Content[0], &src, reflect.TypeOf(conf).Elem())
+			doc = &dst
+		}
+	case os.IsNotExist(err):
+		old = nil
+	default:
+		return err
+	}
+	return write(path, old, doc)
+}
+
+// write replaces the file at path with doc, first keeping old, its previous contents, in path+".bak" unless it is nil
+func write(path string, old []byte, doc *yaml.Node) error {
+	if old != nil {
+		if err := atomicfile.WriteFile(path+".bak", old, filePerm); err != nil {
+			return fmt.Errorf("backup: %w", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, buf.Bytes(), filePerm)
+}
+
+// keyFields are the keys of a user configuration that SaveKeys writes
+var keyFields = []string{"encrypt_private_key", "sign_private_key", "key_version", "issued_at", "expires_at"}
+
+// SaveKeys records the keys of the identity uc, the user or one of identities, in the last of the files at paths
+// whose user or identities entry has its uid, i.e. the layer defining the identity. Only the key fields of that entry
+// are written; the rest of the file is left as it is, rather than filled in with defaults or with values that the
+// environment or command line may have overridden. If no file defines the identity, as when its uid is set by the
+// environment or command line, an error is returned unless uc holds no keys, they being kept in a key store; use
+// CheckSaveKeys to find this out before keys are issued.
+func SaveKeys(paths []string, uc *client.UserConfig) error {
+	var src yaml.Node
+	if err := src.Encode(uc); err != nil {
+		return err
+	}
+
+	path, old, doc, entry, err := locateIdentity(paths, uc.Uid)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		if uc.EncryptPrivateKey != "" || uc.SignPrivateKey != "" {
+			return errNoIdentity(paths, uc.Uid)
+		}
+		return nil
+	}
+	for _, key := range keyFields {
+		if j := find(&src, key); j >= 0 {
+			set(entry, src.Content[j], src.Content[j+1])
+		} else {
+			remove(entry, key) // omitted as empty
+		}
+	}
+	return write(path, old, doc)
+}
+
+// CheckSaveKeys reports an error if SaveKeys could not record keys for the identity with the uid, as none of the files
+// at paths defines it
+func CheckSaveKeys(paths []string, uid string) error {
+	_, _, _, entry, err := locateIdentity(paths, uid)
+	if err == nil && entry == nil {
+		err = errNoIdentity(paths, uid)
+	}
+	return err
+}
+
+func errNoIdentity(paths []string, uid string) error {
+	return fmt.Errorf("%s: no identity with uid %q", strings.Join(paths, ", "), uid)
+}
+
+// locateIdentity returns the last of the files at paths defining the identity with the uid, with its contents, parsed
+// document and the mapping of the identity. The mapping is nil if no file defines the identity.
+func locateIdentity(paths []string, uid string) (path string, old []byte, doc *yaml.Node, entry *yaml.Node, err error) {
+	for i := len(paths) - 1; i >= 0; i-- {
+		path = paths[i]
+		if old, err = ioutil.ReadFile(path); err != nil {
+			return "", nil, nil, nil, err
+		}
+		doc = &yaml.Node{}
+		if err = yaml.Unmarshal(old, doc); err != nil {
+			return "", nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if entry = findIdentity(doc, uid); entry != nil {
+			return path, old, doc, entry, nil
+		}
+	}
+	return "", nil, nil, nil, nil
+}
+
+// findIdentity returns the mapping of the user or of the entry of identities with the uid in doc, nil if there is none
+func findIdentity(doc *yaml.Node, uid string) *yaml.Node {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+	root := doc.Content[0]
+
+	hasUid := func(n *yaml.Node) bool {
+		if n.Kind != yaml.MappingNode {
+			return false
+		}
+		j := find(n, "uid")
+		return j >= 0 && n.Content[j+1].Kind == yaml.ScalarNode && n.Content[j+1].Value == uid
+	}
+	if j := find(root, "user"); j >= 0 && hasUid(root.Content[j+1]) {
+		return root.Content[j+1]
+	}
+	if j := find(root, "identities"); j >= 0 && root.Content[j+1].Kind == yaml.SequenceNode {
+		for _, n := range root.Content[j+1].Content {
+			if hasUid(n) {
+				return n
+			}
+		}
+	}
+	return nil
+}
+
+// set gives key the value in the mapping node, adding it if it is not there
+func set(mapping, key, value *yaml.Node) {
+	if j := find(mapping, key.Value); j >= 0 {
+		replace(mapping.Content[j+1], value)
+		return
+	}
+	mapping.Content = append(mapping.Content, key, value)
+}
+
+// remove deletes key from the mapping node, if it is there
+func remove(mapping *yaml.Node, key string) {
+	if j := find(mapping, key); j >= 0 {
+		mapping.Content = append(mapping.Content[:j], mapping.Content[j+2:]...)
+	}
+}
+
+// merge updates dst, a node of the existing file, with the values of src, the encoding of a value of type t. Keys of
+// mappings missing from src are removed if t defines them (they were omitted as empty) and kept otherwise.
+func merge(dst, src *yaml.Node, t reflect.Type) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if dst.Kind != yaml.MappingNode || src.Kind != yaml.MappingNode {
+		replace(dst, src)
+		return
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		seen[key.Value] = true
+		if j := find(dst, key.Value); j >= 0 {
+			merge(dst.Content[j+1], value, fieldType(t, key.Value))
+		} else {
+			dst.Content = append(dst.Content, key, value)
+		}
+	}
+
+	content := dst.Content[:0]
+	for i := 0; i+1 < len(dst.Content); i += 2 {
+		key := dst.Content[i].Value
+		if !seen[key] && fieldType(t, key) != nil {
+			continue
+		}
+		content = append(content, dst.Content[i], dst.Content[i+1])
+	}
+	dst.Content = content
+}
+
+// replace gives dst the value of src, keeping the comments of dst and its quoting of strings
+func replace(dst, src *yaml.Node) {
+	style := src.Style
+	if dst.Kind == yaml.ScalarNode && src.Kind == yaml.ScalarNode && src.Tag == "!!str" &&
+		dst.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0 {
+		style = dst.Style
+	}
+	dst.Kind = src.Kind
+	dst.Tag = src.Tag
+	dst.Value = src.Value
+	dst.Content = src.Content
+	dst.Style = style
+}
+
+// find returns the index of key in the mapping node, -1 if it is not there
+func find(mapping *yaml.Node, key string) int {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// fieldType returns the type of the value stored under key by a value of type t, nil if t does not define the key
+func fieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := strings.Split(f.Tag.Get("yaml"), ",")
+			if len(tag) > 1 && tag[1] == "inline" {
+				if ft := fieldType(f.Type, key); ft != nil {
+					return ft
+				}
+				continue
+			}
+			name := tag[0]
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			if name == key && f.PkgPath == "" {
+				return f.Type
+			}
+		}
+	}
+	return nil
+}
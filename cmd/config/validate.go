@@ -0,0 +1,281 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/gateway"
+	"github.com/opensvn/auth-client/keystore"
+	"github.com/opensvn/auth-client/provision"
+)
+
+// mqttSchemes are the broker URL schemes the connection manager can dial
+var mqttSchemes = map[string]bool{
+	"mqtt": true, "tcp": true,
+	"ssl": true, "tls": true, "mqtts": true, "mqtt+ssl": true, "tcps": true,
+	"ws": true, "wss": true,
+}
+
+// Validate checks every value of the configuration, including that the keys of each identity parse. Every problem is
+// reported, as a *KeyError naming the key in the returned Errors; nil is returned if there are none.
+func (c *Config) Validate() error {
+	v := &validator{}
+	v.mqtt(&c.Mqtt)
+	v.user("user", &c.User)
+	v.identities(c)
+	v.gateway(&c.Gateway)
+	v.addr(&c.Addr)
+	v.provision(&c.Provision)
+	v.keyStore(&c.KeyStore)
+	v.log(&c.Log)
+	v.listenAddr("monitor.addr", c.Monitor.Addr)
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// validator collects the problems found by Validate
+type validator struct {
+	errs Errors
+}
+
+func (v *validator) add(key string, err error) {
+	v.errs = append(v.errs, &KeyError{Key: key, Err: err})
+}
+
+func (v *validator) addf(key, format string, args ...interface{}) {
+	v.add(key, fmt.Errorf(format, args...))
+}
+
+func (v *validator) required(key, value string) bool {
+	if value == "" {
+		v.add(key, client.ErrFieldMissing)
+		return false
+	}
+	return true
+}
+
+func (v *validator) mqtt(m *MqttConfig) {
+	if v.required("mqtt.server_addr", m.ServerAddr) {
+		u, err := url.Parse(m.ServerAddr)
+		switch {
+		case err != nil:
+			v.add("mqtt.server_addr", err)
+		case !mqttSchemes[u.Scheme]:
+			v.addf("mqtt.server_addr", "unsupported scheme %q (expected mqtt, tcp, ssl, tls, mqtts, ws or wss)", u.Scheme)
+		case u.Host == "":
+			v.addf("mqtt.server_addr", "host missing")
+		}
+	}
+	v.required("mqtt.client_id", m.ClientID)
+	if v.required("mqtt.topic", m.Topic) {
+		v.topicFilter("mqtt.topic", m.Topic)
+	}
+	v.qos("mqtt.qos", m.Qos)
+	if m.Keepalive == 0 {
+		v.addf("mqtt.keepalive", "must be at least 1 second")
+	}
+	if m.ConnectRetryDelay == 0 {
+		v.addf("mqtt.connect_retry_delay", "must be at least 1 millisecond")
+	}
+	if m.WriteToDisk && m.OutputFileName == "" {
+		v.addf("mqtt.output_filename", "required when mqtt.write_to_disk is set")
+	}
+	if m.SinkRetryAttempts < 0 {
+		v.addf("mqtt.sink_retry_attempts", "must not be negative")
+	}
+	if m.Dispatcher.Workers < 0 {
+		v.addf("mqtt.dispatcher.workers", "must not be negative")
+	}
+	if m.Dispatcher.QueueSize < 0 {
+		v.addf("mqtt.dispatcher.queue_size", "must not be negative")
+	}
+	if _, err := client.ParseOverflowPolicy(m.Dispatcher.Overflow); err != nil {
+		v.add("mqtt.dispatcher.overflow", err)
+	}
+}
+
+func (v *validator) qos(key string, qos byte) {
+	if qos > 2 {
+		v.addf(key, "must be 0, 1 or 2, not %d", qos)
+	}
+}
+
+// topicFilter checks that the wildcards of a subscription's topic filter stand alone in their levels, and that # is
+// the last level
+func (v *validator) topicFilter(key, filter string) {
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case strings.Contains(level, "#") && (level != "#" || i != len(levels)-1):
+			v.addf(key, "# must be the whole of the last level of %q", filter)
+			return
+		case strings.Contains(level, "+") && level != "+":
+			v.addf(key, "+ must be the whole of a level of %q", filter)
+			return
+		}
+	}
+}
+
+// user checks the uid, hids and keys of an identity, as NewUserWithError parses them, reporting every field at fault
+func (v *validator) user(prefix string, uc *client.UserConfig) {
+	for _, fe := range client.CheckUserConfig(uc, client.UserOptions{}) {
+		v.add(prefix+"."+fe.Field, fe.Err)
+	}
+}
+
+func (v *validator) identities(c *Config) {
+	uids := map[string]string{c.User.Uid: "user"}
+	clientIDs := map[string]string{c.Mqtt.ClientID: "user"}
+	outputFiles := map[string]string{filepath.Clean(c.Mqtt.OutputFileName): "user"}
+	for i := range c.Identities {
+		id := &c.Identities[i]
+		prefix := fmt.Sprintf("identities[%d]", i)
+		v.user(prefix, &id.UserConfig)
+
+		if other, ok := uids[id.Uid]; ok && id.Uid != "" {
+			v.addf(prefix+".uid", "%q is also the uid of %s", id.Uid, other)
+		}
+		uids[id.Uid] = prefix
+
+		clientID := id.ClientID
+		if clientID == "" {
+			clientID = c.Mqtt.ClientID + "-" + id.Uid
+		}
+		if other, ok := clientIDs[clientID]; ok {
+			v.addf(prefix+".client_id", "%q is also the client id of %s", clientID, other)
+		}
+		clientIDs[clientID] = prefix
+
+		if c.Mqtt.WriteToDisk {
+			outputFile := filepath.Clean(id.OutputFile(&c.Mqtt))
+			if other, ok := outputFiles[outputFile]; ok {
+				v.addf(prefix+".output_filename", "%q is also the output file of %s", outputFile, other)
+			}
+			outputFiles[outputFile] = prefix
+		}
+
+		if id.Topic != "" {
+			v.topicFilter(prefix+".topic", id.Topic)
+		}
+	}
+}
+
+func (v *validator) gateway(g *GatewayConfig) {
+	for i, addr := range g.Listen {
+		key := fmt.Sprintf("gateway.listen[%d]", i)
+		u, err := url.Parse(addr)
+		if err != nil || u.Scheme == "" || u.Opaque != "" {
+			// host:port, which url.Parse takes for a scheme and opaque part
+			v.listenAddr(key, addr)
+			continue
+		}
+		switch u.Scheme {
+		case "unix":
+			if u.Path == "" {
+				v.addf(key, "socket path missing")
+			}
+		case "tcp", "mqtt":
+			v.listenAddr(key, u.Host)
+		default:
+			v.addf(key, "unsupported scheme %q (expected unix, tcp or mqtt)", u.Scheme)
+		}
+	}
+	if err := gateway.ValidateTopicPrefix(g.TopicPrefix); err != nil {
+		v.add("gateway.topic_prefix", err)
+	}
+	for i, uid := range g.Devices {
+		if uid == "" {
+			v.add(fmt.Sprintf("gateway.devices[%d]", i), client.ErrFieldMissing)
+		}
+	}
+}
+
+// listenAddr checks a host:port address to listen on, if set
+func (v *validator) listenAddr(key, addr string) {
+	if addr == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		v.add(key, err)
+	}
+}
+
+func (v *validator) addr(a *AddrConfig) {
+	v.endpoint("addr.ra", a.Ra)
+	v.endpoint("addr.platform", a.Platform)
+	if a.Token != "" && (!strings.HasPrefix(a.Ra, "https://") || !strings.HasPrefix(a.Platform, "https://")) {
+		v.addf("addr.token", "requires https:// addresses for addr.ra and addr.platform, as it is not sent over plain http")
+	}
+	if (a.TLS.CertFile == "") != (a.TLS.KeyFile == "") {
+		v.addf("addr.tls", "cert_file and key_file must be set together")
+	}
+	for i, pin := range a.TLS.Pins {
+		if _, err := provision.ParsePin(pin); err != nil {
+			v.addf(fmt.Sprintf("addr.tls.pins[%d]", i), "expected a hex SHA-256 digest")
+		}
+	}
+}
+
+// endpoint checks an RA or platform address: an http:// or https:// URL, or host:port for plain http
+func (v *validator) endpoint(key, addr string) {
+	if !v.required(key, addr) {
+		return
+	}
+	if !strings.Contains(addr, "://") {
+		v.listenAddr(key, addr)
+		return
+	}
+	u, err := url.Parse(addr)
+	switch {
+	case err != nil:
+		v.add(key, err)
+	case u.Scheme != "http" && u.Scheme != "https":
+		v.addf(key, "unsupported scheme %q (expected http or https)", u.Scheme)
+	case u.Host == "":
+		v.addf(key, "host missing")
+	}
+}
+
+func (v *validator) provision(p *ProvisionConfig) {
+	if p.PollMaxInterval != 0 && p.PollMaxInterval < p.PollInterval {
+		v.addf("provision.poll_max_interval", "must not be less than provision.poll_interval")
+	}
+	if p.PollJitter > 100 {
+		v.addf("provision.poll_jitter", "must be a percentage, not %d", p.PollJitter)
+	}
+	if p.PKGHid != 0 {
+		if err := client.ValidateEncryptHid(p.PKGHid); err != nil {
+			v.add("provision.pkg_hid", err)
+		}
+	}
+}
+
+func (v *validator) keyStore(k *KeyStoreConfig) {
+	switch k.Type {
+	case "":
+	case keystore.TypeFile, keystore.TypeEncrypted:
+		v.required("key_store.path", k.Path)
+	default:
+		for _, name := range keystore.Tokens() {
+			if name == k.Type {
+				return
+			}
+		}
+		v.addf("key_store.type", "unknown key store %q (expected file, encrypted or one of the registered tokens %v)", k.Type, keystore.Tokens())
+	}
+}
+
+func (v *validator) log(l *LogConfig) {
+	if _, err := client.ParseLevel(l.Level); err != nil {
+		v.add("log.level", err)
+	}
+	if _, err := client.ParseLogFormat(l.Format); err != nil {
+		v.add("log.format", err)
+	}
+}
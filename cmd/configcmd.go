@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/opensvn/auth-client/cmd/config"
+)
+
+// runConfig runs the config subcommand named by the first argument
+func runConfig(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usageError("config subcommand required")
+	}
+	switch args[0] {
+	case "check":
+		return runConfigCheck(args[1:])
+	case "print":
+		return runConfigPrint(args[1:])
+	}
+	return usageError(fmt.Sprintf("unknown config subcommand %q", args[0]))
+}
+
+// runConfigCheck checks that the configuration can be used without connecting or provisioning: that it parses and
+// validates, its key store and TLS files open, and any keys its identities hold are valid
+func runConfigCheck(args []string) error {
+	fs := newFlagSet("config check")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	e, ids, err := loadIdentities(fs, "")
+	if err != nil {
+		return err
+	}
+
+	if _, err := newProvisioner(e.conf, e.logger); err != nil {
+		return fmt.Errorf("addr.tls: %w", err)
+	}
+	for _, id := range ids {
+		user, _, err := readUser(id.user, e.store, e.logger)
+		if err != nil {
+			return fmt.Errorf("identity %q: %w", id.user.Uid, err)
+		}
+		if needsKeys(user) {
+			if e.store == nil {
+				if err := config.CheckSaveKeys(configFiles, id.user.Uid); err != nil {
+					return fmt.Errorf("identity %q: keys could not be saved: %w", id.user.Uid, err)
+				}
+			}
+			fmt.Fprintf(os.Stdout, "%s: keys will be provisioned on connecting\n", id.user.Uid)
+			continue
+		}
+		if err := user.Validate(); err != nil {
+			return fmt.Errorf("identity %q: %w", id.user.Uid, err)
+		}
+	}
+
+	fmt.Fprintf(os.Stdout, "%s: ok\n", strings.Join(configFiles, ", "))
+	return nil
+}
+
+// runConfigPrint prints the configuration files merged or, with -effective, the configuration in effect once the
+// defaults, environment and --set are applied too. Private keys, tokens and PINs are redacted.
+func runConfigPrint(args []string) error {
+	fs := newFlagSet("config print")
+	effective := fs.Bool("effective", false, "include the defaults, environment variables and --set overrides")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError("unexpected arguments")
+	}
+
+	var (
+		conf *config.Config
+		err  error
+	)
+	if *effective {
+		conf, err = loadConfig()
+	} else {
+		conf, err = config.Load(config.Layers{Base: &config.Config{}, Files: configFiles})
+	}
+	if err != nil {
+		return err
+	}
+
+	buf, err := config.MarshalRedacted(conf)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(buf)
+	return err
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/gateway"
+	"github.com/opensvn/auth-client/metrics"
+)
+
+// runConnect connects every identity, acting as a gateway if configured, until ctx is cancelled
+func runConnect(ctx context.Context, args []string) error {
+	fs := newFlagSet("connect")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError("unexpected arguments")
+	}
+
+	e, err := loadEnv(os.Stdout)
+	if err != nil {
+		return err
+	}
+	conf, logger := e.conf, e.logger
+
+	var (
+		mon             *monitor
+		clientMetrics   *client.Metrics
+		keysProvisioned *metrics.Gauge
+	)
+	if conf.Monitor.Addr != "" {
+		registry := metrics.NewRegistry()
+		clientMetrics = client.NewMetrics(registry)
+		keysProvisioned = registry.NewGauge("authclient_keys_provisioned", "1 once the device holds its SM9 private keys.")
+		mon = startMonitor(conf.Monitor.Addr, registry, logger)
+		defer mon.stop()
+	}
+
+	ids, err := identities(conf)
+	if err != nil {
+		return err
+	}
+
+	users := make([]*client.User, len(ids))
+	for i, id := range ids {
+		users[i], err = prepareUser(ctx, conf, id, e.store, logger)
+		if err != nil {
+			return fmt.Errorf("identity %q unusable: %w", id.user.Uid, err)
+		}
+	}
+	if keysProvisioned != nil {
+		keysProvisioned.Set(1)
+	}
+
+	serverUrl, err := url.Parse(conf.Mqtt.ServerAddr)
+	if err != nil {
+		return fmt.Errorf("invalid server address: %w", err)
+	}
+
+	// Each identity has a client of its own, connected over its own connection
+	pool := client.NewPool(serverUrl)
+	pool.Logger = logger
+	pool.Metrics = clientMetrics
+	for i, id := range ids {
+		if _, err := pool.Add(users[i], id.client); err != nil {
+			return fmt.Errorf("invalid identity configuration: %w", err)
+		}
+	}
+	if mon != nil {
+		mon.serveHealth(pool)
+	}
+
+	// In gateway mode sub-devices are forwarded over the connection of the first identity
+	var gw *gateway.Gateway
+	if len(conf.Gateway.Listen) > 0 {
+		gw, err = newGateway(conf, pool.Client(string(users[0].Uid)), users[0], logger)
+		if err != nil {
+			return fmt.Errorf("invalid gateway configuration: %w", err)
+		}
+	}
+
+	// Connect to the broker
+	if err := pool.Connect(); err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+
+	if gw != nil {
+		defer gw.Close()
+		for _, addr := range conf.Gateway.Listen {
+			if _, err := gw.Listen(addr); err != nil {
+				logger.Error("gateway listen error", "addr", addr, "err", err)
+				continue
+			}
+			logger.Info("gateway listening", "addr", addr)
+		}
+	}
+
+	// Keys that expire are renewed in the background, the client reconnecting with each new set
+	for i, id := range ids {
+		if users[i].ExpiresAt.IsZero() {
+			continue
+		}
+		if err := startRenewer(ctx, conf, id, e.store, logger, pool, users[i]); err != nil {
+			logger.Error("key renewal disabled", "uid", id.user.Uid, "err", err)
+		}
+	}
+
+	// Messages will be handled through the callback so we really just need to wait until a shutdown is requested
+	<-ctx.Done()
+
+	// We could cancel the context at this point but will call Disconnect instead (this waits for autopaho to shutdown)
+	if err := pool.Disconnect(); err != nil {
+		return fmt.Errorf("disconnect: %w", err)
+	}
+	return nil
+}
+
+// runSubscribe connects one identity, writing the messages received on a topic to standard output until ctx is
+// cancelled
+func runSubscribe(ctx context.Context, args []string) error {
+	fs := newFlagSet("subscribe")
+	uid := fs.String("uid", "", "`uid` of the identity to connect as (the user if empty)")
+	topic := fs.String("topic", "", "`topic` filter to subscribe to (mqtt.topic if empty)")
+	qos := fs.Int("qos", -1, "QoS of the subscription (mqtt.qos if negative)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError("unexpected arguments")
+	}
+	if *qos > 2 {
+		return usageError("qos must be 0, 1 or 2")
+	}
+
+	e, err := loadEnv(os.Stderr)
+	if err != nil {
+		return err
+	}
+	c, err := connectOne(ctx, e, *uid, func(cc *client.ClientConfig) {
+		cc.Topic = orDefault(*topic, cc.Topic)
+		if *qos >= 0 {
+			cc.Qos = byte(*qos)
+		}
+		cc.WriteToStdOut = true
+		cc.WriteToDisk = false
+	})
+	if err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+	return c.Disconnect()
+}
+
+// publishTimeout bounds how long publish waits for the connection to come up
+const publishTimeout = 30 * time.Second
+
+// runPublish connects one identity and publishes a message, given as arguments or read from a file
+func runPublish(ctx context.Context, args []string) error {
+	fs := newFlagSet("publish")
+	uid := fs.String("uid", "", "`uid` of the identity to connect as (the user if empty)")
+	topic := fs.String("topic", "", "`topic` to publish to")
+	qos := fs.Int("qos", 0, "QoS of the message")
+	retain := fs.Bool("retain", false, "ask the broker to retain the message")
+	file := fs.String("file", "", "read the payload from `path` (- for standard input) rather than the arguments")
+	timeout := fs.Duration("timeout", publishTimeout, "how long to wait for the connection")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch {
+	case *topic == "":
+		return usageError("-topic required")
+	case *qos < 0 || *qos > 2:
+		return usageError("qos must be 0, 1 or 2")
+	case *file != "" && fs.NArg() > 0:
+		return usageError("give the message either as arguments or with -file")
+	}
+
+	var payload []byte
+	switch *file {
+	case "":
+		payload = []byte(strings.Join(fs.Args(), " "))
+	case "-":
+		buf, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		payload = buf
+	default:
+		buf, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		payload = buf
+	}
+
+	e, err := loadEnv(os.Stderr)
+	if err != nil {
+		return err
+	}
+	c, err := connectOne(ctx, e, *uid, func(cc *client.ClientConfig) {
+		// The subscription made on connecting is still made, but its messages are discarded
+		cc.WriteToStdOut = false
+		cc.WriteToDisk = false
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Disconnect()
+
+	waitCtx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	if err := c.AwaitConnection(waitCtx); err != nil {
+		return fmt.Errorf("connection not established: %w", err)
+	}
+	return c.PublishMessage(*topic, byte(*qos), *retain, payload)
+}
+
+// connectOne prepares the user of the identity with the uid, provisioning its keys if need be, and connects it with
+// its client configuration adjusted by configure
+func connectOne(ctx context.Context, e *env, uid string, configure func(*client.ClientConfig)) (*client.Client, error) {
+	id, err := findIdentity(e.conf, uid)
+	if err != nil {
+		return nil, err
+	}
+	user, err := prepareUser(ctx, e.conf, id, e.store, e.logger)
+	if err != nil {
+		return nil, fmt.Errorf("identity %q unusable: %w", id.user.Uid, err)
+	}
+	serverUrl, err := url.Parse(e.conf.Mqtt.ServerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address: %w", err)
+	}
+
+	cc := *id.client
+	configure(&cc)
+	c := &client.Client{
+		ServerUrl: serverUrl,
+		User:      user,
+		Config:    &cc,
+		Logger:    e.logger,
+	}
+	c.AuthHandler = client.NewSm9Auth(c)
+	if err := c.Connect(); err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	return c, nil
+}
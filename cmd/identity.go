@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/cmd/config"
+	"github.com/opensvn/auth-client/provision"
+)
+
+// identity is one of the SM9 identities the device connects as
+type identity struct {
+	user    *client.UserConfig // in the configuration, updated as keys are issued
+	client  *client.ClientConfig
+	request provision.Request
+}
+
+// identities returns the identities in the configuration, user first
+func identities(conf *config.Config) ([]*identity, error) {
+	base, err := clientConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []*identity{{
+		user:   &conf.User,
+		client: base,
+		request: provision.Request{
+			Uid:        string(conf.User.Identity().ID()),
+			Username:   conf.Mqtt.ClientName,
+			DeviceType: conf.Mqtt.DeviceType,
+		},
+	}}
+	for i := range conf.Identities {
+		ic := &conf.Identities[i]
+		cc := *base
+		cc.ClientID = orDefault(ic.ClientID, base.ClientID+"-"+ic.Uid)
+		cc.ClientName = orDefault(ic.ClientName, base.ClientName)
+		cc.Topic = orDefault(ic.Topic, base.Topic)
+		cc.OutputFileName = ic.OutputFile(&conf.Mqtt)
+		ids = append(ids, &identity{
+			user:   &ic.UserConfig,
+			client: &cc,
+			request: provision.Request{
+				Uid:        string(ic.Identity().ID()),
+				Username:   cc.ClientName,
+				DeviceType: orDefault(ic.DeviceType, conf.Mqtt.DeviceType),
+			},
+		})
+	}
+	return ids, nil
+}
+
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// clientConfig returns the client configuration in mqtt
+func clientConfig(conf *config.Config) (*client.ClientConfig, error) {
+	overflow, err := client.ParseOverflowPolicy(conf.Mqtt.Dispatcher.Overflow)
+	if err != nil {
+		return nil, err
+	}
+
+	return &client.ClientConfig{
+		ClientID:          conf.Mqtt.ClientID,
+		ClientName:        conf.Mqtt.ClientName,
+		Topic:             conf.Mqtt.Topic,
+		Qos:               conf.Mqtt.Qos,
+		Keepalive:         conf.Mqtt.Keepalive,
+		ConnectRetryDelay: conf.Mqtt.ConnectRetryDelay,
+		WriteToStdOut:     conf.Mqtt.WriteToStdOut,
+		WriteToDisk:       conf.Mqtt.WriteToDisk,
+		OutputFileName:    conf.Mqtt.OutputFileName,
+		SinkRetry: client.RetryPolicy{
+			Attempts: conf.Mqtt.SinkRetryAttempts,
+			Delay:    time.Duration(conf.Mqtt.SinkRetryDelay) * time.Millisecond,
+		},
+		Debug: conf.Mqtt.Debug,
+		Dispatcher: client.DispatcherConfig{
+			Workers:         conf.Mqtt.Dispatcher.Workers,
+			QueueSize:       conf.Mqtt.Dispatcher.QueueSize,
+			OrderedPerTopic: conf.Mqtt.Dispatcher.OrderedPerTopic,
+			Overflow:        overflow,
+		},
+	}, nil
+}
+
+// findIdentity returns the identity with the uid, the user if uid is empty
+func findIdentity(conf *config.Config, uid string) (*identity, error) {
+	ids, err := selectIdentities(conf, uid)
+	if err != nil {
+		return nil, err
+	}
+	return ids[0], nil
+}
+
+// selectIdentities returns the identity with the uid, or every identity if uid is empty
+func selectIdentities(conf *config.Config, uid string) ([]*identity, error) {
+	ids, err := identities(conf)
+	if err != nil {
+		return nil, err
+	}
+	if uid == "" {
+		return ids, nil
+	}
+	for _, id := range ids {
+		if id.user.Uid == uid {
+			return []*identity{id}, nil
+		}
+	}
+	return nil, fmt.Errorf("no identity with uid %q", uid)
+}
+
+// prepareUser loads the user of the identity, provisioning its keys if it has none or they have expired, and checks
+// that they are usable
+func prepareUser(ctx context.Context, conf *config.Config, id *identity, store client.KeyStore, logger client.Logger) (*client.User, error) {
+	user, err := loadUser(id.user, store, logger)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user configuration: %w", err)
+	}
+
+	if needsKeys(user) {
+		if err := provisionUser(ctx, conf, id, store, logger, user); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := user.Validate(); err != nil {
+		return nil, fmt.Errorf("private keys do not match the identity and master public keys: %w", err)
+	}
+	return user, nil
+}
+
+// needsKeys reports whether the user lacks a private key or holds expired keys
+func needsKeys(user *client.User) bool {
+	return user.GetEncryptPrivateKey() == nil || user.GetSignPrivateKey() == nil || user.Expired()
+}
+
+// provisionUser obtains keys for the identity from the RA and platform, setting them in user and saving them
+func provisionUser(ctx context.Context, conf *config.Config, id *identity, store client.KeyStore, logger client.Logger, user *client.User) error {
+	p, err := newProvisioner(conf, logger)
+	if err != nil {
+		return fmt.Errorf("invalid tls configuration: %w", err)
+	}
+	if store == nil {
+		// Checked before the keys are issued, as they would be lost if they could not be saved
+		if err := config.CheckSaveKeys(configFiles, id.user.Uid); err != nil {
+			return fmt.Errorf("keys could not be saved: %w (set the uid in a configuration file or use a key store)", err)
+		}
+	}
+	keys, err := p.Provision(ctx, user, id.request)
+	if err != nil {
+		return fmt.Errorf("provision keys: %w", err)
+	}
+	if err := saveKeys(id.user, store, keys); err != nil {
+		return fmt.Errorf("save keys: %w", err)
+	}
+	return nil
+}
+
+// startRenewer renews the keys of the identity in the background until ctx is cancelled
+func startRenewer(ctx context.Context, conf *config.Config, id *identity, store client.KeyStore, logger client.Logger, pool *client.Pool, user *client.User) error {
+	p, err := newProvisioner(conf, logger)
+	if err != nil {
+		return err
+	}
+
+	r := &provision.Renewer{
+		Provisioner: p,
+		Request:     id.request,
+		Before:      time.Duration(conf.Provision.RenewBefore) * time.Second,
+		Retry:       p.Poll,
+		OnRenewed: func(u *client.User, keys *provision.Keys) error {
+			if err := saveKeys(id.user, store, keys); err != nil {
+				return err
+			}
+			return pool.UpdateUser(u)
+		},
+	}
+	go func() {
+		if err := r.Run(ctx, user); err != nil && ctx.Err() == nil {
+			logger.Error("key renewal stopped", "uid", id.user.Uid, "err", err)
+		}
+	}()
+	return nil
+}
+
+// loadUser creates the user from its configuration, with its private keys taken from the key store if there is one.
+// Keys found in the configuration file whilst the store holds none are moved to the store.
+func loadUser(uc *client.UserConfig, store client.KeyStore, logger client.Logger) (*client.User, error) {
+	user, move, err := readUser(uc, store, logger)
+	if err != nil || !move {
+		return user, err
+	}
+	if err := writeKeys(uc, store); err != nil {
+		return nil, err
+	}
+	logger.Info("moved private keys from the configuration file to the key store", "uid", uc.Uid)
+	return user, nil
+}
+
+// readUser creates the user like loadUser but writes nothing, reporting instead whether its keys should be moved from
+// the configuration file to the key store
+func readUser(uc *client.UserConfig, store client.KeyStore, logger client.Logger) (user *client.User, move bool, err error) {
+	if store == nil {
+		user, err = client.NewUserWithError(uc, client.UserOptions{})
+		return user, false, err
+	}
+	if uc.EncryptPrivateKey == "" && uc.SignPrivateKey == "" {
+		user, err = client.NewUserFromStore(uc, store)
+		return user, false, err
+	}
+
+	_, err = client.LoadKeys(uc, store)
+	if err == nil {
+		logger.Warn("private keys in the configuration file are ignored in favour of the key store", "uid", uc.Uid)
+		user, err = client.NewUserFromStore(uc, store)
+		return user, false, err
+	}
+	if !errors.Is(err, client.ErrKeysNotFound) {
+		return nil, false, err
+	}
+
+	user, err = client.NewUserWithError(uc, client.UserOptions{})
+	return user, err == nil, err
+}
+
+// saveMu serialises updates of the configuration, as the keys of several identities may be renewed at once
+var saveMu sync.Mutex
+
+// saveKeys records newly issued keys in the key store, or the configuration file if there is none
+func saveKeys(uc *client.UserConfig, store client.KeyStore, keys *provision.Keys) error {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	uc.EncryptPrivateKey = keys.EncryptKey
+	uc.SignPrivateKey = keys.SignKey
+	uc.KeyVersion = keys.Version
+	uc.IssuedAt = keys.IssuedAt
+	uc.ExpiresAt = keys.ExpiresAt
+	return writeKeys(uc, store)
+}
+
+// writeKeys moves the keys of uc to the key store, if there is one, then writes them to the configuration file
+// defining the identity
+func writeKeys(uc *client.UserConfig, store client.KeyStore) error {
+	if store != nil {
+		if err := client.SaveUser(uc, store); err != nil {
+			return err
+		}
+	}
+	return config.SaveKeys(configFiles, uc)
+}
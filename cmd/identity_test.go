@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/cmd/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentities(t *testing.T) {
+	conf := config.Default()
+	conf.User = client.UserConfig{Uid: "device1", IdentitySuffix: "|2026"}
+	conf.Identities = []config.IdentityConfig{
+		{UserConfig: client.UserConfig{Uid: "sub1", IdentitySuffix: "|2026"}},
+	}
+
+	ids, err := identities(conf)
+	assert.Nil(t, err)
+	assert.Len(t, ids, 2)
+
+	// Keys are requested for each identity with its suffix
+	assert.Equal(t, "device1|2026", ids[0].request.Uid)
+	assert.Equal(t, "sub1|2026", ids[1].request.Uid)
+
+	assert.Equal(t, "msg.txt", ids[0].client.OutputFileName)
+	assert.Equal(t, "msg-sub1.txt", ids[1].client.OutputFileName)
+	assert.Equal(t, conf.Mqtt.ClientID+"-sub1", ids[1].client.ClientID)
+}
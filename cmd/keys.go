@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/opensvn/auth-client"
+)
+
+// runKeys runs the keys subcommand named by the first argument
+func runKeys(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usageError("keys subcommand required")
+	}
+	switch args[0] {
+	case "show":
+		return runKeysShow(args[1:])
+	case "validate":
+		return runKeysValidate(args[1:])
+	case "export":
+		return runKeysExport(args[1:])
+	}
+	return usageError(fmt.Sprintf("unknown keys subcommand %q", args[0]))
+}
+
+// runKeysShow prints the identity, hids, key lifetime and the keys held of each identity, but no key material
+func runKeysShow(args []string) error {
+	fs := newFlagSet("keys show")
+	uid := fs.String("uid", "", "`uid` of the identity to show (every identity if empty)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	e, ids, err := loadIdentities(fs, *uid)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for i, id := range ids {
+		user, _, err := readUser(id.user, e.store, e.logger)
+		if err != nil {
+			return fmt.Errorf("identity %q: %w", id.user.Uid, err)
+		}
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "uid:\t%s\n", id.user.Uid)
+		fmt.Fprintf(w, "identity:\t%s\n", user.Identity())
+		fmt.Fprintf(w, "key version:\t%d\n", user.KeyVersion)
+		fmt.Fprintf(w, "issued at:\t%s\n", formatTime(user.IssuedAt, "unknown"))
+		fmt.Fprintf(w, "expires at:\t%s\n", formatTime(user.ExpiresAt, "never"))
+		var held []string
+		for _, t := range user.HeldKeys() {
+			held = append(held, t.String())
+		}
+		fmt.Fprintf(w, "keys:\t%s\n", strings.Join(held, ", "))
+	}
+	return w.Flush()
+}
+
+func formatTime(t time.Time, zero string) string {
+	if t.IsZero() {
+		return zero
+	}
+	return t.Format(time.RFC3339)
+}
+
+// runKeysValidate checks that the keys of each identity match it and its master public keys and have not expired
+func runKeysValidate(args []string) error {
+	fs := newFlagSet("keys validate")
+	uid := fs.String("uid", "", "`uid` of the identity to validate (every identity if empty)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	e, ids, err := loadIdentities(fs, *uid)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, id := range ids {
+		user, _, err := readUser(id.user, e.store, e.logger)
+		if err == nil {
+			err = user.Validate()
+		}
+		if err != nil {
+			failed++
+			fmt.Printf("%s: %v\n", id.user.Uid, err)
+			continue
+		}
+		fmt.Printf("%s: ok\n", id.user.Uid)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d identities hold unusable keys", failed, len(ids))
+	}
+	return nil
+}
+
+// runKeysExport writes one key, or every key as PEM, of an identity
+func runKeysExport(args []string) error {
+	fs := newFlagSet("keys export")
+	uid := fs.String("uid", "", "`uid` of the identity (the user if empty)")
+	keyType := fs.String("type", "all", "key to export: sign-private-key, encrypt-private-key, sign-master-public-key, encrypt-master-public-key or all")
+	format := fs.String("format", "pem", "hex, der, base64 or pem (all requires pem)")
+	passwordFile := fs.String("password-file", "", "protect private keys exported as pem with the password in `path` (- for standard input)")
+	out := fs.String("out", "", "write to `path`, which must not exist and is created with mode 0600, rather than standard output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	f, err := client.ParseKeyFormat(*format)
+	if err != nil {
+		return usageError(err.Error())
+	}
+	var password []byte
+	if *passwordFile != "" {
+		if f != client.KeyFormatPEM {
+			return usageError("-password-file requires pem")
+		}
+		if password, err = readSecret(*passwordFile); err != nil {
+			return err
+		}
+	}
+
+	e, ids, err := loadIdentities(fs, *uid)
+	if err != nil {
+		return err
+	}
+	user, _, err := readUser(ids[0].user, e.store, e.logger)
+	if err != nil {
+		return fmt.Errorf("identity %q: %w", ids[0].user.Uid, err)
+	}
+
+	data, err := exportKeys(user, *keyType, f, password)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return writeNewFile(*out, data)
+}
+
+// writeNewFile writes data to a file created with mode 0600. The file must not exist, so that keys never land in a
+// file that others can already read.
+func writeNewFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// exportKeys encodes the key named, or every key if name is all
+func exportKeys(user *client.User, name string, f client.KeyFormat, password []byte) ([]byte, error) {
+	if name == "all" {
+		if f != client.KeyFormatPEM {
+			return nil, usageError("all keys can only be exported as pem")
+		}
+		return user.ExportPEM(password)
+	}
+
+	t, err := client.ParseKeyType(name)
+	if err != nil {
+		return nil, usageError(err.Error())
+	}
+	if t.Private() && len(password) > 0 {
+		der, err := user.MarshalEncryptedKey(t, password)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: client.PEMEncryptedPrivateKey, Bytes: der}), nil
+	}
+
+	data, err := user.ExportKey(t, f)
+	if err != nil {
+		return nil, err
+	}
+	if f == client.KeyFormatHex || f == client.KeyFormatBase64 {
+		data = append(data, '\n')
+	}
+	return data, nil
+}
+
+// loadIdentities loads the configuration for a keys subcommand and selects the identities it applies to
+func loadIdentities(fs *flag.FlagSet, uid string) (*env, []*identity, error) {
+	if fs.NArg() > 0 {
+		return nil, nil, usageError("unexpected arguments")
+	}
+	e, err := loadEnv(os.Stderr)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids, err := selectIdentities(e.conf, uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e, ids, nil
+}
@@ -1,156 +1,327 @@
 package main
 
 import (
-	"encoding/hex"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
-	"net/url"
 	"os"
 	"os/signal"
-	"sync"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/opensvn/auth-client"
 	"github.com/opensvn/auth-client/cmd/config"
-	"gopkg.in/yaml.v3"
+	"github.com/opensvn/auth-client/gateway"
+	"github.com/opensvn/auth-client/keystore"
+	"github.com/opensvn/auth-client/provision"
 )
 
+// configEnv names the environment variable selecting the configuration files, separated by the path list separator,
+// when --config is not given
+const configEnv = "AUTHCLIENT_CONFIG"
+
+// defaultConfigFile is the configuration file used if neither --config nor AUTHCLIENT_CONFIG name one
+const defaultConfigFile = "config/config.yml"
+
+var (
+	// configFiles are the configuration files, set by --config, each overriding those before it. Keys issued whilst
+	// running are written back to the file defining the identity.
+	configFiles []string
+	// settings are the key=value pairs given with --set, overriding the files and environment
+	settings []string
+)
+
+// listFlag is a flag that may be repeated, collecting its values
+type listFlag struct {
+	values *[]string
+}
+
+func (f listFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return strings.Join(*f.values, ",")
+}
+
+func (f listFlag) Set(value string) error {
+	*f.values = append(*f.values, value)
+	return nil
+}
+
+// command is a subcommand of the cli
+type command struct {
+	name  string
+	args  string // synopsis of the arguments, for the usage message
+	brief string
+	run   func(ctx context.Context, args []string) error
+}
+
+// commands lists the subcommands, the first being run when none is named
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"connect", "", "connect every identity and handle messages until interrupted (the default)", runConnect},
+		{"subscribe", "[-uid uid] [-topic topic] [-qos n]", "connect one identity and print the messages received", runSubscribe},
+		{"publish", "[-uid uid] -topic topic [-qos n] [-retain] [-file path | message]", "connect one identity and publish a message", runPublish},
+		{"provision", "[-uid uid] [-force]", "obtain private keys for identities that have none or hold expired keys", runProvision},
+		{"keys", "show|validate|export [flags]", "inspect, check or export the keys of the identities", runKeys},
+		{"config", "check | print [-effective]", "check the configuration, or print it with secrets redacted", runConfig},
+	}
+}
+
 func main() {
-	buf, err := ioutil.ReadFile("config/config.yml")
+	os.Exit(run(os.Args[1:]))
+}
+
+// run parses the global flags and runs the command named, returning the exit status
+func run(args []string) int {
+	configFiles, settings = nil, nil
+	fs := flag.NewFlagSet("authclient", flag.ContinueOnError)
+	fs.Var(listFlag{&configFiles}, "config", "configuration `file`, repeated to layer files (default "+defaultConfigFile+", or set "+configEnv+")")
+	fs.Var(listFlag{&settings}, "set", "override a configuration `key=value`, e.g. mqtt.qos=1 (repeatable)")
+	fs.Usage = func() { usage(fs.Output(), fs) }
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if len(configFiles) == 0 {
+		configFiles = filepath.SplitList(envOr(configEnv, defaultConfigFile))
+	}
+
+	cmd := commands[0]
+	args = fs.Args()
+	if len(args) > 0 {
+		if cmd = findCommand(args[0]); cmd == nil {
+			fmt.Fprintf(fs.Output(), "unknown command %q\n", args[0])
+			usage(fs.Output(), fs)
+			return 2
+		}
+		args = args[1:]
+	}
+
+	// Cancelled when a shutdown is requested, whether that is whilst provisioning or once connected
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := cmd.run(ctx, args)
+	var usageErr usageError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(os.Stderr, "authclient %s: %v\nusage: authclient %s %s\n", cmd.name, err, cmd.name, cmd.args)
+		return 2
+	}
+	fmt.Fprintf(os.Stderr, "authclient %s: %v\n", cmd.name, err)
+	return 1
+}
+
+func usage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintln(w, "usage: authclient [--config file]... [--set key=value]... [command] [flags]")
+	fmt.Fprintln(w, "\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.brief)
+	}
+	fmt.Fprintln(w, "\nglobal flags:")
+	fs.PrintDefaults()
+	fmt.Fprintln(w, "\nrun authclient <command> -h for the flags of a command")
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// usageError is returned by commands given arguments they cannot use
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// newFlagSet creates the flag set of a command, whose errors are returned rather than exiting
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("authclient "+name, flag.ContinueOnError)
+}
+
+func envOr(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// env holds what commands share: the configuration, the logger it selects and the key store
+type env struct {
+	conf   *config.Config
+	logger client.Logger
+	store  client.KeyStore
+}
+
+// loadConfig builds the configuration from the defaults, the files, the environment and --set, in that order of
+// precedence
+func loadConfig() (*config.Config, error) {
+	conf, err := config.Load(config.Layers{Files: configFiles, Env: os.Environ(), Set: settings})
 	if err != nil {
-		log.Printf("read config file error: %v\n", err)
-		return
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
 	}
+	return conf, nil
+}
 
-	conf := &config.Config{}
-	err = yaml.Unmarshal(buf, conf)
+// loadEnv loads and validates the configuration and opens the logger and key store it selects. The logger writes to w, standard
+// error for commands whose output is on standard output.
+func loadEnv(w io.Writer) (*env, error) {
+	conf, err := loadConfig()
 	if err != nil {
-		log.Printf("unmarshal config error: %v\n", err)
-		return
+		return nil, err
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
 	}
 
-	user := client.NewUser(&conf.User)
-	if user == nil || user.GetEncryptPrivateKey() == nil || user.GetSignPrivateKey() == nil {
-		random, err := ApplyKey(conf, user)
-		if err != nil {
-			log.Printf("apply key error: %v\n", err)
-			return
-		}
+	logger, err := newLogger(conf, w)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log configuration: %w", err)
+	}
+	store, err := newKeyStore(conf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key store configuration: %w", err)
+	}
+	return &env{conf: conf, logger: logger, store: store}, nil
+}
 
-		wg := &sync.WaitGroup{}
-		wg.Add(1)
-		go func () {
-			for {
-				time.Sleep(time.Second * 3)
-				keys, err := queryKey(conf)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-
-				if keys.EncryptKey == "" || keys.SignKey == "" {
-					continue
-				}
-
-				signKeyBuf, err := hex.DecodeString(keys.SignKey)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-
-				encryptKeyBuf, err := hex.DecodeString(keys.EncryptKey)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-
-				encryptKey, err := OfbEncrypt(random, encryptKeyBuf)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-
-				signKey, err := OfbEncrypt(random, signKeyBuf)
-				if err != nil {
-					continue
-				}
-
-				conf.User.EncryptPrivateKey = hex.EncodeToString(encryptKey)
-				conf.User.SignPrivateKey = hex.EncodeToString(signKey)
-				break
+// newGateway creates the gateway forwarding sub-devices over upstream, which must not yet be connected
+func newGateway(conf *config.Config, upstream *client.Client, user *client.User, logger client.Logger) (*gateway.Gateway, error) {
+	auth, err := client.NewServerAuthenticator(user)
+	if err != nil {
+		return nil, err
+	}
+	auth.Logger = logger
+	if len(conf.Gateway.Devices) > 0 {
+		allowed := map[string]bool{}
+		for _, uid := range conf.Gateway.Devices {
+			allowed[uid] = true
+		}
+		auth.Authorize = func(uid string, hid byte, deviceName string) error {
+			if !allowed[uid] {
+				return fmt.Errorf("sub-device %q not allowed", uid)
 			}
-			wg.Done()
-		}()
-		wg.Wait()
-
-		err = user.SetEncryptPrivateKey(conf.User.EncryptPrivateKey)
-		if err != nil {
-			log.Printf("set encrypt private key error: %v\n", err)
-			return
+			return nil
 		}
+	}
 
-		err = user.SetSignPrivateKey(conf.User.SignPrivateKey)
-		if err != nil {
-			log.Printf("set sign private key error: %v\n", err)
-			return
-		}
+	gw := gateway.New(upstream, auth)
+	gw.TopicPrefix = conf.Gateway.TopicPrefix
+	gw.Logger = client.LoggerWith(logger, "component", "gateway")
+	return gw, nil
+}
 
-		// save yml file
-		buf, err := yaml.Marshal(conf)
-		if err != nil {
-			log.Printf("marshal failed: %v\n", err)
-			return
-		}
+// newProvisioner creates a Provisioner for the RA and platform in the configuration
+func newProvisioner(conf *config.Config, logger client.Logger) (*provision.Provisioner, error) {
+	httpClient, err := provision.NewHTTPClient(provision.TLSOptions{
+		CAFile:     conf.Addr.TLS.CAFile,
+		Pins:       conf.Addr.TLS.Pins,
+		CertFile:   conf.Addr.TLS.CertFile,
+		KeyFile:    conf.Addr.TLS.KeyFile,
+		ServerName: conf.Addr.TLS.ServerName,
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	p := provision.New(conf.Addr.Ra, conf.Addr.Platform)
+	p.HTTPClient = httpClient
+	p.BearerToken = conf.Addr.Token
+	p.Logger = logger
+	p.Poll = provision.Backoff{
+		Initial: time.Duration(conf.Provision.PollInterval) * time.Second,
+		Max:     time.Duration(conf.Provision.PollMaxInterval) * time.Second,
+		Jitter:  float64(conf.Provision.PollJitter) / 100,
+	}
+	p.PollTimeout = time.Duration(conf.Provision.Timeout) * time.Second
+	p.PKG = client.Identity{
+		Uid:        orDefault(conf.Provision.PKGUid, client.DefaultPKGUid),
+		SignHid:    client.HidSign,
+		EncryptHid: conf.Provision.PKGHid,
+	}
+	return p, nil
+}
+
+// passphraseEnv names the environment variable holding the passphrase of the encrypted key store
+const passphraseEnv = "AUTHCLIENT_KEYSTORE_PASSPHRASE"
+
+// newKeyStore opens the key store selected by the configuration, nil if keys are kept in the configuration file
+func newKeyStore(conf *config.Config) (client.KeyStore, error) {
+	if conf.KeyStore.Type == "" {
+		return nil, nil
+	}
 
-		err = ioutil.WriteFile("config/config.yml", buf, 0644)
-		if err != nil {
-			log.Printf("write config file error: %v\n", err)
-			return
+	opts := keystore.Options{
+		Type:   conf.KeyStore.Type,
+		Path:   conf.KeyStore.Path,
+		PIN:    conf.KeyStore.PIN,
+		Params: conf.KeyStore.Params,
+	}
+	if conf.KeyStore.Type == keystore.TypeEncrypted {
+		passphrase := []byte(os.Getenv(passphraseEnv))
+		if len(passphrase) == 0 && conf.KeyStore.PassphraseFile != "" {
+			buf, err := ioutil.ReadFile(conf.KeyStore.PassphraseFile)
+			if err != nil {
+				return nil, err
+			}
+			passphrase = bytes.TrimRight(buf, "\r\n")
 		}
+		opts.Passphrase = passphrase
 	}
+	return keystore.Open(opts)
+}
 
-	serverUrl, err := url.Parse(conf.Mqtt.ServerAddr)
-	if err != nil {
-		log.Printf("%s\n", err)
-		return
-	}
-
-	c := &client.Client{
-		Config: &client.ClientConfig{
-			ClientID: conf.Mqtt.ClientID,
-			ClientName: conf.Mqtt.ClientName,
-			Topic: conf.Mqtt.Topic,
-			Qos: conf.Mqtt.Qos,
-			Keepalive: conf.Mqtt.Keepalive,
-			ConnectRetryDelay: conf.Mqtt.ConnectRetryDelay,
-			WriteToStdOut: conf.Mqtt.WriteToStdOut,
-			WriteToDisk: conf.Mqtt.WriteToDisk,
-			OutputFileName: conf.Mqtt.OutputFileName,
-			Debug: conf.Mqtt.Debug,
-		},
-	}
-	c.User = user
-	c.ServerUrl = serverUrl
-	c.AuthHandler = client.NewSm9Auth(c)
-
-	// Connect to the broker
-	err = c.Connect()
+// newLogger creates the logger selected by the configuration, writing to w
+func newLogger(conf *config.Config, w io.Writer) (client.Logger, error) {
+	fallback := client.NewLogger(os.Stderr, client.LevelInfo, client.LogFormatText)
+
+	level, err := client.ParseLevel(conf.Log.Level)
 	if err != nil {
-		log.Printf("%s\n", err)
-		return
+		return fallback, err
+	}
+	if conf.Mqtt.Debug {
+		level = client.LevelDebug
 	}
 
-	// Messages will be handled through the callback so we really just need to wait until a shutdown is requested
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
-	signal.Notify(sig, syscall.SIGTERM)
+	format, err := client.ParseLogFormat(conf.Log.Format)
+	if err != nil {
+		return fallback, err
+	}
 
-	<-sig
+	return client.NewLogger(w, level, format), nil
+}
 
-	// We could cancel the context at this point but will call Disconnect instead (this waits for autopaho to shutdown)
-	err = c.Disconnect()
+// readSecret reads a password or passphrase from the first line of a file, "-" reading standard input
+func readSecret(path string) ([]byte, error) {
+	var (
+		buf []byte
+		err error
+	)
+	if path == "-" {
+		buf, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		buf, err = ioutil.ReadFile(path)
+	}
 	if err != nil {
-		log.Printf("%s\n", err)
+		return nil, err
 	}
+	return []byte(strings.TrimRight(strings.SplitN(string(buf), "\n", 2)[0], "\r")), nil
 }
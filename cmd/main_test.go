@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/cmd/config"
+	"github.com/opensvn/auth-client/mqtttest"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+// writeTestConfig writes a configuration for a device holding keys issued by the broker, returning its path
+func writeTestConfig(t *testing.T, b *mqtttest.Broker) string {
+	uc, err := b.UserConfig("device1")
+	assert.Nil(t, err)
+	conf := config.Config{
+		Mqtt: config.MqttConfig{
+			ServerAddr:        b.URL().String(),
+			ClientID:          "device1",
+			Topic:             "devices/device1/#",
+			Keepalive:         30,
+			ConnectRetryDelay: 100,
+		},
+		User: *uc,
+		Addr: config.AddrConfig{Ra: "127.0.0.1:1", Platform: "127.0.0.1:1"},
+	}
+	buf, err := yaml.Marshal(&conf)
+	assert.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "config.yml")
+	assert.Nil(t, ioutil.WriteFile(path, buf, 0600))
+	return path
+}
+
+func TestRun(t *testing.T) {
+	b := mqtttest.NewBroker()
+	defer b.Close()
+	path := writeTestConfig(t, b)
+
+	t.Run("usage errors", func(t *testing.T) {
+		assert.Equal(t, 0, run([]string{"-h"}))
+		assert.Equal(t, 2, run([]string{"-config", path, "frobnicate"}))
+		assert.Equal(t, 2, run([]string{"-config", path, "publish", "hello"}))
+		assert.Equal(t, 2, run([]string{"-config", path, "keys"}))
+		assert.Equal(t, 2, run([]string{"-config", path, "keys", "export", "-format", "jwk"}))
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		assert.Equal(t, 1, run([]string{"-config", filepath.Join(t.TempDir(), "none.yml"), "config", "check"}))
+		assert.Equal(t, 1, run([]string{"-config", path, "-set", "mqtt.qos=high", "config", "check"}))
+		assert.Equal(t, 0, run([]string{"-config", path, "-set", "mqtt.qos=1", "config", "print", "-effective"}))
+	})
+
+	t.Run("config check and keys", func(t *testing.T) {
+		assert.Equal(t, 0, run([]string{"-config", path, "config", "check"}))
+		assert.Equal(t, 0, run([]string{"-config", path, "keys", "validate"}))
+		assert.Equal(t, 1, run([]string{"-config", path, "keys", "validate", "-uid", "device2"}))
+
+		out := filepath.Join(t.TempDir(), "keys.pem")
+		password := filepath.Join(t.TempDir(), "password")
+		assert.Nil(t, ioutil.WriteFile(password, []byte("secret\n"), 0600))
+		assert.Equal(t, 0, run([]string{"-config", path, "keys", "export", "-password-file", password, "-out", out}))
+		data, err := ioutil.ReadFile(out)
+		assert.Nil(t, err)
+		imported := &client.User{}
+		assert.Nil(t, imported.ImportPEM(data, []byte("secret")))
+		assert.Len(t, imported.HeldKeys(), 4)
+		if runtime.GOOS != "windows" {
+			info, err := os.Stat(out)
+			assert.Nil(t, err)
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		}
+
+		// An existing file is not written to, as others may be able to read it
+		assert.Equal(t, 1, run([]string{"-config", path, "keys", "export", "-type", "sign-private-key", "-out", out}))
+		after, err := ioutil.ReadFile(out)
+		assert.Nil(t, err)
+		assert.Equal(t, data, after)
+	})
+
+	t.Run("uid set on the command line", func(t *testing.T) {
+		// Keys issued for a uid no configuration file defines could not be saved, which is reported before
+		// provisioning
+		noKeys := []string{"-config", path, "-set", "user.encrypt_private_key=", "-set", "user.sign_private_key="}
+		assert.Equal(t, 0, run(append(noKeys, "config", "check")))
+		assert.Equal(t, 1, run(append(noKeys, "-set", "user.uid=device2", "config", "check")))
+	})
+
+	t.Run("publish", func(t *testing.T) {
+		assert.Equal(t, 0, run([]string{"-config", path, "publish", "-topic", "devices/device1/status", "-qos", "1", "hello", "world"}))
+		select {
+		case m := <-b.Received():
+			assert.Equal(t, "devices/device1/status", m.Topic)
+			assert.Equal(t, "hello world", string(m.Payload))
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not published")
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/metrics"
+)
+
+// monitor is the optional local http server exposing metrics and health for supervisors
+type monitor struct {
+	server *http.Server
+	mux    *http.ServeMux
+	logger client.Logger
+}
+
+// startMonitor starts serving /metrics on addr in the background
+func startMonitor(addr string, registry *metrics.Registry, logger client.Logger) *monitor {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+
+	m := &monitor{
+		server: &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second},
+		mux:    mux,
+		logger: logger,
+	}
+	go func() {
+		logger.Info("monitor listening", "addr", addr)
+		if err := m.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("monitor server error", "err", err)
+		}
+	}()
+	return m
+}
+
+// health is the body returned by /healthz
+type health struct {
+	State       string            `json:"state"`
+	Since       time.Time         `json:"since"`
+	ReasonCode  byte              `json:"reason_code,omitempty"`
+	Reason      string            `json:"reason,omitempty"`
+	LastError   string            `json:"last_error,omitempty"`
+	Connects    uint64            `json:"connects"`
+	Disconnects uint64            `json:"disconnects"`
+	Identities  map[string]health `json:"identities,omitempty"` // every identity's status, if there are several
+}
+
+func newHealth(s client.Status) health {
+	h := health{
+		State:       s.State.String(),
+		Since:       s.Since,
+		ReasonCode:  s.ReasonCode,
+		Reason:      s.Reason,
+		Connects:    s.Connects,
+		Disconnects: s.Disconnects,
+	}
+	if s.LastError != nil {
+		h.LastError = s.LastError.Error()
+	}
+	return h
+}
+
+// serveHealth adds /healthz, which responds 200 while every client in the pool is connected and 503 otherwise. The
+// body describes the connection of the first identity, with each identity's under identities if there are several.
+func (m *monitor) serveHealth(pool *client.Pool) {
+	m.mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		uids := pool.Uids()
+		var h health
+		connected := len(uids) > 0
+		for i, uid := range uids {
+			c := pool.Client(uid)
+			if c == nil {
+				continue // removed since
+			}
+			s := c.Status()
+			connected = connected && s.Connected()
+			if i == 0 {
+				h = newHealth(s)
+			}
+			if len(uids) > 1 {
+				if h.Identities == nil {
+					h.Identities = map[string]health{}
+				}
+				h.Identities[uid] = newHealth(s)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !connected {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(h)
+	})
+}
+
+// stop shuts the server down, waiting briefly for in-flight requests
+func (m *monitor) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.server.Shutdown(ctx); err != nil {
+		m.logger.Warn("monitor shutdown error", "err", err)
+	}
+}
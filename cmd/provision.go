@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// runProvision obtains keys for the identities that need them, or for every identity selected with -force
+func runProvision(ctx context.Context, args []string) error {
+	fs := newFlagSet("provision")
+	uid := fs.String("uid", "", "`uid` of the identity to provision (every identity if empty)")
+	force := fs.Bool("force", false, "obtain new keys even if the identity holds valid ones")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError("unexpected arguments")
+	}
+
+	e, err := loadEnv(os.Stderr)
+	if err != nil {
+		return err
+	}
+	ids, err := selectIdentities(e.conf, *uid)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		user, err := loadUser(id.user, e.store, e.logger)
+		if err != nil {
+			return fmt.Errorf("identity %q: invalid user configuration: %w", id.user.Uid, err)
+		}
+		if !*force && !needsKeys(user) {
+			fmt.Printf("%s: keys already held\n", id.user.Uid)
+			continue
+		}
+
+		if err := provisionUser(ctx, e.conf, id, e.store, e.logger, user); err != nil {
+			return fmt.Errorf("identity %q: %w", id.user.Uid, err)
+		}
+		if err := user.Validate(); err != nil {
+			return fmt.Errorf("identity %q: issued keys unusable: %w", id.user.Uid, err)
+		}
+		fmt.Printf("%s: keys provisioned\n", id.user.Uid)
+	}
+	return nil
+}
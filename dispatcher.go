@@ -0,0 +1,189 @@
+package client
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const (
+	defaultDispatcherWorkers   = 1
+	defaultDispatcherQueueSize = 64
+)
+
+// OverflowPolicy determines what the dispatcher does with a message when the queue it belongs on is full
+type OverflowPolicy int
+
+const (
+	OverflowBlock      OverflowPolicy = iota // wait for room (applies backpressure to the mqtt read loop)
+	OverflowDropOldest                       // discard the oldest queued message to make room
+	OverflowDropNewest                       // discard the incoming message
+)
+
+// ParseOverflowPolicy converts the textual form used in configuration files into an OverflowPolicy
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch s {
+	case "", "block":
+		return OverflowBlock, nil
+	case "drop_oldest":
+		return OverflowDropOldest, nil
+	case "drop_newest":
+		return OverflowDropNewest, nil
+	}
+	return OverflowBlock, fmt.Errorf("unknown overflow policy %q", s)
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop_oldest"
+	case OverflowDropNewest:
+		return "drop_newest"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// DispatcherConfig configures how received messages are handed to the message handler
+type DispatcherConfig struct {
+	Workers         int            // number of worker goroutines (defaults to 1)
+	QueueSize       int            // capacity of each queue (defaults to 64)
+	OrderedPerTopic bool           // if true all messages on a topic are handled by the same worker, in arrival order
+	Overflow        OverflowPolicy // what to do with a message when its queue is full
+}
+
+// DispatcherStats is a snapshot of the dispatcher counters
+type DispatcherStats struct {
+	Enqueued  uint64 // messages accepted onto a queue
+	Processed uint64 // messages passed to the handler
+	Dropped   uint64 // messages discarded due to the overflow policy
+}
+
+// dispatcher moves message handling off the paho router goroutine and onto a pool of workers. When ordering per topic
+// is requested each worker owns a queue and topics are hashed onto workers, otherwise all workers share one queue.
+type dispatcher struct {
+	enqueued  uint64 // accessed atomically; kept first for 64-bit alignment on 32-bit platforms
+	processed uint64
+	dropped   uint64
+
+	cfg    DispatcherConfig
+	handle func(*paho.Publish)
+	queues []chan *paho.Publish
+
+	mu     sync.RWMutex // guards closed; held for reading while a message is being queued
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// newDispatcher creates a dispatcher and starts its workers
+func newDispatcher(cfg DispatcherConfig, handle func(*paho.Publish)) *dispatcher {
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultDispatcherWorkers
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultDispatcherQueueSize
+	}
+
+	d := &dispatcher{cfg: cfg, handle: handle}
+	if cfg.OrderedPerTopic {
+		d.queues = make([]chan *paho.Publish, cfg.Workers)
+		for i := range d.queues {
+			d.queues[i] = make(chan *paho.Publish, cfg.QueueSize)
+		}
+	} else {
+		d.queues = []chan *paho.Publish{make(chan *paho.Publish, cfg.QueueSize)}
+	}
+
+	d.wg.Add(cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go d.work(d.queues[i%len(d.queues)])
+	}
+	return d
+}
+
+// work handles messages from the queue until it is closed
+func (d *dispatcher) work(q chan *paho.Publish) {
+	defer d.wg.Done()
+	for m := range q {
+		d.handle(m)
+		atomic.AddUint64(&d.processed, 1)
+	}
+}
+
+// queue returns the queue that a message on the topic should be placed on
+func (d *dispatcher) queue(topic string) chan *paho.Publish {
+	if len(d.queues) == 1 {
+		return d.queues[0]
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(topic))
+	return d.queues[h.Sum32()%uint32(len(d.queues))]
+}
+
+// dispatch queues the message applying the configured overflow policy. It returns false if the message was dropped.
+func (d *dispatcher) dispatch(m *paho.Publish) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		atomic.AddUint64(&d.dropped, 1)
+		return false
+	}
+
+	q := d.queue(m.Topic)
+	switch d.cfg.Overflow {
+	case OverflowDropNewest:
+		select {
+		case q <- m:
+		default:
+			atomic.AddUint64(&d.dropped, 1)
+			return false
+		}
+	case OverflowDropOldest:
+		for queued := false; !queued; {
+			select {
+			case q <- m:
+				queued = true
+			default:
+				select {
+				case <-q:
+					atomic.AddUint64(&d.dropped, 1)
+				default: // a worker emptied a slot in the meantime
+				}
+			}
+		}
+	default:
+		q <- m
+	}
+
+	atomic.AddUint64(&d.enqueued, 1)
+	return true
+}
+
+// close stops accepting messages and waits for the workers to drain the queues
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	for _, q := range d.queues {
+		close(q)
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
+
+// stats returns a snapshot of the dispatcher counters
+func (d *dispatcher) stats() DispatcherStats {
+	return DispatcherStats{
+		Enqueued:  atomic.LoadUint64(&d.enqueued),
+		Processed: atomic.LoadUint64(&d.processed),
+		Dropped:   atomic.LoadUint64(&d.dropped),
+	}
+}
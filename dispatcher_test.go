@@ -0,0 +1,102 @@
+package client
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	timeout = time.Second
+	tick    = time.Millisecond
+)
+
+func TestDispatcher(t *testing.T) {
+	t.Run("ordered per topic", func(t *testing.T) {
+		var mu sync.Mutex
+		got := map[string][]string{}
+		d := newDispatcher(DispatcherConfig{Workers: 4, QueueSize: 8, OrderedPerTopic: true}, func(m *paho.Publish) {
+			mu.Lock()
+			got[m.Topic] = append(got[m.Topic], string(m.Payload))
+			mu.Unlock()
+		})
+
+		for i := 0; i < 100; i++ {
+			for _, topic := range []string{"a", "b", "c"} {
+				assert.True(t, d.dispatch(&paho.Publish{Topic: topic, Payload: []byte(strconv.Itoa(i))}))
+			}
+		}
+		d.close()
+
+		for _, topic := range []string{"a", "b", "c"} {
+			assert.Len(t, got[topic], 100)
+			for i, p := range got[topic] {
+				assert.Equal(t, strconv.Itoa(i), p)
+			}
+		}
+		assert.Equal(t, DispatcherStats{Enqueued: 300, Processed: 300}, d.stats())
+	})
+
+	t.Run("drop newest", func(t *testing.T) {
+		release := make(chan struct{})
+		var handled []string
+		d := newDispatcher(DispatcherConfig{QueueSize: 2, Overflow: OverflowDropNewest}, func(m *paho.Publish) {
+			<-release
+			handled = append(handled, string(m.Payload))
+		})
+
+		// The first message is taken by the worker (which then blocks), two fill the queue and the rest are dropped
+		assert.True(t, d.dispatch(&paho.Publish{Payload: []byte("0")}))
+		assert.Eventually(t, func() bool { return len(d.queues[0]) == 0 }, timeout, tick)
+		assert.True(t, d.dispatch(&paho.Publish{Payload: []byte("1")}))
+		assert.True(t, d.dispatch(&paho.Publish{Payload: []byte("2")}))
+		assert.False(t, d.dispatch(&paho.Publish{Payload: []byte("3")}))
+		assert.False(t, d.dispatch(&paho.Publish{Payload: []byte("4")}))
+
+		close(release)
+		d.close()
+		assert.Equal(t, []string{"0", "1", "2"}, handled)
+		assert.Equal(t, uint64(2), d.stats().Dropped)
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		release := make(chan struct{})
+		var handled []string
+		d := newDispatcher(DispatcherConfig{QueueSize: 2, Overflow: OverflowDropOldest}, func(m *paho.Publish) {
+			<-release
+			handled = append(handled, string(m.Payload))
+		})
+
+		assert.True(t, d.dispatch(&paho.Publish{Payload: []byte("0")}))
+		assert.Eventually(t, func() bool { return len(d.queues[0]) == 0 }, timeout, tick)
+		for i := 1; i <= 4; i++ {
+			assert.True(t, d.dispatch(&paho.Publish{Payload: []byte(strconv.Itoa(i))}))
+		}
+
+		close(release)
+		d.close()
+		assert.Equal(t, []string{"0", "3", "4"}, handled)
+		assert.Equal(t, uint64(2), d.stats().Dropped)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		d := newDispatcher(DispatcherConfig{}, func(m *paho.Publish) {})
+		d.close()
+		assert.False(t, d.dispatch(&paho.Publish{}))
+	})
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, p := range []OverflowPolicy{OverflowBlock, OverflowDropOldest, OverflowDropNewest} {
+		parsed, err := ParseOverflowPolicy(p.String())
+		assert.Nil(t, err)
+		assert.Equal(t, p, parsed)
+	}
+
+	_, err := ParseOverflowPolicy("drop_all")
+	assert.NotNil(t, err)
+}
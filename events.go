@@ -0,0 +1,130 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// eventBufferSize is the capacity of the channel returned by Client.Events
+const eventBufferSize = 64
+
+// EventType identifies a change in the state of a client's connection
+type EventType int
+
+const (
+	EventIdle        EventType = iota // Connect has not been called (only ever seen in Status)
+	EventConnecting                   // a CONNECT packet is being sent to the broker
+	EventAuthStarted                  // the broker has sent its sm9 challenge
+	EventAuthFailed                   // the sm9 handshake failed
+	EventUp                           // the connection is up and authenticated
+	EventDown                         // the connection attempt failed or an established connection was lost
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventIdle:
+		return "idle"
+	case EventConnecting:
+		return "connecting"
+	case EventAuthStarted:
+		return "auth-started"
+	case EventAuthFailed:
+		return "auth-failed"
+	case EventUp:
+		return "up"
+	case EventDown:
+		return "down"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event describes a change in the state of a client's connection
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	ReasonCode byte   // reason code of the DISCONNECT sent by the server (EventDown only)
+	Reason     string // reason string sent by the server, if any
+	Err        error  // the error that caused the event, if any
+}
+
+// Status is a snapshot of a client's connection state
+type Status struct {
+	State       EventType // type of the most recent event
+	Since       time.Time // time of the most recent event
+	ReasonCode  byte      // reason code of the most recent event
+	Reason      string    // reason string of the most recent event
+	LastError   error     // most recent error reported by any event
+	Connects    uint64    // number of times the connection has come up
+	Disconnects uint64    // number of times an established connection has been lost
+}
+
+// Connected reports whether the connection was up when the snapshot was taken
+func (s Status) Connected() bool {
+	return s.State == EventUp
+}
+
+// events keeps the connection status and fans events out to listeners
+type events struct {
+	mu        sync.Mutex
+	status    Status
+	listeners []func(Event)
+	ch        chan Event
+}
+
+// AddEventListener registers a function that is called, in the goroutine that raised it, for every subsequent event.
+// Listeners must not block.
+func (c *Client) AddEventListener(fn func(Event)) {
+	c.events.mu.Lock()
+	defer c.events.mu.Unlock()
+	c.events.listeners = append(c.events.listeners, fn)
+}
+
+// Events returns a channel delivering subsequent events. Events are dropped rather than blocking the client if the
+// channel is not drained.
+func (c *Client) Events() <-chan Event {
+	c.events.mu.Lock()
+	defer c.events.mu.Unlock()
+	if c.events.ch == nil {
+		ch := make(chan Event, eventBufferSize)
+		c.events.ch = ch
+		c.events.listeners = append(c.events.listeners, func(e Event) {
+			select {
+			case ch <- e:
+			default:
+			}
+		})
+	}
+	return c.events.ch
+}
+
+// Status returns a snapshot of the connection state
+func (c *Client) Status() Status {
+	c.events.mu.Lock()
+	defer c.events.mu.Unlock()
+	return c.events.status
+}
+
+// emit updates the status and passes the event to the listeners
+func (c *Client) emit(e Event) {
+	e.Time = time.Now()
+
+	c.events.mu.Lock()
+	s := &c.events.status
+	if e.Type == EventUp {
+		s.Connects++
+	}
+	if e.Type == EventDown && s.State == EventUp {
+		s.Disconnects++
+	}
+	s.State, s.Since, s.ReasonCode, s.Reason = e.Type, e.Time, e.ReasonCode, e.Reason
+	if e.Err != nil {
+		s.LastError = e.Err
+	}
+	listeners := append([]func(Event){}, c.events.listeners...)
+	c.events.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(e)
+	}
+}
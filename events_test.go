@@ -0,0 +1,54 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientEvents(t *testing.T) {
+	c := &Client{}
+	assert.Equal(t, EventIdle, c.Status().State)
+	assert.False(t, c.Status().Connected())
+
+	var seen []EventType
+	c.AddEventListener(func(e Event) { seen = append(seen, e.Type) })
+	ch := c.Events()
+
+	c.emit(Event{Type: EventConnecting})
+	c.emit(Event{Type: EventAuthStarted})
+	c.emit(Event{Type: EventUp})
+	assert.True(t, c.Status().Connected())
+
+	c.emit(Event{Type: EventDown, ReasonCode: 0x8b, Reason: "server shutting down"})
+
+	s := c.Status()
+	assert.Equal(t, EventDown, s.State)
+	assert.Equal(t, byte(0x8b), s.ReasonCode)
+	assert.Equal(t, "server shutting down", s.Reason)
+	assert.Equal(t, uint64(1), s.Connects)
+	assert.Equal(t, uint64(1), s.Disconnects)
+
+	// A failed reconnection attempt does not count as another disconnect
+	c.emit(Event{Type: EventDown, Err: errors.New("connection refused")})
+	assert.Equal(t, uint64(1), c.Status().Disconnects)
+	assert.EqualError(t, c.Status().LastError, "connection refused")
+
+	expected := []EventType{EventConnecting, EventAuthStarted, EventUp, EventDown, EventDown}
+	assert.Equal(t, expected, seen)
+	for _, typ := range expected {
+		e := <-ch
+		assert.Equal(t, typ, e.Type)
+		assert.False(t, e.Time.IsZero())
+	}
+}
+
+func TestClientEventsNotDrained(t *testing.T) {
+	c := &Client{}
+	ch := c.Events()
+	for i := 0; i < eventBufferSize+10; i++ {
+		c.emit(Event{Type: EventConnecting})
+	}
+	assert.Len(t, ch, eventBufferSize)
+}
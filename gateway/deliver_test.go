@@ -0,0 +1,135 @@
+package gateway
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/opensvn/auth-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliverSlowSubDevice(t *testing.T) {
+	g := New(&client.Client{Config: &client.ClientConfig{}}, nil)
+	g.SendQueue = 4
+	defer g.Close()
+
+	// A sub-device that does not read: writes to a pipe block until the other end reads
+	local, remote := net.Pipe()
+	defer remote.Close()
+	c := g.newConn(local)
+	c.uid = "sub1"
+	c.subs["cmd/#"] = true
+	g.mu.Lock()
+	g.conns[c] = true
+	g.mu.Unlock()
+	go g.write(c)
+	defer close(c.done)
+
+	// The upstream read loop is not held up; what does not fit in the queue is dropped
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		assert.True(t, g.deliver(&paho.Publish{Topic: "devices/sub1/cmd/reboot", Payload: []byte("now")}))
+	}
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	received := 0
+	for {
+		_ = remote.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		cp, err := packets.ReadPacket(remote)
+		if err != nil {
+			break
+		}
+		assert.Equal(t, "cmd/reboot", cp.Content.(*packets.Publish).Topic)
+		received++
+	}
+	// The queue, plus the message the writer had taken before the queue filled
+	assert.GreaterOrEqual(t, received, g.SendQueue)
+	assert.LessOrEqual(t, received, g.SendQueue+1)
+}
+
+func TestDeliverOverlappingUids(t *testing.T) {
+	g := New(&client.Client{Config: &client.ClientConfig{}}, nil)
+	defer g.Close()
+
+	conns := map[string]*conn{}
+	for _, uid := range []string{"a", "ab"} {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		c := g.newConn(local)
+		c.uid = uid
+		c.subs["#"] = true
+		g.mu.Lock()
+		g.conns[c] = true
+		g.mu.Unlock()
+		conns[uid] = c
+	}
+
+	// Each sub-device receives only the messages in its own namespace, however its uid begins
+	assert.True(t, g.deliver(&paho.Publish{Topic: "devices/ab/cmd", Payload: []byte("now")}))
+	assert.Len(t, conns["a"].out, 0)
+	assert.Len(t, conns["ab"].out, 1)
+	assert.Equal(t, "cmd", (<-conns["ab"].out).Topic)
+	assert.False(t, g.deliver(&paho.Publish{Topic: "devices/abc/cmd"}))
+	assert.Len(t, conns["a"].out, 0)
+	assert.Len(t, conns["ab"].out, 0)
+
+	// A prefix that would let the namespace of "a" take in that of "ab" is refused
+	g.TopicPrefix = "dev-{uid}"
+	_, err := g.Listen("tcp://127.0.0.1:0")
+	assert.NotNil(t, err)
+}
+
+func TestValidateTopicPrefix(t *testing.T) {
+	for prefix, ok := range map[string]bool{
+		"":                 true,
+		"devices/{uid}/":   true,
+		"site/7/{uid}/in/": true,
+		"dev-{uid}":        false,
+		"dev-{uid}/":       false,
+		"devices/{uid}":    false,
+		"devices/":         false,
+		"devices/+/{uid}/": false,
+	} {
+		assert.Equal(t, ok, ValidateTopicPrefix(prefix) == nil, prefix)
+	}
+}
+
+func TestCloseSlowSubDevice(t *testing.T) {
+	g := New(&client.Client{Config: &client.ClientConfig{}}, nil)
+
+	// A sub-device that does not read, so that the DISCONNECT sent on closing blocks
+	local, remote := net.Pipe()
+	c := g.newConn(local)
+	c.uid = "sub1"
+	c.subs["cmd/#"] = true
+	g.mu.Lock()
+	g.conns[c] = true
+	g.mu.Unlock()
+
+	closed := make(chan struct{})
+	go func() {
+		_ = g.Close()
+		close(closed)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Whilst it does, upstream messages are still taken without waiting
+	delivered := make(chan bool)
+	go func() { delivered <- g.deliver(&paho.Publish{Topic: "devices/sub1/cmd/reboot"}) }()
+	select {
+	case taken := <-delivered:
+		assert.True(t, taken)
+	case <-time.After(time.Second):
+		t.Fatal("deliver held up by closing")
+	}
+
+	_ = remote.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close did not finish")
+	}
+}
@@ -0,0 +1,571 @@
+// Package gateway lets sub-devices reach the broker through the gateway's own connection. Sub-devices connect to a
+// local MQTT v5 listener (TCP or a Unix socket) and authenticate with their SM9 identities, exactly as they would with
+// the broker. Their messages are then forwarded upstream with the topic rewritten into a namespace of their uid, and
+// upstream messages in that namespace are delivered back to them.
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/opensvn/auth-client"
+)
+
+// DefaultTopicPrefix is the TopicPrefix used if none is set
+const DefaultTopicPrefix = "devices/{uid}/"
+
+// DefaultSendQueue is the SendQueue used if none is set
+const DefaultSendQueue = 64
+
+// DefaultHandshakeTimeout is the HandshakeTimeout used if none is set
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// Gateway forwards the traffic of locally connected sub-devices over Upstream. Messages are forwarded upstream with
+// their QoS and delivered to sub-devices at QoS 0.
+type Gateway struct {
+	Upstream *client.Client        // the gateway's own connection; use New so that upstream messages reach the gateway
+	Auth     client.ServerAuthHook // authenticates sub-devices, typically a ServerAuthenticator holding the gateway's keys
+	// TopicPrefix is prepended to the topics of a sub-device upstream, with {uid} replaced by its uid. It must have
+	// {uid} as a whole level and end with /, so that no sub-device's namespace lies within another's; see
+	// ValidateTopicPrefix.
+	TopicPrefix string
+	// SendQueue is the number of upstream messages that may wait to be written to each sub-device. Messages arriving
+	// whilst a sub-device's queue is full are dropped, so that a slow sub-device cannot hold up the upstream connection.
+	SendQueue int
+	// HandshakeTimeout limits how long a sub-device may take to send its CONNECT and complete authentication
+	HandshakeTimeout time.Duration
+	Logger           client.Logger // if nil, nothing is logged
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[*conn]bool
+	upstream  map[string]int // upstream topic filters subscribed to, with the number of sub-devices using each
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// conn is a connected sub-device
+type conn struct {
+	net.Conn
+	uid      string
+	clientID string
+	subs     map[string]bool       // local topic filters
+	out      chan *packets.Publish // messages waiting to be delivered, written by the conn's own goroutine
+	done     chan struct{}         // closed once the sub-device has gone
+}
+
+// New creates a gateway forwarding over upstream, which must not yet be connected. Messages received upstream on the
+// topics of sub-devices are taken by the gateway; others are passed on to upstream's handler as before.
+func New(upstream *client.Client, auth client.ServerAuthHook) *Gateway {
+	g := &Gateway{Upstream: upstream, Auth: auth, conns: map[*conn]bool{}, upstream: map[string]int{}}
+
+	next := upstream.Config.OnPublish
+	upstream.Config.OnPublish = func(m *paho.Publish) bool {
+		if g.deliver(m) {
+			return true
+		}
+		return next != nil && next(m)
+	}
+	// Subscriptions are made again whenever the upstream connection is, as it starts a new session
+	upstream.AddEventListener(func(e client.Event) {
+		if e.Type == client.EventUp {
+			go g.resubscribe()
+		}
+	})
+	return g
+}
+
+func (g *Gateway) logger() client.Logger {
+	if g.Logger == nil {
+		return client.NopLogger()
+	}
+	return g.Logger
+}
+
+// Listen listens for sub-devices on addr, which is a unix:// URL naming a socket, a tcp:// URL or a host:port, and
+// serves them in the background until Close is called
+func (g *Gateway) Listen(addr string) (net.Listener, error) {
+	if err := ValidateTopicPrefix(g.TopicPrefix); err != nil {
+		return nil, err
+	}
+	network, address := "tcp", addr
+	if u, err := url.Parse(addr); err == nil && u.Scheme != "" && u.Opaque == "" {
+		switch u.Scheme {
+		case "unix":
+			network, address = "unix", u.Path
+			// A socket left behind by an earlier run would make listening fail
+			if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+				_ = os.Remove(address)
+			}
+		case "tcp", "mqtt":
+			address = u.Host
+		default:
+			return nil, fmt.Errorf("unsupported gateway listen address %q (expected unix:// or tcp://)", addr)
+		}
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := g.serve(l); err != nil {
+			g.logger().Error("gateway listener stopped", "addr", addr, "err", err)
+		}
+	}()
+	return l, nil
+}
+
+// Serve accepts sub-device connections on l until it is closed. It returns nil if the gateway was closed.
+func (g *Gateway) Serve(l net.Listener) error {
+	if err := ValidateTopicPrefix(g.TopicPrefix); err != nil {
+		_ = l.Close()
+		return err
+	}
+	return g.serve(l)
+}
+
+// serve runs Serve once the topic prefix has been checked
+func (g *Gateway) serve(l net.Listener) error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		_ = l.Close()
+		return errors.New("gateway closed")
+	}
+	g.listeners = append(g.listeners, l)
+	g.mu.Unlock()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			g.mu.Lock()
+			closed := g.closed
+			g.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			g.handle(g.newConn(nc))
+		}()
+	}
+}
+
+// Close stops listening and disconnects every sub-device. The upstream connection is left to its owner.
+func (g *Gateway) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+	for _, l := range g.listeners {
+		_ = l.Close()
+	}
+	conns := make([]*conn, 0, len(g.conns))
+	for c := range g.conns {
+		conns = append(conns, c)
+	}
+	g.mu.Unlock()
+
+	// Written without holding mu, as a sub-device slow to read would otherwise hold up deliver
+	for _, c := range conns {
+		_, _ = (&packets.Disconnect{ReasonCode: packets.DisconnectServerShuttingDown, Properties: &packets.Properties{}}).WriteTo(c)
+		_ = c.Close()
+	}
+
+	g.wg.Wait()
+	return nil
+}
+
+// Devices returns the uids of the connected sub-devices
+func (g *Gateway) Devices() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	uids := make([]string, 0, len(g.conns))
+	for c := range g.conns {
+		uids = append(uids, c.uid)
+	}
+	return uids
+}
+
+// prefix returns the upstream topic prefix of the sub-device
+func (g *Gateway) prefix(uid string) string {
+	p := g.TopicPrefix
+	if p == "" {
+		p = DefaultTopicPrefix
+	}
+	return strings.Replace(p, "{uid}", uid, -1)
+}
+
+// ValidateTopicPrefix checks a TopicPrefix: it must not contain wildcards, must have {uid} as the whole of one of its
+// levels and must end with /. Otherwise the namespace of one sub-device could be the start of another's, as that of
+// "a" is of "ab" with the prefix "dev-{uid}", and a sub-device would receive messages meant for another. An empty
+// prefix selects DefaultTopicPrefix.
+func ValidateTopicPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if strings.ContainsAny(prefix, "+#") {
+		return fmt.Errorf("topic prefix %q must not contain wildcards", prefix)
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("topic prefix %q must end with /", prefix)
+	}
+	for _, level := range strings.Split(prefix, "/") {
+		if level == "{uid}" {
+			return nil
+		}
+	}
+	return fmt.Errorf("topic prefix %q must have {uid} as a whole level", prefix)
+}
+
+// UpstreamTopic returns the topic (or topic filter) a sub-device's topic is forwarded to
+func (g *Gateway) UpstreamTopic(uid, topic string) string {
+	return g.prefix(uid) + topic
+}
+
+// newConn wraps a sub-device connection
+func (g *Gateway) newConn(nc net.Conn) *conn {
+	size := g.SendQueue
+	if size <= 0 {
+		size = DefaultSendQueue
+	}
+	return &conn{
+		Conn: packets.NewThreadSafeConn(nc),
+		subs: map[string]bool{},
+		out:  make(chan *packets.Publish, size),
+		done: make(chan struct{}),
+	}
+}
+
+// handle runs a sub-device connection: the handshake, then the packet loop until it goes away
+func (g *Gateway) handle(c *conn) {
+	defer c.Close()
+
+	if err := g.connect(c); err != nil {
+		g.logger().Warn("sub-device rejected", "remote", c.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return
+	}
+	g.conns[c] = true
+	g.mu.Unlock()
+	g.logger().Info("sub-device connected", "uid", c.uid, "client_id", c.clientID)
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		g.write(c)
+	}()
+	defer close(c.done)
+	defer g.disconnected(c)
+
+	for {
+		cp, err := packets.ReadPacket(c)
+		if err != nil {
+			return
+		}
+		switch p := cp.Content.(type) {
+		case *packets.Subscribe:
+			g.subscribe(c, p)
+		case *packets.Unsubscribe:
+			g.unsubscribe(c, p)
+		case *packets.Publish:
+			g.publish(c, p)
+		case *packets.Pubrel:
+			_, _ = (&packets.Pubcomp{PacketID: p.PacketID, Properties: &packets.Properties{}}).WriteTo(c)
+		case *packets.Pingreq:
+			_, _ = (&packets.Pingresp{}).WriteTo(c)
+		case *packets.Disconnect:
+			return
+		}
+	}
+}
+
+// write delivers the messages queued for the sub-device until it goes. A message that cannot be written closes the
+// connection, so that the sub-device reconnects rather than silently missing messages.
+func (g *Gateway) write(c *conn) {
+	for {
+		select {
+		case pub := <-c.out:
+			if _, err := pub.WriteTo(c); err != nil {
+				g.logger().Warn("delivering message to sub-device failed", "uid", c.uid, "topic", pub.Topic, "err", err)
+				_ = c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// disconnected forgets the sub-device, dropping upstream subscriptions no other sub-device uses
+func (g *Gateway) disconnected(c *conn) {
+	g.mu.Lock()
+	delete(g.conns, c)
+	var unused []string
+	for filter := range c.subs {
+		if g.release(g.UpstreamTopic(c.uid, filter)) {
+			unused = append(unused, g.UpstreamTopic(c.uid, filter))
+		}
+	}
+	g.mu.Unlock()
+
+	for _, filter := range unused {
+		_ = g.Upstream.Unsubscribe(filter)
+	}
+	g.logger().Info("sub-device disconnected", "uid", c.uid, "client_id", c.clientID)
+}
+
+// connect reads the CONNECT packet and authenticates the sub-device, sending the CONNACK. A sub-device that does not
+// finish within HandshakeTimeout is dropped.
+func (g *Gateway) connect(c *conn) error {
+	timeout := g.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if err := g.authenticate(c); err != nil {
+		return err
+	}
+	return c.SetReadDeadline(time.Time{})
+}
+
+// authenticate runs the CONNECT and AUTH exchange of connect
+func (g *Gateway) authenticate(c *conn) error {
+	cp, err := packets.ReadPacket(c)
+	if err != nil {
+		return err
+	}
+	connect, ok := cp.Content.(*packets.Connect)
+	if !ok {
+		return fmt.Errorf("expected CONNECT, got %s", cp.PacketType())
+	}
+	c.clientID = connect.ClientID
+
+	if connect.Properties == nil || connect.Properties.AuthMethod != g.Auth.AuthMethod() {
+		return g.connack(c, packets.ConnackBadAuthenticationMethod, errors.New("unsupported authentication method"))
+	}
+
+	exchange, auth, err := g.Auth.OnConnect(connect.Properties)
+	for err == nil && auth != nil {
+		if _, err = auth.WriteTo(c); err != nil {
+			return err
+		}
+		cp, rerr := packets.ReadPacket(c)
+		if rerr != nil {
+			return rerr
+		}
+		reply, ok := cp.Content.(*packets.Auth)
+		if !ok {
+			return fmt.Errorf("expected AUTH, got %s", cp.PacketType())
+		}
+		if reply.Properties == nil {
+			reply.Properties = &packets.Properties{}
+		}
+		auth, err = exchange.OnAuth(reply)
+	}
+	if err != nil {
+		return g.connack(c, packets.ConnackNotAuthorized, err)
+	}
+
+	c.uid, _ = exchange.Identity()
+	if c.uid == "" || strings.ContainsAny(c.uid, "/+#") {
+		// The uid becomes part of the sub-device's topics, which it must not be able to escape
+		return g.connack(c, packets.ConnackNotAuthorized, fmt.Errorf("uid %q cannot be used in topics", c.uid))
+	}
+	return g.connack(c, packets.ConnackSuccess, nil)
+}
+
+// connack sends the CONNACK and returns err
+func (g *Gateway) connack(c *conn, reasonCode byte, err error) error {
+	props := &packets.Properties{AuthMethod: g.Auth.AuthMethod()}
+	if err != nil {
+		props.ReasonString = err.Error()
+	}
+	if _, werr := (&packets.Connack{ReasonCode: reasonCode, Properties: props}).WriteTo(c); werr != nil && err == nil {
+		return werr
+	}
+	return err
+}
+
+// subscribe records the sub-device's filter, subscribing upstream to those no other sub-device uses yet. A SUBSCRIBE
+// is refused if it has more than one filter: the packet is decoded into a map, losing the order the SUBACK must
+// answer the filters in.
+func (g *Gateway) subscribe(c *conn, s *packets.Subscribe) {
+	suback := &packets.Suback{PacketID: s.PacketID, Properties: &packets.Properties{}}
+	if len(s.Subscriptions) > 1 {
+		for range s.Subscriptions {
+			suback.Reasons = append(suback.Reasons, packets.SubackImplementationspecificerror)
+		}
+		suback.Properties.ReasonString = "one topic filter per SUBSCRIBE"
+		_, _ = suback.WriteTo(c)
+		return
+	}
+	for filter := range s.Subscriptions {
+		upstream := g.UpstreamTopic(c.uid, filter)
+
+		g.mu.Lock()
+		first := false
+		if !c.subs[filter] {
+			c.subs[filter] = true
+			g.upstream[upstream]++
+			first = g.upstream[upstream] == 1
+		}
+		g.mu.Unlock()
+
+		reason := byte(0) // granted QoS 0, at which messages are delivered
+		if first {
+			if err := g.Upstream.Subscribe(upstream); err != nil {
+				g.mu.Lock()
+				delete(c.subs, filter)
+				g.release(upstream)
+				g.mu.Unlock()
+				reason = packets.SubackUnspecifiederror
+			}
+		}
+		suback.Reasons = append(suback.Reasons, reason)
+	}
+	_, _ = suback.WriteTo(c)
+}
+
+func (g *Gateway) unsubscribe(c *conn, u *packets.Unsubscribe) {
+	unsuback := &packets.Unsuback{PacketID: u.PacketID, Properties: &packets.Properties{}}
+	for _, filter := range u.Topics {
+		upstream := g.UpstreamTopic(c.uid, filter)
+
+		g.mu.Lock()
+		found, unused := c.subs[filter], false
+		if found {
+			delete(c.subs, filter)
+			unused = g.release(upstream)
+		}
+		g.mu.Unlock()
+
+		if !found {
+			unsuback.Reasons = append(unsuback.Reasons, packets.UnsubackNoSubscriptionFound)
+			continue
+		}
+		if unused {
+			_ = g.Upstream.Unsubscribe(upstream)
+		}
+		unsuback.Reasons = append(unsuback.Reasons, packets.UnsubackSuccess)
+	}
+	_, _ = unsuback.WriteTo(c)
+}
+
+// release drops a use of the upstream filter, reporting whether it is no longer used. mu must be held.
+func (g *Gateway) release(upstream string) bool {
+	g.upstream[upstream]--
+	if g.upstream[upstream] > 0 {
+		return false
+	}
+	delete(g.upstream, upstream)
+	return true
+}
+
+// resubscribe subscribes again to every upstream filter in use
+func (g *Gateway) resubscribe() {
+	g.mu.Lock()
+	filters := make([]string, 0, len(g.upstream))
+	for filter := range g.upstream {
+		filters = append(filters, filter)
+	}
+	g.mu.Unlock()
+
+	for _, filter := range filters {
+		_ = g.Upstream.Subscribe(filter)
+	}
+}
+
+// publish forwards a sub-device's message upstream, acknowledging it once the upstream broker has
+func (g *Gateway) publish(c *conn, p *packets.Publish) {
+	topic := g.UpstreamTopic(c.uid, p.Topic)
+	err := g.Upstream.PublishMessage(topic, p.QoS, p.Retain, p.Payload)
+	if err != nil {
+		g.logger().Warn("forwarding sub-device message failed", "uid", c.uid, "topic", topic, "err", err)
+	}
+
+	reason := byte(0)
+	if err != nil {
+		reason = packets.PubackUnspecifiedError
+	}
+	switch p.QoS {
+	case 1:
+		_, _ = (&packets.Puback{PacketID: p.PacketID, ReasonCode: reason, Properties: &packets.Properties{}}).WriteTo(c)
+	case 2:
+		_, _ = (&packets.Pubrec{PacketID: p.PacketID, ReasonCode: reason, Properties: &packets.Properties{}}).WriteTo(c)
+	}
+}
+
+// deliver queues a message received upstream for the sub-devices subscribed to it, reporting whether it was in the
+// namespace of a connected sub-device. It runs in the upstream read loop, so it never waits for a sub-device.
+func (g *Gateway) deliver(m *paho.Publish) bool {
+	g.mu.Lock()
+	var (
+		targets []*conn
+		topics  []string
+		taken   bool
+	)
+	for c := range g.conns {
+		prefix := g.prefix(c.uid)
+		if !strings.HasPrefix(m.Topic, prefix) {
+			continue
+		}
+		taken = true
+		local := strings.TrimPrefix(m.Topic, prefix)
+		for filter := range c.subs {
+			if match(filter, local) {
+				targets = append(targets, c)
+				topics = append(topics, local)
+				break
+			}
+		}
+	}
+	g.mu.Unlock()
+
+	for i, c := range targets {
+		pub := &packets.Publish{Topic: topics[i], Payload: m.Payload, Properties: &packets.Properties{}}
+		select {
+		case c.out <- pub:
+		default:
+			g.logger().Warn("message to sub-device dropped, send queue full", "uid", c.uid, "topic", topics[i])
+		}
+	}
+	return taken
+}
+
+// match reports whether topic matches the filter, which may contain the + and # wildcards
+func match(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
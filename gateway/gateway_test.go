@@ -0,0 +1,176 @@
+package gateway_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/gateway"
+	"github.com/opensvn/auth-client/mqtttest"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	timeout = 5 * time.Second
+	tick    = 10 * time.Millisecond
+)
+
+// newClient creates a client for uid, holding keys issued by the broker's master keys, writing what it receives to a
+// file
+func newClient(t *testing.T, broker *mqtttest.Broker, server *url.URL, uid, topic string) (*client.Client, string) {
+	conf, err := broker.UserConfig(uid)
+	assert.Nil(t, err)
+	output := filepath.Join(t.TempDir(), "received.txt")
+	c := &client.Client{
+		ServerUrl: server,
+		User:      client.NewUser(conf),
+		Logger:    client.NopLogger(),
+		Config: &client.ClientConfig{
+			ClientID:          uid,
+			ClientName:        uid,
+			Topic:             topic,
+			Keepalive:         30,
+			ConnectRetryDelay: 50,
+			WriteToDisk:       true,
+			OutputFileName:    output,
+		},
+	}
+	c.AuthHandler = client.NewSm9Auth(c)
+	return c, output
+}
+
+func TestGateway(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	// The gateway connects upstream as its own identity and authenticates sub-devices with the same keys
+	upstream, upstreamOutput := newClient(t, broker, broker.URL(), "gateway", "gateway/in")
+	auth, err := client.NewServerAuthenticator(upstream.User)
+	assert.Nil(t, err)
+	auth.Authorize = func(uid string, hid byte, deviceName string) error {
+		if uid == "intruder" {
+			return errors.New("unknown sub-device")
+		}
+		return nil
+	}
+	gw := gateway.New(upstream, auth)
+	gw.Logger = client.NopLogger()
+	assert.Nil(t, upstream.Connect())
+	defer upstream.Disconnect()
+
+	l, err := gw.Listen("tcp://127.0.0.1:0")
+	assert.Nil(t, err)
+	defer gw.Close()
+	local := &url.URL{Scheme: "mqtt", Host: l.Addr().String()}
+
+	sub, subOutput := newClient(t, broker, local, "sub1", "cmd/#")
+	events := sub.Events()
+	assert.Nil(t, sub.Connect())
+	defer sub.Disconnect()
+	waitFor(t, events, client.EventUp)
+	assert.Equal(t, []string{"sub1"}, gw.Devices())
+
+	// Messages from the sub-device go upstream over the gateway's connection, in the sub-device's namespace
+	assert.Nil(t, sub.Publish("telemetry", "21.5"))
+	select {
+	case m := <-broker.Received():
+		assert.Equal(t, "gateway", m.ClientID)
+		assert.Equal(t, "devices/sub1/telemetry", m.Topic)
+		assert.Equal(t, "21.5", string(m.Payload))
+	case <-time.After(timeout):
+		t.Fatal("publish not forwarded upstream")
+	}
+
+	// and messages in its namespace come back to it with the prefix removed
+	assert.Eventually(t, func() bool { return broker.Subscribed("devices/sub1/cmd/reboot") }, timeout, tick)
+	assert.Equal(t, 1, broker.Publish("devices/sub1/cmd/reboot", []byte("now")))
+	assert.Eventually(t, func() bool { return sub.DispatcherStats().Processed == 1 }, timeout, tick)
+	buf, err := ioutil.ReadFile(subOutput)
+	assert.Nil(t, err)
+	assert.Contains(t, string(buf), "now")
+
+	// Other upstream messages still reach the gateway's own handler
+	assert.Eventually(t, func() bool { return broker.Subscribed("gateway/in") }, timeout, tick)
+	assert.Equal(t, 1, broker.Publish("gateway/in", []byte("hello")))
+	assert.Eventually(t, func() bool { return upstream.DispatcherStats().Processed == 1 }, timeout, tick)
+	buf, err = ioutil.ReadFile(upstreamOutput)
+	assert.Nil(t, err)
+	assert.Contains(t, string(buf), "hello")
+
+	t.Run("unauthorised sub-device", func(t *testing.T) {
+		intruder, _ := newClient(t, broker, local, "intruder", "cmd")
+		events := intruder.Events()
+		assert.Nil(t, intruder.Connect())
+		defer intruder.Disconnect()
+		// The gateway refuses the uid before beginning the AUTH exchange
+		e := waitFor(t, events, client.EventDown)
+		assert.True(t, strings.Contains(e.Err.Error(), "unknown sub-device"), e.Err.Error())
+		assert.False(t, intruder.Status().Connected())
+		assert.Equal(t, []string{"sub1"}, gw.Devices())
+	})
+
+	// Upstream subscriptions are dropped once no sub-device needs them
+	assert.Nil(t, sub.Disconnect())
+	assert.Eventually(t, func() bool { return !broker.Subscribed("devices/sub1/cmd/reboot") }, timeout, tick)
+}
+
+func TestGatewayHandshakeTimeout(t *testing.T) {
+	gw := gateway.New(&client.Client{Config: &client.ClientConfig{}}, nil)
+	gw.HandshakeTimeout = 100 * time.Millisecond
+	gw.Logger = client.NopLogger()
+	defer gw.Close()
+
+	l, err := gw.Listen("tcp://127.0.0.1:0")
+	assert.Nil(t, err)
+	nc, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer nc.Close()
+
+	// A sub-device that never sends its CONNECT is disconnected
+	assert.Nil(t, nc.SetReadDeadline(time.Now().Add(timeout)))
+	_, err = nc.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestGatewayListen(t *testing.T) {
+	gw := gateway.New(&client.Client{Config: &client.ClientConfig{}}, nil)
+	defer gw.Close()
+
+	socket := filepath.Join(t.TempDir(), "gw.sock")
+	l, err := gw.Listen("unix://" + socket)
+	assert.Nil(t, err)
+	assert.Equal(t, "unix", l.Addr().Network())
+	nc, err := net.Dial("unix", socket)
+	assert.Nil(t, err)
+	nc.Close()
+
+	_, err = gw.Listen("ws://127.0.0.1:0")
+	assert.True(t, strings.Contains(err.Error(), "unsupported gateway listen address"))
+
+	assert.Equal(t, "devices/sub1/a/b", gw.UpstreamTopic("sub1", "a/b"))
+	gw.TopicPrefix = "site/7/{uid}/"
+	assert.Equal(t, "site/7/sub1/a/b", gw.UpstreamTopic("sub1", "a/b"))
+}
+
+// waitFor returns the first event of the given type, failing the test if none arrives in time
+func waitFor(t *testing.T, events <-chan client.Event, typ client.EventType) client.Event {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == typ {
+				return e
+			}
+		case <-deadline:
+			t.Fatalf("no %s event", typ)
+			return client.Event{}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package gateway
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/opensvn/auth-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribeMultipleFilters(t *testing.T) {
+	g := New(&client.Client{Config: &client.ClientConfig{}}, nil)
+	defer g.Close()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	c := g.newConn(local)
+	c.uid = "sub1"
+
+	// The SUBACK could not answer the filters in order, so the SUBSCRIBE is refused
+	go g.subscribe(c, &packets.Subscribe{
+		PacketID:      7,
+		Subscriptions: map[string]packets.SubOptions{"cmd/#": {}, "config": {}},
+	})
+	_ = remote.SetReadDeadline(time.Now().Add(time.Second))
+	cp, err := packets.ReadPacket(remote)
+	assert.Nil(t, err)
+	suback := cp.Content.(*packets.Suback)
+	assert.Equal(t, uint16(7), suback.PacketID)
+	assert.Equal(t, []byte{packets.SubackImplementationspecificerror, packets.SubackImplementationspecificerror}, suback.Reasons)
+	assert.Empty(t, c.subs)
+	assert.Empty(t, g.upstream)
+}
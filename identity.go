@@ -0,0 +1,89 @@
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// The hids GM/T 0044 assigns to the keys of an identity, identifying the function they are issued for
+const (
+	HidSign     byte = 0x01
+	HidExchange byte = 0x02
+	HidEncrypt  byte = 0x03
+)
+
+// DefaultPKGUid is the identity of the key generation centre that provisioning requests are encrypted to, unless
+// configured otherwise
+const DefaultPKGUid = "pkg"
+
+// ValidateSignHid checks that hid can be the hid of sign keys
+func ValidateSignHid(hid byte) error {
+	if hid != HidSign {
+		return fmt.Errorf("sign hid must be %s, not %s", FormatHid(HidSign), FormatHid(hid))
+	}
+	return nil
+}
+
+// ValidateEncryptHid checks that hid can be the hid of encrypt keys: the encrypt hid, the key exchange hid, whose keys
+// have the same form and which some key generation centres issue for both, or, as some issue both keys under one hid,
+// the sign hid
+func ValidateEncryptHid(hid byte) error {
+	switch hid {
+	case HidEncrypt, HidExchange, HidSign:
+		return nil
+	}
+	return fmt.Errorf("encrypt hid must be %s, %s or %s, not %s", FormatHid(HidEncrypt), FormatHid(HidExchange), FormatHid(HidSign), FormatHid(hid))
+}
+
+// FormatHid returns the form of hid sent in user properties and headers: two hex digits
+func FormatHid(hid byte) string {
+	return hex.EncodeToString([]byte{hid})
+}
+
+// ParseHid parses a hid formatted by FormatHid
+func ParseHid(s string) (byte, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil || len(buf) != 1 {
+		return 0, fmt.Errorf("invalid hid %q", s)
+	}
+	return buf[0], nil
+}
+
+// Identity is an SM9 identity as keys are issued for it: a uid, optionally qualified by a suffix such as a validity
+// period (uid||date), with the hids of its sign and encrypt keys
+type Identity struct {
+	Uid        string
+	Suffix     string // appended to Uid in the identity keys are issued for
+	SignHid    byte
+	EncryptHid byte // if zero, the encrypt keys are issued under SignHid
+}
+
+// ID returns the identity the keys are issued for, Uid followed by Suffix
+func (id Identity) ID() []byte {
+	return []byte(id.Uid + id.Suffix)
+}
+
+// EncryptionHid returns the hid data encrypted to the identity is encrypted with
+func (id Identity) EncryptionHid() byte {
+	if id.EncryptHid == 0 {
+		return id.SignHid
+	}
+	return id.EncryptHid
+}
+
+// Validate checks that the identity has a uid and that its hids suit their keys
+func (id Identity) Validate() error {
+	if id.Uid == "" {
+		return errors.New("uid required")
+	}
+	if err := ValidateSignHid(id.SignHid); err != nil {
+		return err
+	}
+	return ValidateEncryptHid(id.EncryptionHid())
+}
+
+// String returns the identity and its hids, for logs and errors
+func (id Identity) String() string {
+	return fmt.Sprintf("%s (sign hid %s, encrypt hid %s)", id.ID(), FormatHid(id.SignHid), FormatHid(id.EncryptionHid()))
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHid(t *testing.T) {
+	assert.Equal(t, "01", FormatHid(HidSign))
+	assert.Equal(t, "03", FormatHid(HidEncrypt))
+
+	hid, err := ParseHid("03")
+	assert.Nil(t, err)
+	assert.Equal(t, HidEncrypt, hid)
+	for _, s := range []string{"", "3", "0103", "zz"} {
+		_, err := ParseHid(s)
+		assert.NotNil(t, err, s)
+	}
+
+	assert.Nil(t, ValidateSignHid(HidSign))
+	assert.EqualError(t, ValidateSignHid(HidEncrypt), "sign hid must be 01, not 03")
+	for _, hid := range []byte{HidSign, HidExchange, HidEncrypt} {
+		assert.Nil(t, ValidateEncryptHid(hid))
+	}
+	assert.EqualError(t, ValidateEncryptHid(0), "encrypt hid must be 03, 02 or 01, not 00")
+	assert.NotNil(t, ValidateEncryptHid(4))
+}
+
+func TestIdentity(t *testing.T) {
+	id := Identity{Uid: "device1", Suffix: "|2026", SignHid: HidSign}
+	assert.Equal(t, []byte("device1|2026"), id.ID())
+	assert.Equal(t, HidSign, id.EncryptionHid())
+	assert.Nil(t, id.Validate())
+
+	id.EncryptHid = HidEncrypt
+	assert.Equal(t, HidEncrypt, id.EncryptionHid())
+	assert.Equal(t, "device1|2026 (sign hid 01, encrypt hid 03)", id.String())
+
+	assert.EqualError(t, Identity{SignHid: HidSign}.Validate(), "uid required")
+	assert.NotNil(t, Identity{Uid: "device1"}.Validate())
+	assert.NotNil(t, Identity{Uid: "device1", SignHid: HidSign, EncryptHid: 7}.Validate())
+}
+
+func TestUserIdentity(t *testing.T) {
+	t.Run("suffix", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1|2026", HidSign)
+		conf.Uid = "device1"
+		conf.IdentitySuffix = "|2026"
+		u, err := NewUserWithError(conf, UserOptions{RequirePrivateKeys: true})
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("device1|2026"), u.Uid)
+		assert.Equal(t, Identity{Uid: "device1", Suffix: "|2026", SignHid: HidSign}, u.Identity())
+		assert.Nil(t, u.Validate())
+
+		// The configuration written back keeps the uid and suffix apart
+		exported, err := u.MarshalConfig()
+		assert.Nil(t, err)
+		assert.Equal(t, conf, exported)
+
+		conf.IdentitySuffix = ""
+		assert.NotNil(t, NewUser(conf).Validate(), "keys are issued for the identity with its suffix")
+	})
+
+	t.Run("separate encrypt hid", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", HidSign)
+		enc := newTestUserConfig(t, "device1", HidEncrypt)
+		conf.EncryptPrivateKey = enc.EncryptPrivateKey
+		conf.EncryptMasterPublicKey = enc.EncryptMasterPublicKey
+
+		assert.NotNil(t, NewUser(conf).Validate())
+		conf.EncryptHid = HidEncrypt
+		u := NewUser(conf)
+		assert.Nil(t, u.Validate())
+		assert.Equal(t, HidEncrypt, u.Identity().EncryptionHid())
+
+		exported, err := u.MarshalConfig()
+		assert.Nil(t, err)
+		assert.Equal(t, HidEncrypt, exported.EncryptHid)
+	})
+
+	t.Run("invalid hids", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", HidSign)
+		conf.Hid = 0
+		_, err := NewUserWithError(conf, UserOptions{})
+		assert.EqualError(t, err, "hid: sign hid must be 01, not 00")
+
+		conf.Hid = HidSign
+		conf.EncryptHid = 9
+		_, err = NewUserWithError(conf, UserOptions{})
+		assert.EqualError(t, err, "encrypt_hid: encrypt hid must be 03, 02 or 01, not 09")
+	})
+}
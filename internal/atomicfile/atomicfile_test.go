@@ -0,0 +1,34 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys.yml")
+
+	assert.Nil(t, WriteFile(path, []byte("old"), 0600))
+	assert.Nil(t, WriteFile(path, []byte("new"), 0600))
+	buf, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(buf))
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// No temporary files are left behind, whether the write succeeds or fails
+	assert.NotNil(t, WriteFile(filepath.Join(dir, "missing", "keys.yml"), []byte("x"), 0600))
+	entries, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
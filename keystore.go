@@ -0,0 +1,96 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrKeysNotFound is returned by a KeyStore holding no keys for the identity
+var ErrKeysNotFound = errors.New("no keys stored for identity")
+
+// StoredKeys are the private keys of an identity as kept by a KeyStore: hex encoded ASN.1, as in UserConfig, with
+// their version and lifetime
+type StoredKeys struct {
+	EncryptPrivateKey string    `json:"encrypt_private_key"`
+	SignPrivateKey    string    `json:"sign_private_key"`
+	KeyVersion        int       `json:"key_version,omitempty"`
+	IssuedAt          time.Time `json:"issued_at"`
+	ExpiresAt         time.Time `json:"expires_at"`
+	EncryptHid        byte      `json:"encrypt_hid,omitempty"` // the hid of the encrypt key, zero if not recorded
+}
+
+// KeyStore keeps private keys apart from the configuration, see the keystore package for implementations
+type KeyStore interface {
+	Load(uid string) (*StoredKeys, error) // returns ErrKeysNotFound if there are none
+	Save(uid string, keys *StoredKeys) error
+	Delete(uid string) error
+}
+
+// NewUserFromStore creates the user described by conf, taking its private keys from store. Keys still held in conf
+// are used if the store has none, so that configurations predating the store keep working until they are migrated
+// with SaveUser. The returned user has no private keys if neither holds any.
+func NewUserFromStore(conf *UserConfig, store KeyStore) (*User, error) {
+	u, err := NewUserWithError(conf, UserOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := LoadKeys(conf, store)
+	if errors.Is(err, ErrKeysNotFound) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load keys: %w", err)
+	}
+
+	if err := u.SetEncryptPrivateKey(keys.EncryptPrivateKey); err != nil {
+		return nil, fmt.Errorf("stored encrypt private key: %w", err)
+	}
+	if err := u.SetSignPrivateKey(keys.SignPrivateKey); err != nil {
+		return nil, fmt.Errorf("stored sign private key: %w", err)
+	}
+	u.KeyVersion = keys.KeyVersion
+	u.IssuedAt = keys.IssuedAt
+	u.ExpiresAt = keys.ExpiresAt
+	return u, nil
+}
+
+// LoadKeys returns the keys store holds for the identity of conf. Keys are kept under the identity they are issued
+// for, the uid followed by any suffix, so a change of suffix finds none; keys issued under another encrypt hid are
+// likewise reported as ErrKeysNotFound, so that new keys are provisioned rather than failing to validate.
+func LoadKeys(conf *UserConfig, store KeyStore) (*StoredKeys, error) {
+	id := conf.Identity()
+	keys, err := store.Load(string(id.ID()))
+	if err != nil {
+		return nil, err
+	}
+	if keys.EncryptHid != 0 && keys.EncryptHid != id.EncryptionHid() {
+		return nil, ErrKeysNotFound
+	}
+	return keys, nil
+}
+
+// SaveUser stores the private keys of conf and removes them from it, so that the configuration can be written out
+// without them. They are stored under the identity they are issued for, see LoadKeys.
+func SaveUser(conf *UserConfig, store KeyStore) error {
+	id := conf.Identity()
+	err := store.Save(string(id.ID()), &StoredKeys{
+		EncryptPrivateKey: conf.EncryptPrivateKey,
+		SignPrivateKey:    conf.SignPrivateKey,
+		KeyVersion:        conf.KeyVersion,
+		IssuedAt:          conf.IssuedAt,
+		ExpiresAt:         conf.ExpiresAt,
+		EncryptHid:        id.EncryptionHid(),
+	})
+	if err != nil {
+		return err
+	}
+
+	conf.EncryptPrivateKey = ""
+	conf.SignPrivateKey = ""
+	conf.KeyVersion = 0
+	conf.IssuedAt = time.Time{}
+	conf.ExpiresAt = time.Time{}
+	return nil
+}
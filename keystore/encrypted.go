@@ -0,0 +1,201 @@
+package keystore
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/emmansun/gmsm/sm3"
+	"github.com/emmansun/gmsm/sm4"
+	"github.com/opensvn/auth-client"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	encryptedFileVersion = 1
+	kdfPBKDF2SM3         = "pbkdf2-sm3"
+	// DefaultIterations is the PBKDF2 iteration count used for new files
+	DefaultIterations = 100000
+	saltLen           = 16
+)
+
+// ErrWrongPassphrase is returned when an encrypted store cannot be opened, because the passphrase is wrong or the
+// file has been modified
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted key store")
+
+// encryptedFile is the format of the file: the stored entries, as JSON, sealed with SM4-GCM under a key derived from
+// the passphrase. The header fields are authenticated along with the ciphertext.
+type encryptedFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       string `json:"salt"`
+	IV         string `json:"iv"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+func (e *encryptedFile) additionalData() []byte {
+	return []byte(strconv.Itoa(e.Version) + "|" + e.KDF + "|" + strconv.Itoa(e.Iterations) + "|" + e.Salt)
+}
+
+// EncryptedFile keeps keys in a file encrypted with SM4-GCM under a key derived from a passphrase with PBKDF2-SM3. A
+// fresh salt and IV are used each time the file is written.
+type EncryptedFile struct {
+	Path       string
+	Passphrase []byte
+	Iterations int // for new files (defaults to DefaultIterations); existing files record their own
+
+	mu sync.Mutex
+}
+
+// NewEncryptedFile creates a store kept in the file at path, encrypted under the passphrase
+func NewEncryptedFile(path string, passphrase []byte) *EncryptedFile {
+	return &EncryptedFile{Path: path, Passphrase: passphrase}
+}
+
+func (f *EncryptedFile) Load(uid string) (*client.StoredKeys, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	keys, ok := entries[uid]
+	if !ok {
+		return nil, client.ErrKeysNotFound
+	}
+	return keys, nil
+}
+
+func (f *EncryptedFile) Save(uid string, keys *client.StoredKeys) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries, err := f.read()
+	if err != nil {
+		return err
+	}
+	entries[uid] = keys
+	return f.write(entries)
+}
+
+func (f *EncryptedFile) Delete(uid string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries, err := f.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[uid]; !ok {
+		return nil
+	}
+	delete(entries, uid)
+	return f.write(entries)
+}
+
+func (f *EncryptedFile) read() (map[string]*client.StoredKeys, error) {
+	entries := map[string]*client.StoredKeys{}
+	buf, err := readPrivateFile(f.Path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file encryptedFile
+	if err := json.Unmarshal(buf, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Path, err)
+	}
+	if file.Version != encryptedFileVersion || file.KDF != kdfPBKDF2SM3 || file.Iterations <= 0 {
+		return nil, fmt.Errorf("%s: unsupported key store version %d (kdf %q)", f.Path, file.Version, file.KDF)
+	}
+	salt, err := hex.DecodeString(file.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid salt", f.Path)
+	}
+	iv, err := hex.DecodeString(file.IV)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid iv", f.Path)
+	}
+	ciphertext, err := hex.DecodeString(file.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid ciphertext", f.Path)
+	}
+
+	aead, err := newAEAD(f.Passphrase, salt, file.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aead.NonceSize() {
+		return nil, fmt.Errorf("%s: invalid iv", f.Path)
+	}
+	plaintext, err := aead.Open(nil, iv, ciphertext, file.additionalData())
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	if err := json.Unmarshal(plaintext, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Path, err)
+	}
+	return entries, nil
+}
+
+func (f *EncryptedFile) write(entries map[string]*client.StoredKeys) error {
+	plaintext, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	iterations := f.Iterations
+	if iterations <= 0 {
+		iterations = DefaultIterations
+	}
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := newAEAD(f.Passphrase, salt, iterations)
+	if err != nil {
+		return err
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return err
+	}
+
+	file := encryptedFile{
+		Version:    encryptedFileVersion,
+		KDF:        kdfPBKDF2SM3,
+		Iterations: iterations,
+		Salt:       hex.EncodeToString(salt),
+		IV:         hex.EncodeToString(iv),
+	}
+	file.Ciphertext = hex.EncodeToString(aead.Seal(nil, iv, plaintext, file.additionalData()))
+
+	buf, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(f.Path, buf, filePerm)
+}
+
+// newAEAD derives the SM4 key from the passphrase and returns it in GCM mode
+func newAEAD(passphrase, salt []byte, iterations int) (cipher.AEAD, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase required")
+	}
+	key := pbkdf2.Key(passphrase, salt, iterations, sm4.BlockSize, sm3.New)
+	block, err := sm4.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,107 @@
+package keystore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/opensvn/auth-client"
+)
+
+// filePerm is the mode key files are written with; files readable by others are refused
+const filePerm = 0600
+
+// File keeps keys as JSON in a file only its owner may read or write, in the manner of an OS keyring file. The keys
+// are not encrypted, so the file's permissions are all that protects them.
+type File struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// NewFile creates a store kept in the file at path, which is created when keys are first saved
+func NewFile(path string) *File {
+	return &File{Path: path}
+}
+
+func (f *File) Load(uid string) (*client.StoredKeys, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	keys, ok := entries[uid]
+	if !ok {
+		return nil, client.ErrKeysNotFound
+	}
+	return keys, nil
+}
+
+func (f *File) Save(uid string, keys *client.StoredKeys) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries, err := f.read()
+	if err != nil {
+		return err
+	}
+	entries[uid] = keys
+	return f.write(entries)
+}
+
+func (f *File) Delete(uid string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries, err := f.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[uid]; !ok {
+		return nil
+	}
+	delete(entries, uid)
+	return f.write(entries)
+}
+
+// read returns the stored entries, an empty set if the file does not exist yet
+func (f *File) read() (map[string]*client.StoredKeys, error) {
+	entries := map[string]*client.StoredKeys{}
+	buf, err := readPrivateFile(f.Path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Path, err)
+	}
+	return entries, nil
+}
+
+func (f *File) write(entries map[string]*client.StoredKeys) error {
+	buf, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(f.Path, buf, filePerm)
+}
+
+// readPrivateFile reads a file holding keys, refusing it if its permissions allow others access (as ssh does with
+// private keys). Permissions are not checked on Windows, where they are not reflected in the file mode.
+func readPrivateFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s: permissions %#o allow access by others, expected %#o", path, info.Mode().Perm(), filePerm)
+	}
+	return ioutil.ReadFile(path)
+}
@@ -0,0 +1,61 @@
+// Package keystore provides implementations of client.KeyStore: a file readable only by its owner, a file encrypted
+// under a passphrase, and an adapter for PKCS#11-like tokens provided as plug-ins.
+package keystore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/internal/atomicfile"
+)
+
+// Types of store accepted by Open; any other type names a registered token
+const (
+	TypeFile      = "file"
+	TypeEncrypted = "encrypted"
+)
+
+// Options selects and configures a store
+type Options struct {
+	Type       string            // TypeFile, TypeEncrypted or the name of a token registered with RegisterToken
+	Path       string            // file of the file stores
+	Passphrase []byte            // passphrase of the encrypted store
+	PIN        string            // user PIN of a token
+	Params     map[string]string // passed to the token's opener
+}
+
+// Open creates the store selected by opts
+func Open(opts Options) (client.KeyStore, error) {
+	switch opts.Type {
+	case TypeFile:
+		if opts.Path == "" {
+			return nil, fmt.Errorf("%s key store requires a path", opts.Type)
+		}
+		return NewFile(opts.Path), nil
+	case TypeEncrypted:
+		if opts.Path == "" {
+			return nil, fmt.Errorf("%s key store requires a path", opts.Type)
+		}
+		if len(opts.Passphrase) == 0 {
+			return nil, fmt.Errorf("%s key store requires a passphrase", opts.Type)
+		}
+		return NewEncryptedFile(opts.Path, opts.Passphrase), nil
+	default:
+		token, err := OpenToken(opts.Type, opts.Params)
+		if err != nil {
+			return nil, err
+		}
+		return &TokenStore{Token: token, PIN: opts.PIN}, nil
+	}
+}
+
+// writeFile creates the directory of the file if need be and replaces the file atomically, so a crash leaves either the
+// old or the new contents
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data, perm)
+}
@@ -0,0 +1,136 @@
+package keystore
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opensvn/auth-client"
+	"github.com/stretchr/testify/assert"
+)
+
+var testKeys = &client.StoredKeys{
+	EncryptPrivateKey: "0381820004aa",
+	SignPrivateKey:    "0342000449bb",
+	KeyVersion:        3,
+	IssuedAt:          time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	ExpiresAt:         time.Date(2024, 2, 2, 3, 4, 5, 0, time.UTC),
+}
+
+// testStore checks the behaviour common to every store
+func testStore(t *testing.T, store client.KeyStore) {
+	_, err := store.Load("device1")
+	assert.True(t, errors.Is(err, client.ErrKeysNotFound))
+
+	assert.Nil(t, store.Save("device1", testKeys))
+	assert.Nil(t, store.Save("device2", &client.StoredKeys{SignPrivateKey: "02"}))
+
+	keys, err := store.Load("device1")
+	assert.Nil(t, err)
+	assert.Equal(t, testKeys, keys)
+
+	assert.Nil(t, store.Delete("device1"))
+	assert.Nil(t, store.Delete("device1"))
+	_, err = store.Load("device1")
+	assert.True(t, errors.Is(err, client.ErrKeysNotFound))
+
+	keys, err = store.Load("device2")
+	assert.Nil(t, err)
+	assert.Equal(t, "02", keys.SignPrivateKey)
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "keys.json")
+	testStore(t, NewFile(path))
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	assert.Nil(t, os.Chmod(path, 0644))
+	_, err = NewFile(path).Load("device2")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "allow access by others")
+}
+
+func TestEncryptedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.enc")
+	store := NewEncryptedFile(path, []byte("secret"))
+	store.Iterations = 10
+	testStore(t, store)
+
+	buf, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.False(t, strings.Contains(string(buf), "02"+`"`), "keys must not be stored in the clear")
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		_, err := NewEncryptedFile(path, []byte("guess")).Load("device2")
+		assert.True(t, errors.Is(err, ErrWrongPassphrase))
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		var file encryptedFile
+		assert.Nil(t, json.Unmarshal(buf, &file))
+		file.Iterations = 11
+		tampered, err := json.Marshal(file)
+		assert.Nil(t, err)
+		other := filepath.Join(t.TempDir(), "keys.enc")
+		assert.Nil(t, ioutil.WriteFile(other, tampered, 0600))
+
+		_, err = NewEncryptedFile(other, []byte("secret")).Load("device2")
+		assert.True(t, errors.Is(err, ErrWrongPassphrase))
+	})
+
+	t.Run("fresh salt on each write", func(t *testing.T) {
+		assert.Nil(t, store.Save("device3", testKeys))
+		again, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		var before, after encryptedFile
+		assert.Nil(t, json.Unmarshal(buf, &before))
+		assert.Nil(t, json.Unmarshal(again, &after))
+		assert.NotEqual(t, before.Salt, after.Salt)
+		assert.NotEqual(t, before.IV, after.IV)
+	})
+}
+
+func TestTokenStore(t *testing.T) {
+	token := NewMemoryToken("1234")
+	testStore(t, &TokenStore{Token: token, PIN: "1234"})
+
+	_, err := token.FindObject(label("device2"))
+	assert.NotNil(t, err, "the store must log out after each operation")
+
+	_, err = (&TokenStore{Token: token, PIN: "0000"}).Load("device2")
+	assert.True(t, errors.Is(err, ErrPINIncorrect))
+}
+
+func TestOpen(t *testing.T) {
+	token := NewMemoryToken("1234")
+	RegisterToken("test-token", func(params map[string]string) (Token, error) {
+		assert.Equal(t, "slot0", params["slot"])
+		return token, nil
+	})
+	assert.Contains(t, Tokens(), "test-token")
+	assert.Panics(t, func() { RegisterToken("test-token", nil) })
+
+	store, err := Open(Options{Type: "test-token", PIN: "1234", Params: map[string]string{"slot": "slot0"}})
+	assert.Nil(t, err)
+	assert.Nil(t, store.Save("device1", testKeys))
+
+	_, err = Open(Options{Type: "unknown"})
+	assert.NotNil(t, err)
+	_, err = Open(Options{Type: TypeEncrypted, Path: "keys.enc"})
+	assert.EqualError(t, err, "encrypted key store requires a passphrase")
+
+	store, err = Open(Options{Type: TypeFile, Path: filepath.Join(t.TempDir(), "keys.json")})
+	assert.Nil(t, err)
+	assert.IsType(t, &File{}, store)
+}
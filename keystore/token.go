@@ -0,0 +1,206 @@
+package keystore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/opensvn/auth-client"
+)
+
+// ErrObjectNotFound is returned by a Token holding no object with the label
+var ErrObjectNotFound = errors.New("object not found")
+
+// Token is the plug-in interface for hardware or software tokens, modelled on a PKCS#11 session: objects, identified
+// by label, may only be used between Login and Logout. Implementations are registered with RegisterToken so that they
+// can be selected by name in the configuration.
+type Token interface {
+	Login(pin string) error
+	Logout() error
+	FindObject(label string) ([]byte, error) // returns ErrObjectNotFound if there is none
+	CreateObject(label string, value []byte) error
+	DestroyObject(label string) error
+}
+
+// TokenOpener creates a Token from its configuration parameters
+type TokenOpener func(params map[string]string) (Token, error)
+
+var (
+	tokensMu sync.Mutex
+	tokens   = map[string]TokenOpener{}
+)
+
+// RegisterToken makes a token available to Open under name. It panics if the name is already in use, as registration
+// is expected to happen from init functions.
+func RegisterToken(name string, open TokenOpener) {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	if name == TypeFile || name == TypeEncrypted || tokens[name] != nil {
+		panic(fmt.Sprintf("keystore: token %q already registered", name))
+	}
+	tokens[name] = open
+}
+
+// OpenToken opens the token registered under name
+func OpenToken(name string, params map[string]string) (Token, error) {
+	tokensMu.Lock()
+	open := tokens[name]
+	tokensMu.Unlock()
+	if open == nil {
+		return nil, fmt.Errorf("unknown key store %q (registered tokens: %v)", name, Tokens())
+	}
+	return open(params)
+}
+
+// Tokens returns the names of the registered tokens
+func Tokens() []string {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	names := make([]string, 0, len(tokens))
+	for name := range tokens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TokenStore keeps the keys of each identity as an object on a Token, logging in for each operation
+type TokenStore struct {
+	Token Token
+	PIN   string
+
+	mu sync.Mutex
+}
+
+func label(uid string) string {
+	return "sm9-keys:" + uid
+}
+
+func (s *TokenStore) Load(uid string) (*client.StoredKeys, error) {
+	var keys client.StoredKeys
+	err := s.session(func() error {
+		value, err := s.Token.FindObject(label(uid))
+		if errors.Is(err, ErrObjectNotFound) {
+			return client.ErrKeysNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(value, &keys)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &keys, nil
+}
+
+func (s *TokenStore) Save(uid string, keys *client.StoredKeys) error {
+	value, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return s.session(func() error {
+		return s.Token.CreateObject(label(uid), value)
+	})
+}
+
+func (s *TokenStore) Delete(uid string) error {
+	return s.session(func() error {
+		err := s.Token.DestroyObject(label(uid))
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+// session runs fn whilst logged in to the token
+func (s *TokenStore) session(fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.Token.Login(s.PIN); err != nil {
+		return fmt.Errorf("token login: %w", err)
+	}
+	err := fn()
+	if logoutErr := s.Token.Logout(); logoutErr != nil && err == nil {
+		err = fmt.Errorf("token logout: %w", logoutErr)
+	}
+	return err
+}
+
+// MemoryToken is a Token holding objects in memory, protected by a PIN. It serves as a reference implementation and
+// for tests.
+type MemoryToken struct {
+	pin string
+
+	mu       sync.Mutex
+	loggedIn bool
+	objects  map[string][]byte
+}
+
+// NewMemoryToken creates an empty token with the PIN
+func NewMemoryToken(pin string) *MemoryToken {
+	return &MemoryToken{pin: pin, objects: map[string][]byte{}}
+}
+
+// ErrPINIncorrect is returned by MemoryToken.Login given the wrong PIN
+var ErrPINIncorrect = errors.New("pin incorrect")
+
+// errNotLoggedIn is returned by MemoryToken when an object is used outside a session
+var errNotLoggedIn = errors.New("user not logged in")
+
+func (t *MemoryToken) Login(pin string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if pin != t.pin {
+		return ErrPINIncorrect
+	}
+	t.loggedIn = true
+	return nil
+}
+
+func (t *MemoryToken) Logout() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.loggedIn = false
+	return nil
+}
+
+func (t *MemoryToken) FindObject(label string) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.loggedIn {
+		return nil, errNotLoggedIn
+	}
+	value, ok := t.objects[label]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (t *MemoryToken) CreateObject(label string, value []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.loggedIn {
+		return errNotLoggedIn
+	}
+	t.objects[label] = append([]byte(nil), value...)
+	return nil
+}
+
+func (t *MemoryToken) DestroyObject(label string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.loggedIn {
+		return errNotLoggedIn
+	}
+	if _, ok := t.objects[label]; !ok {
+		return ErrObjectNotFound
+	}
+	delete(t.objects, label)
+	return nil
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mapStore is a KeyStore held in memory
+type mapStore map[string]*StoredKeys
+
+func (m mapStore) Load(uid string) (*StoredKeys, error) {
+	keys, ok := m[uid]
+	if !ok {
+		return nil, ErrKeysNotFound
+	}
+	return keys, nil
+}
+
+func (m mapStore) Save(uid string, keys *StoredKeys) error {
+	m[uid] = keys
+	return nil
+}
+
+func (m mapStore) Delete(uid string) error {
+	delete(m, uid)
+	return nil
+}
+
+func TestNewUserFromStore(t *testing.T) {
+	t.Run("keys moved to the store", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", 1)
+		conf.KeyVersion = 2
+		conf.ExpiresAt = time.Now().Add(time.Hour).Round(0)
+		signKey := conf.SignPrivateKey
+
+		store := mapStore{}
+		assert.Nil(t, SaveUser(conf, store))
+		assert.Empty(t, conf.EncryptPrivateKey)
+		assert.Empty(t, conf.SignPrivateKey)
+		assert.Zero(t, conf.KeyVersion)
+		assert.Equal(t, signKey, store["device1"].SignPrivateKey)
+
+		u, err := NewUserFromStore(conf, store)
+		assert.Nil(t, err)
+		assert.Nil(t, u.Validate())
+		assert.Equal(t, 2, u.KeyVersion)
+		assert.False(t, u.ExpiresAt.IsZero())
+	})
+
+	t.Run("keys of another identity", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", 1)
+		conf.IdentitySuffix = "2026"
+		store := mapStore{}
+		assert.Nil(t, SaveUser(conf, store))
+		assert.NotNil(t, store["device12026"])
+
+		// Keys are issued for the identity with its suffix, so another suffix or encrypt hid needs new ones
+		conf.IdentitySuffix = "2027"
+		u, err := NewUserFromStore(conf, store)
+		assert.Nil(t, err)
+		assert.Nil(t, u.GetSignPrivateKey())
+
+		conf.IdentitySuffix = "2026"
+		conf.EncryptHid = HidEncrypt
+		u, err = NewUserFromStore(conf, store)
+		assert.Nil(t, err)
+		assert.Nil(t, u.GetEncryptPrivateKey())
+
+		conf.EncryptHid = 0
+		u, err = NewUserFromStore(conf, store)
+		assert.Nil(t, err)
+		assert.NotNil(t, u.GetSignPrivateKey())
+	})
+
+	t.Run("keys left in the configuration", func(t *testing.T) {
+		u, err := NewUserFromStore(newTestUserConfig(t, "device1", 1), mapStore{})
+		assert.Nil(t, err)
+		assert.Nil(t, u.Validate())
+	})
+
+	t.Run("corrupt stored keys", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", 1)
+		store := mapStore{"device1": {EncryptPrivateKey: "00", SignPrivateKey: conf.SignPrivateKey}}
+		_, err := NewUserFromStore(conf, store)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("store failure", func(t *testing.T) {
+		_, err := NewUserFromStore(newTestUserConfig(t, "device1", 1), failingStore{})
+		assert.True(t, errors.Is(err, errStoreFailed))
+	})
+}
+
+var errStoreFailed = errors.New("store failed")
+
+type failingStore struct{}
+
+func (failingStore) Load(string) (*StoredKeys, error) { return nil, errStoreFailed }
+func (failingStore) Save(string, *StoredKeys) error   { return errStoreFailed }
+func (failingStore) Delete(string) error              { return errStoreFailed }
@@ -0,0 +1,259 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log record. The values match those of log/slog so levels can be mapped directly.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+// ParseLevel converts the textual form used in configuration files into a Level
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// LogFormat selects how a logger created by NewLogger renders records
+type LogFormat int
+
+const (
+	LogFormatText LogFormat = iota // key=value pairs on a single line
+	LogFormatJSON                  // one JSON object per line
+)
+
+// ParseLogFormat converts the textual form used in configuration files into a LogFormat
+func ParseLogFormat(s string) (LogFormat, error) {
+	switch strings.ToLower(s) {
+	case "", "text":
+		return LogFormatText, nil
+	case "json":
+		return LogFormatJSON, nil
+	}
+	return LogFormatText, fmt.Errorf("unknown log format %q", s)
+}
+
+// Logger is the logging interface used throughout this module. Arguments following the message are alternating keys
+// and values, as with log/slog, so an *slog.Logger satisfies the interface.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// LoggerWith returns a Logger that adds args to every record written to l, as slog.Logger.With does
+func LoggerWith(l Logger, args ...interface{}) Logger {
+	if w, ok := l.(*withLogger); ok {
+		return &withLogger{l: w.l, args: append(append([]interface{}{}, w.args...), args...)}
+	}
+	return &withLogger{l: l, args: args}
+}
+
+// withLogger is the Logger returned by LoggerWith
+type withLogger struct {
+	l    Logger
+	args []interface{}
+}
+
+func (w *withLogger) Debug(msg string, args ...interface{}) { w.l.Debug(msg, w.with(args)...) }
+func (w *withLogger) Info(msg string, args ...interface{})  { w.l.Info(msg, w.with(args)...) }
+func (w *withLogger) Warn(msg string, args ...interface{})  { w.l.Warn(msg, w.with(args)...) }
+func (w *withLogger) Error(msg string, args ...interface{}) { w.l.Error(msg, w.with(args)...) }
+
+func (w *withLogger) with(args []interface{}) []interface{} {
+	return append(append(make([]interface{}, 0, len(w.args)+len(args)), w.args...), args...)
+}
+
+// redacted replaces the value of any field that may carry key material or other secrets
+const redacted = "[REDACTED]"
+
+// secretKeys are the fragments of field names whose values are never written out
+var secretKeys = []string{"private_key", "privatekey", "secret", "password", "passphrase", "token", "auth_data", "random"}
+
+// isSecret reports whether the value logged under key must be redacted
+func isSecret(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// stdLogger is the Logger returned by NewLogger
+type stdLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	level  Level
+	format LogFormat
+	now    func() time.Time
+}
+
+// NewLogger returns a Logger writing records at or above level to w
+func NewLogger(w io.Writer, level Level, format LogFormat) Logger {
+	return &stdLogger{w: w, level: level, format: format, now: time.Now}
+}
+
+// defaultLogger is used wherever a Logger has not been provided
+var defaultLogger = NewLogger(os.Stdout, LevelInfo, LogFormatText)
+
+func (l *stdLogger) Debug(msg string, args ...interface{}) { l.log(LevelDebug, msg, args) }
+func (l *stdLogger) Info(msg string, args ...interface{})  { l.log(LevelInfo, msg, args) }
+func (l *stdLogger) Warn(msg string, args ...interface{})  { l.log(LevelWarn, msg, args) }
+func (l *stdLogger) Error(msg string, args ...interface{}) { l.log(LevelError, msg, args) }
+
+func (l *stdLogger) log(level Level, msg string, args []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	fields := [][2]interface{}{{"time", l.now().Format(time.RFC3339Nano)}, {"level", level.String()}, {"msg", msg}}
+	for len(args) > 0 {
+		key, ok := args[0].(string)
+		if !ok || len(args) == 1 {
+			// Mirrors log/slog which reports a value without a key under !BADKEY
+			fields = append(fields, [2]interface{}{"!BADKEY", args[0]})
+			args = args[1:]
+			continue
+		}
+		value := args[1]
+		if isSecret(key) {
+			value = redacted
+		}
+		fields = append(fields, [2]interface{}{key, value})
+		args = args[2:]
+	}
+
+	var buf bytes.Buffer
+	if l.format == LogFormatJSON {
+		writeJSON(&buf, fields)
+	} else {
+		writeText(&buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(buf.Bytes())
+}
+
+// writeText renders the fields as key=value pairs, quoting values where needed
+func writeText(buf *bytes.Buffer, fields [][2]interface{}) {
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(f[0].(string))
+		buf.WriteByte('=')
+		s := stringValue(f[1])
+		if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+}
+
+// writeJSON renders the fields as a JSON object, keeping them in order
+func writeJSON(buf *bytes.Buffer, fields [][2]interface{}) {
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(f[0])
+		buf.Write(k)
+		buf.WriteByte(':')
+
+		var v []byte
+		switch value := f[1].(type) {
+		case error, fmt.Stringer:
+			v, _ = json.Marshal(stringValue(value))
+		default:
+			var err error
+			if v, err = json.Marshal(value); err != nil {
+				v, _ = json.Marshal(stringValue(value))
+			}
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+}
+
+// stringValue formats a field value for text output
+func stringValue(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case error:
+		return value.Error()
+	case fmt.Stringer:
+		return value.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// nopLogger discards everything
+type nopLogger struct{}
+
+// NopLogger returns a Logger that discards all records
+func NopLogger() Logger { return nopLogger{} }
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// pahoLogger implements the paho.Logger interface, passing paho and autopaho debug output to a Logger
+type pahoLogger struct {
+	log       Logger
+	component string
+}
+
+// Println implements paho.Logger
+func (l pahoLogger) Println(v ...interface{}) {
+	l.log.Debug(strings.TrimSuffix(fmt.Sprintln(v...), "\n"), "component", l.component)
+}
+
+// Printf implements paho.Logger
+func (l pahoLogger) Printf(format string, v ...interface{}) {
+	l.log.Debug(strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"), "component", l.component) // some log calls in paho add \n
+}
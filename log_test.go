@@ -0,0 +1,77 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLogger(buf *bytes.Buffer, level Level, format LogFormat) *stdLogger {
+	l := NewLogger(buf, level, format).(*stdLogger)
+	l.now = func() time.Time { return time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC) }
+	return l
+}
+
+func TestLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	l := newTestLogger(&buf, LevelInfo, LogFormatText)
+
+	l.Debug("hidden")
+	l.Info("connection up", "server", "tcp://127.0.0.1:1883", "attempt", 2)
+	l.Warn("failed", "err", errors.New("no route to host"), "odd")
+
+	assert.Equal(t, `time=2022-07-01T12:00:00Z level=INFO msg="connection up" server=tcp://127.0.0.1:1883 attempt=2
+time=2022-07-01T12:00:00Z level=WARN msg=failed err="no route to host" !BADKEY=odd
+`, buf.String())
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := newTestLogger(&buf, LevelDebug, LogFormatJSON)
+
+	l.Debug("provisioned", "uid", "device1", "hid", byte(1), "err", errors.New("none"))
+
+	var record map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, map[string]interface{}{
+		"time":  "2022-07-01T12:00:00Z",
+		"level": "DEBUG",
+		"msg":   "provisioned",
+		"uid":   "device1",
+		"hid":   float64(1),
+		"err":   "none",
+	}, record)
+}
+
+func TestLoggerRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	l := newTestLogger(&buf, LevelInfo, LogFormatText)
+
+	l.Info("keys", "sign_private_key", "0342", "EncryptPrivateKey", "0381", "auth_data", "abcd", "uid", "device1")
+
+	assert.Equal(t, "time=2022-07-01T12:00:00Z level=INFO msg=keys sign_private_key=[REDACTED] EncryptPrivateKey=[REDACTED] auth_data=[REDACTED] uid=device1\n", buf.String())
+}
+
+func TestLoggerWith(t *testing.T) {
+	var buf bytes.Buffer
+	l := LoggerWith(LoggerWith(newTestLogger(&buf, LevelInfo, LogFormatText), "uid", "device1"), "component", "pool")
+
+	l.Info("connected", "attempt", 1)
+
+	assert.Equal(t, "time=2022-07-01T12:00:00Z level=INFO msg=connected uid=device1 component=pool attempt=1\n", buf.String())
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		parsed, err := ParseLevel(level.String())
+		assert.Nil(t, err)
+		assert.Equal(t, level, parsed)
+	}
+
+	_, err := ParseLevel("verbose")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,267 @@
+// Package metrics is a small, dependency free metrics registry that renders its contents in the Prometheus text
+// exposition format. It provides just what the client needs: counters (optionally labelled), gauges and histograms.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are the default histogram buckets (in seconds), matching those of the Prometheus client library
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is implemented by every metric type
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds a set of metrics
+type Registry struct {
+	mu         sync.Mutex
+	names      map[string]bool
+	collectors []collector
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+// register adds the collector, panicking if the name is already in use (this is always a programming error)
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// NewCounter creates and registers a counter
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(name, &single{name: name, help: help, kind: "counter", value: c.Value})
+	return c
+}
+
+// NewCounterVec creates and registers a counter partitioned by the given labels
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, counters: map[string]*Counter{}}
+	r.register(name, c)
+	return c
+}
+
+// NewGauge creates and registers a gauge
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.register(name, &single{name: name, help: help, kind: "gauge", value: g.Value})
+	return g
+}
+
+// NewHistogram creates and registers a histogram. If buckets is nil DefBuckets is used.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	r.register(name, h)
+	return h
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP implements http.Handler so the registry can be mounted at /metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = r.WriteTo(w)
+}
+
+// Counter is a value that only ever increases
+type Counter struct {
+	bits uint64 // float64 bits, accessed atomically
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() { c.Add(1) }
+
+// Add adds v (which must not be negative) to the counter
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	addFloat(&c.bits, v)
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value() float64 { return math.Float64frombits(atomic.LoadUint64(&c.bits)) }
+
+// CounterVec is a set of counters sharing a name, distinguished by label values
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu       sync.Mutex
+	keys     []string
+	counters map[string]*Counter
+}
+
+// WithLabelValues returns the counter for the label values (given in the order the labels were declared)
+func (c *CounterVec) WithLabelValues(values ...string) *Counter {
+	if len(values) != len(c.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", c.name, len(c.labels), len(values)))
+	}
+	pairs := make([]string, len(values))
+	for i, v := range values {
+		pairs[i] = c.labels[i] + `="` + escapeLabel(v) + `"`
+	}
+	key := strings.Join(pairs, ",")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counter, ok := c.counters[key]
+	if !ok {
+		counter = &Counter{}
+		c.counters[key] = counter
+		c.keys = append(c.keys, key)
+		sort.Strings(c.keys)
+	}
+	return counter
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range c.keys {
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, key, formatFloat(c.counters[key].Value()))
+	}
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	bits uint64 // float64 bits, accessed atomically
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64) { atomic.StoreUint64(&g.bits, math.Float64bits(v)) }
+
+// Add adds v (which may be negative) to the gauge
+func (g *Gauge) Add(v float64) { addFloat(&g.bits, v) }
+
+// Inc adds one to the gauge
+func (g *Gauge) Inc() { g.Add(1) }
+
+// Dec subtracts one from the gauge
+func (g *Gauge) Dec() { g.Add(-1) }
+
+// Value returns the current value of the gauge
+func (g *Gauge) Value() float64 { return math.Float64frombits(atomic.LoadUint64(&g.bits)) }
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	name, help string
+	buckets    []float64
+
+	mu     sync.Mutex
+	counts []uint64 // non-cumulative count per bucket
+	count  uint64
+	sum    float64
+}
+
+// Observe records a single observation
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v) // first bucket with an upper bound >= v
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// single renders an unlabelled counter or gauge
+type single struct {
+	name, help, kind string
+	value            func() float64
+}
+
+func (s *single) write(w *bufio.Writer) {
+	writeHeader(w, s.name, s.help, s.kind)
+	fmt.Fprintf(w, "%s %s\n", s.name, formatFloat(s.value()))
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// addFloat atomically adds v to the float64 stored as bits in addr
+func addFloat(addr *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		updated := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(addr, old, updated) {
+			return
+		}
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// countingWriter counts the bytes written so WriteTo can report them
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	connects := r.NewCounterVec("connects_total", "Connection attempts.", "result")
+	connects.WithLabelValues("success").Inc()
+	connects.WithLabelValues("failure").Add(2)
+	connects.WithLabelValues("success").Inc()
+
+	up := r.NewGauge("connected", "1 if connected.")
+	up.Inc()
+
+	received := r.NewCounter("received_total", "Messages received.")
+	received.Add(3)
+
+	latency := r.NewHistogram("latency_seconds", "Handler latency.", []float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(2)
+
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, `# HELP connects_total Connection attempts.
+# TYPE connects_total counter
+connects_total{result="failure"} 2
+connects_total{result="success"} 2
+# HELP connected 1 if connected.
+# TYPE connected gauge
+connected 1
+# HELP received_total Messages received.
+# TYPE received_total counter
+received_total 3
+# HELP latency_seconds Handler latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.55
+latency_seconds_count 3
+`, buf.String())
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("requests_total", "Requests.", "path").WithLabelValues(`/a"b`).Inc()
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), `requests_total{path="/a\"b"} 1`)
+}
+
+func TestRegistryDuplicate(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("dup", "")
+	assert.Panics(t, func() { r.NewGauge("dup", "") })
+}
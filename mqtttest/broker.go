@@ -0,0 +1,424 @@
+// Package mqtttest provides a minimal in-process MQTT v5 broker that performs the server side of SM9 enhanced
+// authentication, so that clients can be tested end to end without a real broker.
+//
+// The broker supports what the client needs and little more: CONNECT with the "sm9" authentication method,
+// SUBSCRIBE/UNSUBSCRIBE with wildcards, PUBLISH at QoS 0 to 2 (forwarded to subscribers at QoS 0), PINGREQ and
+// DISCONNECT. Sessions, retained messages and wills are not supported.
+package mqtttest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/emmansun/gmsm/sm9"
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/sm9test"
+)
+
+// Message is a PUBLISH received from a client
+type Message struct {
+	ClientID string
+	Topic    string
+	Payload  []byte
+	QoS      byte
+}
+
+// conn is a connected client
+type conn struct {
+	net.Conn
+	clientID string
+	subs     map[string]byte // topic filter to granted QoS
+}
+
+// Broker is a minimal MQTT v5 broker. Clients are authenticated by a client.ServerAuthenticator holding keys issued
+// from EncryptMaster for the broker's identity, Uid and Hid. The fields must not be modified.
+type Broker struct {
+	EncryptMaster *sm9.EncryptMasterPrivateKey
+	SignMaster    *sm9.SignMasterPrivateKey
+	Uid           []byte // identity of the broker, "broker"
+	Hid           byte   // hid of the broker and of the keys issued by UserConfig, 1
+
+	listener net.Listener
+	auth     client.ServerAuthHook
+	masters  *sm9test.Masters // EncryptMaster and SignMaster, with the public keys encoded once for UserConfig
+	received chan Message
+	wg       sync.WaitGroup
+
+	mu         sync.Mutex
+	conns      map[*conn]bool
+	tamperAuth func(a *packets.Auth, fromClient bool)
+	refuse     byte
+	authOK     int
+	authFailed int
+	closed     bool
+}
+
+// NewBroker starts a broker listening on a local port, with freshly generated master keys. It panics on failure, like
+// httptest.NewServer.
+func NewBroker() *Broker {
+	masters, err := sm9test.NewMasters()
+	if err != nil {
+		panic(fmt.Sprintf("mqtttest: %v", err))
+	}
+	b := &Broker{
+		EncryptMaster: masters.Encrypt,
+		SignMaster:    masters.Sign,
+		Uid:           []byte("broker"),
+		Hid:           1,
+		masters:       masters,
+		received:      make(chan Message, 1024),
+		conns:         map[*conn]bool{},
+	}
+
+	conf, err := b.UserConfig(string(b.Uid))
+	if err != nil {
+		panic(fmt.Sprintf("mqtttest: generate broker keys: %v", err))
+	}
+	b.auth, err = client.NewServerAuthenticator(client.NewUser(conf))
+	if err != nil {
+		panic(fmt.Sprintf("mqtttest: %v", err))
+	}
+
+	b.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("mqtttest: listen: %v", err))
+	}
+	b.wg.Add(1)
+	go b.serve()
+	return b
+}
+
+// URL returns the address clients should connect to
+func (b *Broker) URL() *url.URL {
+	return &url.URL{Scheme: "mqtt", Host: b.listener.Addr().String()}
+}
+
+// UserConfig returns a configuration for uid with private keys issued by the broker's master keys
+func (b *Broker) UserConfig(uid string) (*client.UserConfig, error) {
+	keys, err := b.masters.Keys(uid, b.Hid)
+	if err != nil {
+		return nil, err
+	}
+	return &client.UserConfig{
+		Uid:                    uid,
+		Hid:                    b.Hid,
+		EncryptPrivateKey:      keys.EncryptPrivateKey,
+		SignPrivateKey:         keys.SignPrivateKey,
+		EncryptMasterPublicKey: keys.EncryptMasterPublicKey,
+		SignMasterPublicKey:    keys.SignMasterPublicKey,
+	}, nil
+}
+
+// SetTamperAuth installs a hook called with each AUTH packet exchanged during the handshake: those the broker is
+// about to send, and those received from the client before they are checked. The hook may modify the packet.
+func (b *Broker) SetTamperAuth(fn func(a *packets.Auth, fromClient bool)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tamperAuth = fn
+}
+
+// SetRefuse makes the broker refuse connections with a CONNACK carrying reasonCode before any authentication exchange,
+// as a broker that is busy or banning the client would; 0 accepts them again
+func (b *Broker) SetRefuse(reasonCode byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refuse = reasonCode
+}
+
+// Handshakes returns the number of SM9 handshakes that succeeded and failed
+func (b *Broker) Handshakes() (ok, failed int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.authOK, b.authFailed
+}
+
+// Received returns the channel PUBLISH packets from clients are delivered on. Messages are dropped if it is full.
+func (b *Broker) Received() <-chan Message {
+	return b.received
+}
+
+// Clients returns the ids of the connected clients
+func (b *Broker) Clients() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ids []string
+	for c := range b.conns {
+		ids = append(ids, c.clientID)
+	}
+	return ids
+}
+
+// Subscribed reports whether any client holds a subscription matching topic
+func (b *Broker) Subscribed(topic string) bool {
+	return len(b.subscribers(topic)) > 0
+}
+
+// Publish sends a message to every client subscribed to topic, returning the number it was sent to
+func (b *Broker) Publish(topic string, payload []byte) int {
+	sent := 0
+	for _, c := range b.subscribers(topic) {
+		p := &packets.Publish{Topic: topic, Payload: payload, Properties: &packets.Properties{}}
+		if _, err := p.WriteTo(c); err == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+// DisconnectAll sends DISCONNECT with the reason code to every client and closes their connections
+func (b *Broker) DisconnectAll(reasonCode byte) {
+	b.mu.Lock()
+	conns := make([]*conn, 0, len(b.conns))
+	for c := range b.conns {
+		conns = append(conns, c)
+	}
+	b.mu.Unlock()
+
+	for _, c := range conns {
+		d := &packets.Disconnect{ReasonCode: reasonCode, Properties: &packets.Properties{}}
+		_, _ = d.WriteTo(c)
+		_ = c.Close()
+	}
+}
+
+// Close stops the broker, closing all connections
+func (b *Broker) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	_ = b.listener.Close()
+	b.mu.Lock()
+	for c := range b.conns {
+		_ = c.Close()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+func (b *Broker) serve() {
+	defer b.wg.Done()
+	for {
+		nc, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.handle(&conn{Conn: packets.NewThreadSafeConn(nc), subs: map[string]byte{}})
+		}()
+	}
+}
+
+// handle runs a connection: the handshake, then the packet loop until the client goes away
+func (b *Broker) handle(c *conn) {
+	defer c.Close()
+
+	if err := b.connect(c); err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.conns[c] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, c)
+		b.mu.Unlock()
+	}()
+
+	for {
+		cp, err := packets.ReadPacket(c)
+		if err != nil {
+			return
+		}
+		switch p := cp.Content.(type) {
+		case *packets.Subscribe:
+			b.subscribe(c, p)
+		case *packets.Unsubscribe:
+			b.unsubscribe(c, p)
+		case *packets.Publish:
+			b.publish(c, p)
+		case *packets.Pubrel:
+			_, _ = (&packets.Pubcomp{PacketID: p.PacketID, Properties: &packets.Properties{}}).WriteTo(c)
+		case *packets.Pingreq:
+			_, _ = (&packets.Pingresp{}).WriteTo(c)
+		case *packets.Disconnect:
+			return
+		}
+	}
+}
+
+// connect reads the CONNECT packet and runs the enhanced authentication exchange, sending the CONNACK
+func (b *Broker) connect(c *conn) error {
+	cp, err := packets.ReadPacket(c)
+	if err != nil {
+		return err
+	}
+	connect, ok := cp.Content.(*packets.Connect)
+	if !ok {
+		return fmt.Errorf("expected CONNECT, got %s", cp.PacketType())
+	}
+	c.clientID = connect.ClientID
+
+	b.mu.Lock()
+	refuse := b.refuse
+	b.mu.Unlock()
+	if refuse != 0 {
+		_, _ = (&packets.Connack{ReasonCode: refuse, Properties: &packets.Properties{}}).WriteTo(c)
+		return fmt.Errorf("refused with reason code %#x", refuse)
+	}
+
+	if connect.Properties == nil || connect.Properties.AuthMethod != b.auth.AuthMethod() {
+		return b.connack(c, packets.ConnackBadAuthenticationMethod, errors.New("unsupported authentication method"))
+	}
+	if err := b.authenticate(c, connect.Properties); err != nil {
+		return b.connack(c, packets.ConnackNotAuthorized, err)
+	}
+	return b.connack(c, packets.ConnackSuccess, nil)
+}
+
+// authenticate runs the exchange through the broker's ServerAuthHook, as a broker embedding it would
+func (b *Broker) authenticate(c *conn, props *packets.Properties) error {
+	exchange, auth, err := b.auth.OnConnect(props)
+	for err == nil && auth != nil {
+		b.tamper(auth, false)
+		if _, err := auth.WriteTo(c); err != nil {
+			return err
+		}
+
+		cp, rerr := packets.ReadPacket(c)
+		if rerr != nil {
+			return rerr
+		}
+		reply, ok := cp.Content.(*packets.Auth)
+		if !ok {
+			return fmt.Errorf("expected AUTH, got %s", cp.PacketType())
+		}
+		if reply.Properties == nil {
+			reply.Properties = &packets.Properties{}
+		}
+		b.tamper(reply, true)
+		auth, err = exchange.OnAuth(reply)
+	}
+	return err
+}
+
+// connack sends the CONNACK, recording the outcome of the handshake, and returns err
+func (b *Broker) connack(c *conn, reasonCode byte, err error) error {
+	b.mu.Lock()
+	if reasonCode == packets.ConnackSuccess {
+		b.authOK++
+	} else {
+		b.authFailed++
+	}
+	b.mu.Unlock()
+
+	props := &packets.Properties{AuthMethod: b.auth.AuthMethod()}
+	if err != nil {
+		props.ReasonString = err.Error()
+	}
+	if _, werr := (&packets.Connack{ReasonCode: reasonCode, Properties: props}).WriteTo(c); werr != nil && err == nil {
+		return werr
+	}
+	return err
+}
+
+func (b *Broker) tamper(a *packets.Auth, fromClient bool) {
+	b.mu.Lock()
+	fn := b.tamperAuth
+	b.mu.Unlock()
+	if fn != nil {
+		fn(a, fromClient)
+	}
+}
+
+func (b *Broker) subscribe(c *conn, s *packets.Subscribe) {
+	suback := &packets.Suback{PacketID: s.PacketID, Properties: &packets.Properties{}}
+	b.mu.Lock()
+	for filter, opts := range s.Subscriptions {
+		qos := opts.QoS
+		if qos > 1 {
+			qos = 1
+		}
+		c.subs[filter] = qos
+		suback.Reasons = append(suback.Reasons, qos)
+	}
+	b.mu.Unlock()
+	_, _ = suback.WriteTo(c)
+}
+
+func (b *Broker) unsubscribe(c *conn, u *packets.Unsubscribe) {
+	unsuback := &packets.Unsuback{PacketID: u.PacketID, Properties: &packets.Properties{}}
+	b.mu.Lock()
+	for _, filter := range u.Topics {
+		if _, ok := c.subs[filter]; ok {
+			delete(c.subs, filter)
+			unsuback.Reasons = append(unsuback.Reasons, packets.UnsubackSuccess)
+		} else {
+			unsuback.Reasons = append(unsuback.Reasons, packets.UnsubackNoSubscriptionFound)
+		}
+	}
+	b.mu.Unlock()
+	_, _ = unsuback.WriteTo(c)
+}
+
+func (b *Broker) publish(c *conn, p *packets.Publish) {
+	select {
+	case b.received <- Message{ClientID: c.clientID, Topic: p.Topic, Payload: p.Payload, QoS: p.QoS}:
+	default:
+	}
+
+	switch p.QoS {
+	case 1:
+		_, _ = (&packets.Puback{PacketID: p.PacketID, Properties: &packets.Properties{}}).WriteTo(c)
+	case 2:
+		_, _ = (&packets.Pubrec{PacketID: p.PacketID, Properties: &packets.Properties{}}).WriteTo(c)
+	}
+	b.Publish(p.Topic, p.Payload)
+}
+
+// subscribers returns the connections with a subscription matching topic
+func (b *Broker) subscribers(topic string) []*conn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var matched []*conn
+	for c := range b.conns {
+		for filter := range c.subs {
+			if match(filter, topic) {
+				matched = append(matched, c)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// match reports whether topic matches the filter, which may contain the + and # wildcards
+func match(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
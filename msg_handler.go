@@ -3,40 +3,53 @@ package client
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/eclipse/paho.golang/paho"
 )
 
+// RetryPolicy controls how a failed write to the output file is retried
+type RetryPolicy struct {
+	Attempts int           // total number of attempts (values below 1 mean a single attempt)
+	Delay    time.Duration // wait before the first retry, doubled before each subsequent one
+}
+
 // handler is a simple struct that provides a function to be called when a message is received. The message is parsed
 // and the count followed by the raw message is written to the file (this makes it easier to sort the file)
 type handler struct {
 	writeToStdOut bool
+	retry         RetryPolicy
+	onError       func(error) // called when a message could not be written out after all attempts (logged if nil)
+	log           Logger
 
-	f *os.File
+	f  io.WriteCloser // the output file, nil if messages are not written to disk
+	mu sync.Mutex     // held across the attempts of a write, so that the lines of dispatcher workers do not interleave
 }
 
 // NewHandler creates a new output handler and opens the output file (if applicable)
-func NewHandler(writeToDisk bool, fileName string, writeToStdOut bool) *handler {
-	var f *os.File
+func NewHandler(writeToDisk bool, fileName string, writeToStdOut bool) (*handler, error) {
+	h := &handler{
+		writeToStdOut: writeToStdOut,
+		log:           defaultLogger,
+	}
 	if writeToDisk {
-		var err error
-		f, err = os.Create(fileName)
+		f, err := os.Create(fileName)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("create output file: %w", err)
 		}
+		h.f = f
 	}
-	return &handler{
-		writeToStdOut: writeToStdOut,
-		f:             f,
-	}
+	return h, nil
 }
 
 // Close closes the file
 func (o *handler) Close() {
 	if o.f != nil {
 		if err := o.f.Close(); err != nil {
-			fmt.Printf("ERROR closing file: %s", err)
+			o.log.Error("closing output file", "err", err)
 		}
 		o.f = nil
 	}
@@ -52,12 +65,17 @@ func (o *handler) handle(msg *paho.Publish) {
 	// We extract the count and write that out first to simplify checking for missing values
 	var m Message
 	if err := json.Unmarshal(msg.Payload, &m); err != nil {
-		fmt.Printf("Message could not be parsed (%s): %s", msg.Payload, err)
+		o.log.Warn("message could not be parsed", "topic", msg.Topic, "payload", string(msg.Payload), "err", err)
 	}
 	if o.f != nil {
 		// Write out the number (make it long enough that sorting works) and the payload
-		if _, err := o.f.WriteString(fmt.Sprintf("%09d %s\n", m.Count, msg.Payload)); err != nil {
-			fmt.Printf("ERROR writing to file: %s", err)
+		if err := o.write(fmt.Sprintf("%09d %s\n", m.Count, msg.Payload)); err != nil {
+			err = fmt.Errorf("message on %s not written: %w", msg.Topic, err)
+			if o.onError != nil {
+				o.onError(err)
+			} else {
+				o.log.Error("writing to output file", "err", err)
+			}
 		}
 	}
 
@@ -65,3 +83,25 @@ func (o *handler) handle(msg *paho.Publish) {
 		fmt.Printf("received message: %s\n", msg.Payload)
 	}
 }
+
+// write writes the line to the output file, retrying in line with the retry policy. A retry writes only what the
+// failed attempt left unwritten, so that a short write does not duplicate the start of the line, and no other line is
+// written until it is done.
+func (o *handler) write(line string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delay := o.retry.Delay
+	for attempt := 1; ; attempt++ {
+		n, err := io.WriteString(o.f, line)
+		line = line[n:]
+		if err == nil {
+			return nil
+		}
+		if attempt >= o.retry.Attempts {
+			return fmt.Errorf("%d attempt(s) failed: %w", attempt, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
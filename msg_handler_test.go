@@ -0,0 +1,96 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHandler(t *testing.T) {
+	t.Run("file cannot be created", func(t *testing.T) {
+		h, err := NewHandler(true, filepath.Join(t.TempDir(), "missing", "msg.txt"), false)
+		assert.NotNil(t, err)
+		assert.Nil(t, h)
+	})
+
+	t.Run("messages written to file", func(t *testing.T) {
+		fileName := filepath.Join(t.TempDir(), "msg.txt")
+		h, err := NewHandler(true, fileName, false)
+		assert.Nil(t, err)
+
+		h.handle(&paho.Publish{Topic: "t", Payload: []byte(`{"Count":7}`)})
+		h.Close()
+
+		buf, err := ioutil.ReadFile(fileName)
+		assert.Nil(t, err)
+		assert.Equal(t, "000000007 {\"Count\":7}\n", string(buf))
+	})
+}
+
+func TestHandlerWriteFailure(t *testing.T) {
+	h, err := NewHandler(true, filepath.Join(t.TempDir(), "msg.txt"), false)
+	assert.Nil(t, err)
+	h.retry = RetryPolicy{Attempts: 3, Delay: time.Millisecond}
+
+	var errs []error
+	h.onError = func(err error) { errs = append(errs, err) }
+
+	// Closing the file underneath the handler makes every write fail
+	assert.Nil(t, h.f.Close())
+	h.handle(&paho.Publish{Topic: "t", Payload: []byte(`{"Count":1}`)})
+
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "3 attempt(s) failed")
+}
+
+// shortWriter accepts at most limit bytes per write, failing writes it cuts short
+type shortWriter struct {
+	limit int
+	buf   bytes.Buffer
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		w.buf.Write(p[:w.limit])
+		return w.limit, errors.New("short write")
+	}
+	return w.buf.Write(p)
+}
+
+func (w *shortWriter) Close() error {
+	return nil
+}
+
+func TestHandlerShortWrite(t *testing.T) {
+	w := &shortWriter{limit: 8}
+	h := &handler{log: NopLogger(), f: w, retry: RetryPolicy{Attempts: 5, Delay: time.Millisecond}}
+
+	h.handle(&paho.Publish{Topic: "t", Payload: []byte(`{"Count":3}`)})
+	assert.Equal(t, "000000003 {\"Count\":3}\n", w.buf.String(), "retries write only the remainder")
+
+	// Concurrent workers do not write between the parts of a line
+	w.buf.Reset()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h.handle(&paho.Publish{Topic: "t", Payload: []byte(fmt.Sprintf(`{"Count":%d}`, i))})
+		}(i)
+	}
+	wg.Wait()
+	lines := strings.Split(strings.TrimSuffix(w.buf.String(), "\n"), "\n")
+	assert.Len(t, lines, 8)
+	for _, line := range lines {
+		assert.Regexp(t, `^00000000\d \{"Count":\d\}$`, line)
+	}
+}
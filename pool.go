@@ -0,0 +1,181 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+// Pool manages the clients of several SM9 identities, for example a gateway acting on behalf of its sub-devices. Each
+// identity authenticates over its own connection to the broker, so that the broker attributes its traffic correctly.
+type Pool struct {
+	ServerUrl *url.URL
+	Logger    Logger   // if nil, records at info level and above are written to stdout
+	Metrics   *Metrics // shared by the clients; if nil, no metrics are recorded
+
+	mu        sync.Mutex
+	clients   map[string]*Client
+	uids      []string // in the order the identities were added
+	connected bool
+}
+
+// NewPool creates an empty pool of clients connecting to serverUrl
+func NewPool(serverUrl *url.URL) *Pool {
+	return &Pool{ServerUrl: serverUrl, clients: map[string]*Client{}}
+}
+
+// logger returns the Logger the pool should use
+func (p *Pool) logger() Logger {
+	if p.Logger == nil {
+		return defaultLogger
+	}
+	return p.Logger
+}
+
+// Add creates the client of an identity. Its ClientID must be unique within the pool, as the broker would otherwise
+// drop one connection each time the other connects. The client is connected at once if the pool is.
+func (p *Pool) Add(user *User, conf *ClientConfig) (*Client, error) {
+	if user == nil || len(user.Uid) == 0 {
+		return nil, errors.New("user with a uid required")
+	}
+	if conf == nil {
+		return nil, errors.New("client configuration required")
+	}
+	uid := string(user.Uid)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clients == nil {
+		p.clients = map[string]*Client{}
+	}
+	if _, ok := p.clients[uid]; ok {
+		return nil, fmt.Errorf("identity %q already in the pool", uid)
+	}
+	for _, other := range p.clients {
+		if other.Config.ClientID == conf.ClientID {
+			return nil, fmt.Errorf("identity %q: client id %q already used by identity %q", uid, conf.ClientID, string(other.user().Uid))
+		}
+	}
+
+	c := &Client{
+		ServerUrl: p.ServerUrl,
+		User:      user,
+		Config:    conf,
+		Logger:    LoggerWith(p.logger(), "uid", uid),
+		Metrics:   p.Metrics,
+	}
+	c.AuthHandler = NewSm9Auth(c)
+	if p.connected {
+		if err := c.Connect(); err != nil {
+			return nil, fmt.Errorf("identity %q: %w", uid, err)
+		}
+	}
+
+	p.clients[uid] = c
+	p.uids = append(p.uids, uid)
+	return c, nil
+}
+
+// Remove disconnects the client of the identity, if the pool is connected, and removes it from the pool
+func (p *Pool) Remove(uid string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.clients[uid]
+	if !ok {
+		return fmt.Errorf("identity %q not in the pool", uid)
+	}
+
+	delete(p.clients, uid)
+	for i, u := range p.uids {
+		if u == uid {
+			p.uids = append(p.uids[:i], p.uids[i+1:]...)
+			break
+		}
+	}
+	if p.connected {
+		return c.Disconnect()
+	}
+	return nil
+}
+
+// Client returns the client of the identity, nil if it is not in the pool
+func (p *Pool) Client(uid string) *Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.clients[uid]
+}
+
+// Uids returns the uids of the identities in the order they were added
+func (p *Pool) Uids() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.uids...)
+}
+
+// Clients returns the clients in the order their identities were added
+func (p *Pool) Clients() []*Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clients := make([]*Client, 0, len(p.uids))
+	for _, uid := range p.uids {
+		clients = append(clients, p.clients[uid])
+	}
+	return clients
+}
+
+// Connect connects the clients of every identity. If any cannot be connected, those already connected are
+// disconnected again and the error returned.
+func (p *Pool) Connect() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.connected {
+		return errors.New("pool already connected")
+	}
+
+	for i, uid := range p.uids {
+		if err := p.clients[uid].Connect(); err != nil {
+			for _, connected := range p.uids[:i] {
+				if derr := p.clients[connected].Disconnect(); derr != nil {
+					p.logger().Warn("disconnect error", "uid", connected, "err", derr)
+				}
+			}
+			return fmt.Errorf("identity %q: %w", uid, err)
+		}
+	}
+	p.connected = true
+	return nil
+}
+
+// Disconnect disconnects every client, returning the first error met
+func (p *Pool) Disconnect() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.connected {
+		return nil
+	}
+	p.connected = false
+
+	var first error
+	for _, uid := range p.uids {
+		if err := p.clients[uid].Disconnect(); err != nil {
+			p.logger().Warn("disconnect error", "uid", uid, "err", err)
+			if first == nil {
+				first = fmt.Errorf("identity %q: %w", uid, err)
+			}
+		}
+	}
+	return first
+}
+
+// UpdateUser replaces the user of the client with the same uid, see Client.UpdateUser
+func (p *Pool) UpdateUser(u *User) error {
+	if u == nil {
+		return errors.New("user required")
+	}
+	c := p.Client(string(u.Uid))
+	if c == nil {
+		return fmt.Errorf("identity %q not in the pool", string(u.Uid))
+	}
+	return c.UpdateUser(u)
+}
@@ -0,0 +1,78 @@
+package client_test
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/mqtttest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	pool := client.NewPool(broker.URL())
+	pool.Logger = client.NopLogger()
+
+	add := func(uid, clientID string) (*client.Client, error) {
+		conf, err := broker.UserConfig(uid)
+		assert.Nil(t, err)
+		return pool.Add(client.NewUser(conf), &client.ClientConfig{
+			ClientID:          clientID,
+			Topic:             "devices/" + uid + "/in",
+			Keepalive:         30,
+			ConnectRetryDelay: 50,
+			WriteToDisk:       true,
+			OutputFileName:    filepath.Join(t.TempDir(), uid+".txt"),
+		})
+	}
+
+	c1, err := add("sub1", "gw-sub1")
+	assert.Nil(t, err)
+	_, err = add("sub2", "gw-sub2")
+	assert.Nil(t, err)
+
+	_, err = add("sub1", "gw-other")
+	assert.EqualError(t, err, `identity "sub1" already in the pool`)
+	_, err = add("sub3", "gw-sub1")
+	assert.EqualError(t, err, `identity "sub3": client id "gw-sub1" already used by identity "sub1"`)
+
+	events := c1.Events()
+	assert.Nil(t, pool.Connect())
+	waitFor(t, events, client.EventUp)
+	assert.Eventually(t, func() bool {
+		clients := broker.Clients()
+		sort.Strings(clients)
+		return assert.ObjectsAreEqual([]string{"gw-sub1", "gw-sub2"}, clients)
+	}, e2eTimeout, e2eTick)
+
+	// Identities added once the pool is connected connect at once
+	c3, err := add("sub3", "gw-sub3")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return c3.Status().Connected() }, e2eTimeout, e2eTick)
+	ok, failed := broker.Handshakes()
+	assert.Equal(t, 3, ok)
+	assert.Equal(t, 0, failed)
+
+	// Each identity publishes over its own connection
+	assert.Nil(t, pool.Client("sub2").Publish("devices/sub2/out", "hello"))
+	select {
+	case m := <-broker.Received():
+		assert.Equal(t, "gw-sub2", m.ClientID)
+	case <-time.After(e2eTimeout):
+		t.Fatal("publish not received by the broker")
+	}
+
+	assert.Nil(t, pool.Remove("sub1"))
+	assert.Nil(t, pool.Client("sub1"))
+	assert.Len(t, pool.Clients(), 2)
+	assert.Equal(t, []string{"sub2", "sub3"}, pool.Uids())
+	assert.Eventually(t, func() bool { return len(broker.Clients()) == 2 }, e2eTimeout, e2eTick)
+
+	assert.Nil(t, pool.Disconnect())
+	assert.Eventually(t, func() bool { return len(broker.Clients()) == 0 }, e2eTimeout, e2eTick)
+}
@@ -0,0 +1,120 @@
+package provision_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/provision"
+	"github.com/opensvn/auth-client/provision/provisiontest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newProvisioner(srv *provisiontest.Server) *provision.Provisioner {
+	p := provision.New(srv.URL, srv.URL)
+	p.Retry = client.RetryPolicy{Attempts: 3, Delay: time.Millisecond}
+	p.Poll = provision.Backoff{Initial: time.Millisecond, Multiplier: 1}
+	p.PollTimeout = 5 * time.Second
+	return p
+}
+
+func TestProvisionEndToEnd(t *testing.T) {
+	t.Run("issued", func(t *testing.T) {
+		srv := provisiontest.NewServer()
+		defer srv.Close()
+		srv.SetIssueDelay(20 * time.Millisecond)
+
+		user := client.NewUser(srv.UserConfig("device1"))
+		keys, err := newProvisioner(srv).Provision(context.Background(), user, provision.Request{Uid: "device1"})
+		assert.Nil(t, err)
+		assert.NotNil(t, keys)
+		assert.True(t, srv.Registered("device1"))
+		assert.Greater(t, srv.Queries("device1"), 1)
+		assert.Nil(t, user.Validate())
+	})
+
+	t.Run("pkg identity and suffix", func(t *testing.T) {
+		srv := provisiontest.NewServer()
+		defer srv.Close()
+		srv.PKGUid = []byte("kgc")
+		srv.PKGHid = client.HidEncrypt
+
+		conf := srv.UserConfig("device1")
+		conf.IdentitySuffix = "|2026"
+		user := client.NewUser(conf)
+		p := newProvisioner(srv)
+		_, err := p.Provision(context.Background(), user, provision.Request{Uid: "device1|2026"})
+		var platformErr *provision.PlatformError
+		assert.True(t, errors.As(err, &platformErr), "session key encrypted to the default pkg identity: %v", err)
+
+		p.PKG = client.Identity{Uid: "kgc", SignHid: client.HidSign, EncryptHid: client.HidEncrypt}
+		_, err = p.Provision(context.Background(), user, provision.Request{Uid: "device1|2026"})
+		assert.Nil(t, err)
+		assert.True(t, srv.Registered("device1|2026"))
+		assert.Nil(t, user.Validate())
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		srv := provisiontest.NewServer()
+		defer srv.Close()
+		srv.SetTamper(true)
+
+		user := client.NewUser(srv.UserConfig("device1"))
+		keys, err := newProvisioner(srv).Provision(context.Background(), user, provision.Request{Uid: "device1"})
+		assert.Nil(t, keys)
+		assert.True(t, errors.Is(err, provision.ErrIntegrity), err)
+		assert.Nil(t, user.GetSignPrivateKey())
+	})
+
+	t.Run("transient failures", func(t *testing.T) {
+		srv := provisiontest.NewServer()
+		defer srv.Close()
+		srv.FailStatus(provisiontest.RegisterPath, 2, http.StatusServiceUnavailable)
+		srv.FailStatus(provisiontest.KeysPath, 3, http.StatusBadGateway)
+
+		user := client.NewUser(srv.UserConfig("device1"))
+		_, err := newProvisioner(srv).Provision(context.Background(), user, provision.Request{Uid: "device1"})
+		assert.Nil(t, err)
+		assert.Nil(t, user.Validate())
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		srv := provisiontest.NewServer()
+		defer srv.Close()
+		srv.FailCode(provisiontest.RegisterPath, 1, 40301, "device not allowed")
+
+		user := client.NewUser(srv.UserConfig("device1"))
+		_, err := newProvisioner(srv).Provision(context.Background(), user, provision.Request{Uid: "device1"})
+		var platformErr *provision.PlatformError
+		assert.True(t, errors.As(err, &platformErr), err)
+		assert.False(t, srv.Registered("device1"))
+	})
+
+	t.Run("signed queries", func(t *testing.T) {
+		srv := provisiontest.NewServer()
+		defer srv.Close()
+		srv.SetRequireSignature(true)
+
+		conf, err := srv.IssuedUserConfig("device1")
+		assert.Nil(t, err)
+		user := client.NewUser(conf)
+		_, err = newProvisioner(srv).Provision(context.Background(), user, provision.Request{Uid: "device1"})
+		assert.Nil(t, err)
+		assert.Greater(t, srv.SignedRequests(), 0)
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		srv := provisiontest.NewServer()
+		defer srv.Close()
+		srv.SetLatency(time.Second)
+
+		p := newProvisioner(srv)
+		p.HTTPClient = &http.Client{Timeout: 20 * time.Millisecond}
+		p.Retry.Attempts = 1
+		_, err := p.Provision(context.Background(), client.NewUser(srv.UserConfig("device1")), provision.Request{Uid: "device1"})
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,94 @@
+package provision
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/emmansun/gmsm/sm4"
+)
+
+// EnvelopeVersionSM4GCM identifies envelopes encrypted with SM4 in GCM mode under the registration session key
+const EnvelopeVersionSM4GCM = 1
+
+var (
+	// ErrUnsupportedVersion is returned for envelopes using an algorithm this package does not implement
+	ErrUnsupportedVersion = errors.New("unsupported envelope version")
+	// ErrIntegrity is returned when an envelope fails authentication, i.e. it was corrupted or tampered with
+	ErrIntegrity = errors.New("envelope integrity check failed")
+)
+
+// Envelope carries one issued private key encrypted under the session key sent at registration
+type Envelope struct {
+	Version    int    `json:"version"`    // algorithm used, see EnvelopeVersionSM4GCM
+	IV         string `json:"iv"`         // hex encoded nonce, unique to the envelope
+	Ciphertext string `json:"ciphertext"` // hex encoded ciphertext followed by the authentication tag
+}
+
+// Key types bound into each envelope so that the sign and encrypt keys cannot be swapped
+const (
+	KeyTypeSign    = "sign"
+	KeyTypeEncrypt = "encrypt"
+)
+
+// AdditionalData returns the data authenticated alongside a key: the identity it was issued to and its type. Platforms
+// pass it to Seal when issuing keys.
+func AdditionalData(uid, keyType string) []byte {
+	return []byte(uid + "|" + keyType)
+}
+
+// Seal encrypts plaintext into a new envelope. Devices only open envelopes; Seal is for platforms and tests.
+func Seal(key, plaintext, aad []byte) (*Envelope, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		Version:    EnvelopeVersionSM4GCM,
+		IV:         hex.EncodeToString(nonce),
+		Ciphertext: hex.EncodeToString(aead.Seal(nil, nonce, plaintext, aad)),
+	}, nil
+}
+
+// Open authenticates and decrypts the envelope
+func (e *Envelope) Open(key, aad []byte) ([]byte, error) {
+	if e.Version != EnvelopeVersionSM4GCM {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, e.Version)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := hex.DecodeString(e.IV)
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("%w: invalid iv", ErrIntegrity)
+	}
+	ciphertext, err := hex.DecodeString(e.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: ciphertext is not hex encoded", ErrIntegrity)
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, ErrIntegrity
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := sm4.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
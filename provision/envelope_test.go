@@ -0,0 +1,51 @@
+package provision
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelope(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	aad := AdditionalData("device1", KeyTypeSign)
+
+	e, err := Seal(key, []byte("private key"), aad)
+	assert.Nil(t, err)
+	assert.Equal(t, EnvelopeVersionSM4GCM, e.Version)
+
+	plaintext, err := e.Open(key, aad)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("private key"), plaintext)
+
+	t.Run("wrong key", func(t *testing.T) {
+		_, err := e.Open([]byte("fedcba9876543210"), aad)
+		assert.True(t, errors.Is(err, ErrIntegrity))
+	})
+
+	t.Run("swapped key type", func(t *testing.T) {
+		_, err := e.Open(key, AdditionalData("device1", KeyTypeEncrypt))
+		assert.True(t, errors.Is(err, ErrIntegrity))
+	})
+
+	t.Run("tampered ciphertext", func(t *testing.T) {
+		tampered := *e
+		last := tampered.Ciphertext[len(tampered.Ciphertext)-1]
+		if last == '0' {
+			last = '1'
+		} else {
+			last = '0'
+		}
+		tampered.Ciphertext = tampered.Ciphertext[:len(tampered.Ciphertext)-1] + string(last)
+		_, err := tampered.Open(key, aad)
+		assert.True(t, errors.Is(err, ErrIntegrity))
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		future := *e
+		future.Version = 2
+		_, err := future.Open(key, aad)
+		assert.True(t, errors.Is(err, ErrUnsupportedVersion))
+	})
+}
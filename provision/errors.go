@@ -0,0 +1,68 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// maxErrorBody limits how much of an error response is kept in an HTTPError
+const maxErrorBody = 512
+
+// HTTPError is returned when the RA or platform responds with a status outside 2xx
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Body       string // start of the response body, often the server's explanation
+}
+
+func (e *HTTPError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("%s: %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%s: %d %s: %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// Temporary reports whether the status indicates a condition that may clear by itself (timeouts, rate limiting and
+// server errors)
+func (e *HTTPError) Temporary() bool {
+	return e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// PlatformError is returned when the RA or platform reports a non-zero code in its response
+type PlatformError struct {
+	URL  string
+	Code int
+	Msg  string
+}
+
+func (e *PlatformError) Error() string {
+	return fmt.Sprintf("%s: code %d: %s", e.URL, e.Code, e.Msg)
+}
+
+// Retryable reports whether the operation that returned err may succeed if repeated. Rejections by the RA or platform,
+// key envelopes that fail to open, tokens refused over plain http and cancellation are permanent; network failures and
+// temporary statuses are not.
+func Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Temporary()
+	}
+
+	var platformErr *PlatformError
+	switch {
+	case errors.As(err, &platformErr),
+		errors.Is(err, ErrIntegrity),
+		errors.Is(err, ErrUnsupportedVersion),
+		errors.Is(err, ErrInsecureToken),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	return true
+}
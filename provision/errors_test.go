@@ -0,0 +1,92 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryable(t *testing.T) {
+	assert.False(t, Retryable(nil))
+	assert.True(t, Retryable(errors.New("connection refused")))
+	assert.True(t, Retryable(&HTTPError{StatusCode: http.StatusBadGateway}))
+	assert.True(t, Retryable(&HTTPError{StatusCode: http.StatusTooManyRequests}))
+	assert.False(t, Retryable(&HTTPError{StatusCode: http.StatusForbidden}))
+	assert.False(t, Retryable(fmt.Errorf("query key: %w", &PlatformError{Code: 1})))
+	assert.False(t, Retryable(fmt.Errorf("open sign key: %w", ErrIntegrity)))
+	assert.False(t, Retryable(context.Canceled))
+}
+
+func TestProvisionFailures(t *testing.T) {
+	masters := newTestMasters(t)
+
+	t.Run("registration rejected", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "device not allowed", http.StatusForbidden)
+		}))
+		defer srv.Close()
+
+		p := New(srv.URL, srv.URL)
+		p.Retry.Attempts = 3
+		_, err := p.Provision(context.Background(), masters.user(t, "device1", false), Request{Uid: "device1"})
+
+		var httpErr *HTTPError
+		assert.True(t, errors.As(err, &httpErr))
+		assert.Equal(t, http.StatusForbidden, httpErr.StatusCode)
+		assert.Equal(t, "device not allowed", httpErr.Body)
+	})
+
+	t.Run("registration reports an error code", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"code":1001,"msg":"unknown device type"}`))
+		}))
+		defer srv.Close()
+
+		_, err := New(srv.URL, srv.URL).Provision(context.Background(), masters.user(t, "device1", false), Request{Uid: "device1"})
+		assert.EqualError(t, err, "apply key: "+srv.URL+"/register: code 1001: unknown device type")
+	})
+
+	t.Run("platform reports an error code", func(t *testing.T) {
+		queries := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/register" {
+				return
+			}
+			queries++
+			_, _ = w.Write([]byte(`{"code":2,"msg":"device not registered"}`))
+		}))
+		defer srv.Close()
+
+		p := New(srv.URL, srv.URL)
+		p.Poll = Backoff{Initial: time.Millisecond}
+		_, err := p.Provision(context.Background(), masters.user(t, "device1", false), Request{Uid: "device1"})
+
+		var platformErr *PlatformError
+		assert.True(t, errors.As(err, &platformErr))
+		assert.Equal(t, "device not registered", platformErr.Msg)
+		assert.Equal(t, 1, queries)
+	})
+
+	t.Run("platform temporarily unavailable", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/register" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer srv.Close()
+
+		p := New(srv.URL, srv.URL)
+		p.Poll = Backoff{Initial: time.Millisecond, Multiplier: 1}
+		p.PollTimeout = 50 * time.Millisecond
+		_, err := p.Provision(context.Background(), masters.user(t, "device1", false), Request{Uid: "device1"})
+
+		assert.True(t, errors.Is(err, ErrKeysNotIssued))
+		assert.Contains(t, err.Error(), "503 Service Unavailable")
+	})
+}
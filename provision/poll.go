@@ -0,0 +1,122 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollInitial    = 3 * time.Second
+	defaultPollMax        = time.Minute
+	defaultPollMultiplier = 2
+)
+
+// ErrKeysNotIssued is returned (wrapped) when the platform has not issued the keys before the deadline
+var ErrKeysNotIssued = errors.New("keys not issued")
+
+// Backoff describes the waits between queries for the issued keys. Each wait is the previous one multiplied by
+// Multiplier, capped at Max, with up to Jitter of it randomised so that a fleet of devices does not poll in step.
+type Backoff struct {
+	Initial    time.Duration // first wait (defaults to 3 seconds)
+	Max        time.Duration // longest wait (defaults to 1 minute)
+	Multiplier float64       // growth of the wait after each query (defaults to 2; 1 polls at a fixed interval)
+	Jitter     float64       // fraction of each wait, between 0 and 1, that is randomised
+}
+
+// jitterRand is seeded explicitly as the global source is not seeded automatically for this module's go version
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// withDefaults returns a copy of the backoff with unset fields filled in
+func (b Backoff) withDefaults() Backoff {
+	if b.Initial <= 0 {
+		b.Initial = defaultPollInitial
+	}
+	if b.Max <= 0 {
+		b.Max = defaultPollMax
+	}
+	if b.Max < b.Initial {
+		b.Max = b.Initial
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = defaultPollMultiplier
+	}
+	if b.Jitter < 0 {
+		b.Jitter = 0
+	}
+	if b.Jitter > 1 {
+		b.Jitter = 1
+	}
+	return b
+}
+
+// next returns the wait following cur (cur is zero before the first wait)
+func (b Backoff) next(cur time.Duration) time.Duration {
+	if cur <= 0 {
+		return b.Initial
+	}
+	next := time.Duration(float64(cur) * b.Multiplier)
+	if next > b.Max || next <= 0 { // <= 0 guards against overflow
+		next = b.Max
+	}
+	return next
+}
+
+// jittered randomly shortens d by up to the jitter fraction
+func (b Backoff) jittered(d time.Duration) time.Duration {
+	if b.Jitter == 0 {
+		return d
+	}
+	jitterMu.Lock()
+	f := jitterRand.Float64()
+	jitterMu.Unlock()
+	return d - time.Duration(f*b.Jitter*float64(d))
+}
+
+// poll calls query, waiting between calls as described by b, until it reports done. If timeout is positive and
+// elapses first an error wrapping ErrKeysNotIssued is returned. Cancellation of ctx is reported with its error.
+func poll(ctx context.Context, b Backoff, timeout time.Duration, query func(ctx context.Context) (done bool, err error)) error {
+	b = b.withDefaults()
+
+	pollCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		pollCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var (
+		wait    time.Duration
+		lastErr error
+	)
+	for queries := 0; ; queries++ {
+		wait = b.next(wait)
+		t := time.NewTimer(b.jittered(wait))
+		select {
+		case <-t.C:
+		case <-pollCtx.Done():
+			t.Stop()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if lastErr != nil {
+				return fmt.Errorf("%w after %d queries in %s (last error: %v)", ErrKeysNotIssued, queries, timeout, lastErr)
+			}
+			return fmt.Errorf("%w after %d queries in %s", ErrKeysNotIssued, queries, timeout)
+		}
+
+		done, err := query(pollCtx)
+		if done {
+			return err
+		}
+		if err != nil && pollCtx.Err() == nil { // errors caused by the deadline or cancellation are not interesting
+			lastErr = err
+		}
+	}
+}
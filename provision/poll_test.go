@@ -0,0 +1,59 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 5 * time.Second}.withDefaults()
+
+	var waits []time.Duration
+	var wait time.Duration
+	for i := 0; i < 5; i++ {
+		wait = b.next(wait)
+		waits = append(waits, wait)
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, waits)
+
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := b.jittered(4 * time.Second)
+		assert.True(t, d > 2*time.Second && d <= 4*time.Second, d)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	fast := Backoff{Initial: time.Millisecond, Multiplier: 1}
+
+	t.Run("done", func(t *testing.T) {
+		queries := 0
+		err := poll(context.Background(), fast, 0, func(context.Context) (bool, error) {
+			queries++
+			return queries == 3, nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 3, queries)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		err := poll(context.Background(), fast, 20*time.Millisecond, func(context.Context) (bool, error) {
+			return false, errors.New("connection refused")
+		})
+		assert.True(t, errors.Is(err, ErrKeysNotIssued))
+		assert.Contains(t, err.Error(), "connection refused")
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		err := poll(ctx, fast, time.Minute, func(context.Context) (bool, error) {
+			cancel()
+			return false, nil
+		})
+		assert.Equal(t, context.Canceled, err)
+	})
+}
@@ -0,0 +1,336 @@
+// Package provision obtains SM9 private keys for a device. The device registers with the registration authority (RA),
+// sending a session key encrypted to the key generation centre, then polls the platform until the keys it issues are
+// available. Each key is delivered in an Envelope, authenticated and encrypted under the session key.
+package provision
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/emmansun/gmsm/sm9"
+	"github.com/opensvn/auth-client"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+	sessionKeyLen  = 16
+)
+
+type RegisterRequest struct {
+	Id         string `json:"id"`
+	Username   string `json:"username"`
+	Eid        string `json:"eid"`
+	Random     []byte `json:"random"`
+	DeviceType string `json:"device_type"`
+}
+
+// Keys holds hex encoded, ASN.1 private keys ready for client.UserConfig, along with their version and lifetime
+type Keys struct {
+	SignKey    string
+	EncryptKey string
+	Version    int
+	IssuedAt   time.Time
+	ExpiresAt  time.Time // zero if the keys do not expire
+}
+
+// IssuedKeys are the keys as returned by the platform; both are nil until they have been issued
+type IssuedKeys struct {
+	SignKey    *Envelope `json:"signkey"`
+	EncryptKey *Envelope `json:"encryptkey"`
+	Version    int       `json:"version,omitempty"`
+	IssuedAt   time.Time `json:"issued_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type KeyResponse struct {
+	Msg  string     `json:"msg"`
+	Code int        `json:"code"`
+	Data IssuedKeys `json:"data"`
+}
+
+// Request identifies the device keys are requested for
+type Request struct {
+	Uid        string // identity the keys are issued for
+	Username   string // device name shown by the platform
+	DeviceType string
+}
+
+// Provisioner obtains private keys from the RA and platform
+type Provisioner struct {
+	RaAddr       string             // registration authority: an http:// or https:// URL, or host:port for plain http
+	PlatformAddr string             // key issuing platform, in the same form as RaAddr
+	HTTPClient   *http.Client       // defaults to a client with a 5 second timeout; see NewHTTPClient for https
+	BearerToken  string             // if set, sent to the RA and platform in the Authorization header; requires https
+	Retry        client.RetryPolicy // retries of the registration request
+	Poll         Backoff            // waits between queries for the issued keys
+	PollTimeout  time.Duration      // how long to wait for the keys to be issued (no limit if zero)
+	Logger       client.Logger      // defaults to discarding all records
+	PKG          client.Identity    // key generation centre the session key is encrypted to; defaults to client.DefaultPKGUid, hid 1
+}
+
+// New creates a Provisioner using the default settings
+func New(raAddr, platformAddr string) *Provisioner {
+	return &Provisioner{RaAddr: raAddr, PlatformAddr: platformAddr}
+}
+
+func (p *Provisioner) httpClient() *http.Client {
+	if p.HTTPClient == nil {
+		return &http.Client{Timeout: defaultTimeout}
+	}
+	return p.HTTPClient
+}
+
+// pkg returns the identity of the key generation centre
+func (p *Provisioner) pkg() client.Identity {
+	if p.PKG.Uid == "" {
+		return client.Identity{Uid: client.DefaultPKGUid, SignHid: client.HidSign}
+	}
+	return p.PKG
+}
+
+func (p *Provisioner) logger() client.Logger {
+	if p.Logger == nil {
+		return client.NopLogger()
+	}
+	return p.Logger
+}
+
+// Provision registers the device and waits for the platform to issue its keys. The keys are validated against the
+// master public keys held by user, then set on user and also returned, hex encoded, so they can be persisted.
+func (p *Provisioner) Provision(ctx context.Context, user *client.User, req Request) (*Keys, error) {
+	var (
+		random []byte
+		err    error
+	)
+	delay := p.Retry.Delay
+	for attempt := 1; ; attempt++ {
+		random, err = p.ApplyKey(ctx, user, req)
+		if err == nil {
+			break
+		}
+		if attempt >= p.Retry.Attempts || !Retryable(err) {
+			return nil, fmt.Errorf("apply key: %w", err)
+		}
+		p.logger().Warn("apply key error, retrying", "attempt", attempt, "err", err)
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+		delay *= 2
+	}
+
+	keys, err := p.waitForKeys(ctx, user, req.Uid, random)
+	if err != nil {
+		return nil, err
+	}
+
+	// The keys are checked on a copy so that user is left untouched if they turn out to be unusable
+	candidate := *user
+	candidate.KeyVersion = keys.Version
+	candidate.IssuedAt = keys.IssuedAt
+	candidate.ExpiresAt = keys.ExpiresAt
+	if err := candidate.SetEncryptPrivateKey(keys.EncryptKey); err != nil {
+		return nil, fmt.Errorf("parse issued encrypt key: %w", err)
+	}
+	if err := candidate.SetSignPrivateKey(keys.SignKey); err != nil {
+		return nil, fmt.Errorf("parse issued sign key: %w", err)
+	}
+	if err := candidate.Validate(); err != nil {
+		return nil, fmt.Errorf("issued keys are invalid: %w", err)
+	}
+	*user = candidate
+	p.logger().Info("keys provisioned", "uid", req.Uid, "version", keys.Version, "expires_at", keys.ExpiresAt)
+	return keys, nil
+}
+
+// waitForKeys polls the platform until the keys are issued, returning them decrypted and hex encoded
+func (p *Provisioner) waitForKeys(ctx context.Context, user *client.User, uid string, random []byte) (*Keys, error) {
+	var issued *Keys
+	err := poll(ctx, p.Poll, p.PollTimeout, func(ctx context.Context) (bool, error) {
+		keys, err := p.QueryKey(ctx, uid, user)
+		if err != nil {
+			if ctx.Err() == nil && !Retryable(err) {
+				return true, fmt.Errorf("query key: %w", err)
+			}
+			p.logger().Warn("query key error", "err", err)
+			return false, err
+		}
+
+		if keys.EncryptKey == nil || keys.SignKey == nil {
+			p.logger().Debug("keys not issued yet", "uid", uid)
+			return false, nil
+		}
+
+		// A key that fails to open has been corrupted or tampered with, so provisioning stops rather than retrying
+		encryptKey, err := keys.EncryptKey.Open(random, AdditionalData(uid, KeyTypeEncrypt))
+		if err != nil {
+			return true, fmt.Errorf("open encrypt key: %w", err)
+		}
+
+		signKey, err := keys.SignKey.Open(random, AdditionalData(uid, KeyTypeSign))
+		if err != nil {
+			return true, fmt.Errorf("open sign key: %w", err)
+		}
+
+		issued = &Keys{
+			EncryptKey: hex.EncodeToString(encryptKey),
+			SignKey:    hex.EncodeToString(signKey),
+			Version:    keys.Version,
+			IssuedAt:   keys.IssuedAt,
+			ExpiresAt:  keys.ExpiresAt,
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return issued, nil
+}
+
+// ApplyKey registers the device with the RA. It returns the session key the issued keys will be encrypted with.
+func (p *Provisioner) ApplyKey(ctx context.Context, user *client.User, req Request) ([]byte, error) {
+	if user == nil || user.GetEncryptMasterPublicKey() == nil {
+		return nil, errors.New("encrypt master public key required to apply for keys")
+	}
+
+	random, err := getRandom(sessionKeyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg := p.pkg()
+	if err := pkg.Validate(); err != nil {
+		return nil, fmt.Errorf("pkg identity: %w", err)
+	}
+	random1, err := sm9.EncryptASN1(rand.Reader, user.GetEncryptMasterPublicKey(), pkg.ID(), pkg.EncryptionHid(), random)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := json.Marshal(RegisterRequest{
+		Id:         req.Uid,
+		Username:   req.Username,
+		Eid:        req.Uid,
+		Random:     random1,
+		DeviceType: req.DeviceType,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u := endpoint(p.RaAddr, "/register")
+	p.logger().Info("registering with RA", "url", u, "uid", req.Uid)
+	if _, err = p.post(ctx, u, buf, user); err != nil {
+		return nil, err
+	}
+
+	return random, nil
+}
+
+// QueryKey fetches the (still encrypted) keys issued for uid; they are nil until the platform has issued them. The
+// request is signed if signer holds a sign private key.
+func (p *Provisioner) QueryKey(ctx context.Context, uid string, signer *client.User) (*IssuedKeys, error) {
+	u := endpoint(p.PlatformAddr, "/identificationinfo/identificationinfo/keys?id="+url.QueryEscape(uid))
+	p.logger().Debug("querying keys", "url", u)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.authenticate(req, nil, signer); err != nil {
+		return nil, err
+	}
+
+	body, err := p.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp KeyResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid response: %w", u, err)
+	}
+	if resp.Code != 0 {
+		return nil, &PlatformError{URL: u, Code: resp.Code, Msg: resp.Msg}
+	}
+
+	return &resp.Data, nil
+}
+
+func (p *Provisioner) post(ctx context.Context, url string, body []byte, signer *client.User) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := p.authenticate(req, body, signer); err != nil {
+		return nil, err
+	}
+
+	respBody, err := p.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The RA reports failures as {"code": n, "msg": "..."}; other bodies are accepted as they are
+	var status struct {
+		Code *int   `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	if json.Unmarshal(respBody, &status) == nil && status.Code != nil && *status.Code != 0 {
+		return nil, &PlatformError{URL: url, Code: *status.Code, Msg: status.Msg}
+	}
+
+	return respBody, nil
+}
+
+// do sends the request, returning the body of a 2xx response or an HTTPError
+func (p *Provisioner) do(req *http.Request) ([]byte, error) {
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(body) > maxErrorBody {
+			body = body[:maxErrorBody]
+		}
+		return nil, &HTTPError{URL: req.URL.String(), StatusCode: resp.StatusCode, Body: string(bytes.TrimSpace(body))}
+	}
+	return body, nil
+}
+
+func getRandom(len int) ([]byte, error) {
+	buf := make([]byte, len)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// sleep waits for d, returning early with the context's error if it is cancelled
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,74 @@
+package provision
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/sm9test"
+	"github.com/stretchr/testify/assert"
+)
+
+// testMasters holds master key pairs playing the part of the key generation centre
+type testMasters struct {
+	*sm9test.Masters
+}
+
+func newTestMasters(t *testing.T) *testMasters {
+	m, err := sm9test.NewMasters()
+	assert.Nil(t, err)
+	return &testMasters{m}
+}
+
+// user returns a user holding the master public keys and, if withKeys is set, private keys issued for uid
+func (m *testMasters) user(t *testing.T, uid string, withKeys bool) *client.User {
+	keys := m.Public()
+	if withKeys {
+		var err error
+		keys, err = m.Keys(uid, 1)
+		assert.Nil(t, err)
+	}
+
+	user := client.NewUser(&client.UserConfig{
+		Uid:                    uid,
+		Hid:                    1,
+		EncryptPrivateKey:      keys.EncryptPrivateKey,
+		SignPrivateKey:         keys.SignPrivateKey,
+		EncryptMasterPublicKey: keys.EncryptMasterPublicKey,
+		SignMasterPublicKey:    keys.SignMasterPublicKey,
+	})
+	assert.NotNil(t, user)
+	return user
+}
+
+func TestProvisionCancelled(t *testing.T) {
+	var queries int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/identificationinfo") {
+			atomic.AddInt32(&queries, 1)
+			_, _ = w.Write([]byte(`{"code":0,"msg":"","data":{}}`))
+		}
+	}))
+	defer srv.Close()
+
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	p := New(addr, addr)
+	p.Poll = Backoff{Initial: time.Millisecond, Multiplier: 1}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	keys, err := p.Provision(ctx, newTestMasters(t).user(t, "device1", false), Request{Uid: "device1"})
+	assert.Nil(t, keys)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Greater(t, atomic.LoadInt32(&queries), int32(0))
+}
+
+func TestApplyKeyWithoutMasterKey(t *testing.T) {
+	_, err := New("ra", "platform").ApplyKey(context.Background(), nil, Request{Uid: "device1"})
+	assert.NotNil(t, err)
+}
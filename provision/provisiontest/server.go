@@ -0,0 +1,359 @@
+// Package provisiontest provides an in-process registration authority and key issuing platform so that provisioning
+// can be tested end to end without a live RA.
+package provisiontest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/emmansun/gmsm/sm9"
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/provision"
+	"github.com/opensvn/auth-client/sm9test"
+)
+
+// Paths served, matching those used by provision.Provisioner
+const (
+	RegisterPath = "/register"
+	KeysPath     = "/identificationinfo/identificationinfo/keys"
+)
+
+// failure is a fault injected into the next requests to a path
+type failure struct {
+	remaining int
+	status    int    // http status to respond with, if non-zero
+	code      int    // platform error code to respond with otherwise
+	msg       string // message accompanying the code or status
+}
+
+// device is the state kept for a registered device
+type device struct {
+	sessionKey []byte
+	registered time.Time
+	queries    int
+	version    int       // of the keys last issued
+	issuedAt   time.Time // zero until the keys for this registration have been issued
+}
+
+// Server is a fake RA and platform. It holds SM9 master key pairs, decrypts the session key sent to /register with
+// the PKG identity's key and, once IssueDelay has passed, issues keys for the device sealed under that session key.
+type Server struct {
+	*httptest.Server
+
+	EncryptMaster *sm9.EncryptMasterPrivateKey
+	SignMaster    *sm9.SignMasterPrivateKey
+
+	PKGUid []byte // identity the session key is encrypted to (defaults to "pkg")
+	PKGHid byte   // hid of the PKG identity (defaults to 1)
+	Hid    byte   // hid user keys are issued with (defaults to 1)
+
+	masters            *sm9test.Masters
+	mu                 sync.Mutex
+	issueDelay         time.Duration
+	keyLifetime        time.Duration
+	latency            time.Duration
+	tamper             bool
+	requireSignature   bool
+	failures           map[string]*failure
+	devices            map[string]*device
+	signedRequestCount int
+}
+
+// NewServer starts a server with freshly generated master keys. It panics on failure, like httptest.NewServer.
+func NewServer() *Server {
+	masters, err := sm9test.NewMasters()
+	if err != nil {
+		panic(fmt.Sprintf("provisiontest: %v", err))
+	}
+
+	s := &Server{
+		EncryptMaster: masters.Encrypt,
+		SignMaster:    masters.Sign,
+		PKGUid:        []byte("pkg"),
+		PKGHid:        1,
+		Hid:           1,
+		masters:       masters,
+		failures:      map[string]*failure{},
+		devices:       map[string]*device{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(RegisterPath, s.register)
+	mux.HandleFunc(KeysPath, s.keys)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// UserConfig returns a configuration for uid holding the master public keys but no private keys, i.e. the state of
+// a device before provisioning
+func (s *Server) UserConfig(uid string) *client.UserConfig {
+	return &client.UserConfig{
+		Uid:                    uid,
+		Hid:                    s.Hid,
+		EncryptMasterPublicKey: s.masters.EncryptMasterPublicKey,
+		SignMasterPublicKey:    s.masters.SignMasterPublicKey,
+	}
+}
+
+// IssuedUserConfig returns a configuration for uid including private keys, i.e. the state of a provisioned device
+func (s *Server) IssuedUserConfig(uid string) (*client.UserConfig, error) {
+	keys, err := s.masters.Keys(uid, s.Hid)
+	if err != nil {
+		return nil, err
+	}
+	conf := s.UserConfig(uid)
+	conf.EncryptPrivateKey = keys.EncryptPrivateKey
+	conf.SignPrivateKey = keys.SignPrivateKey
+	return conf, nil
+}
+
+// SetIssueDelay sets how long after registration the keys become available
+func (s *Server) SetIssueDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.issueDelay = d
+}
+
+// SetKeyLifetime makes issued keys expire d after they are issued (they do not expire if d is zero)
+func (s *Server) SetKeyLifetime(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keyLifetime = d
+}
+
+// KeyVersion returns the version of the keys last issued to uid (zero if none have been)
+func (s *Server) KeyVersion(uid string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d := s.devices[uid]; d != nil {
+		return d.version
+	}
+	return 0
+}
+
+// SetLatency delays every response by d
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// SetTamper makes the server corrupt the keys it issues, which devices must reject
+func (s *Server) SetTamper(tamper bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tamper = tamper
+}
+
+// SetRequireSignature makes the server reject key queries that are not signed by the device's SM9 sign key
+func (s *Server) SetRequireSignature(require bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requireSignature = require
+}
+
+// FailStatus makes the next n requests to path fail with the http status
+func (s *Server) FailStatus(path string, n, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = &failure{remaining: n, status: status, msg: http.StatusText(status)}
+}
+
+// FailCode makes the next n responses from path report the platform error code and message
+func (s *Server) FailCode(path string, n, code int, msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = &failure{remaining: n, code: code, msg: msg}
+}
+
+// Registered reports whether uid has registered
+func (s *Server) Registered(uid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.devices[uid] != nil
+}
+
+// Queries returns the number of key queries made for uid
+func (s *Server) Queries(uid string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d := s.devices[uid]; d != nil {
+		return d.queries
+	}
+	return 0
+}
+
+// SignedRequests returns the number of requests carrying a valid SM9 signature
+func (s *Server) SignedRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.signedRequestCount
+}
+
+// intercept applies latency and any injected failure, returning true if the response has been written
+func (s *Server) intercept(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.Lock()
+	latency := s.latency
+	f := s.failures[r.URL.Path]
+	var injected failure
+	if f != nil && f.remaining > 0 {
+		f.remaining--
+		injected = *f
+	}
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return true
+		}
+	}
+
+	switch {
+	case injected.status != 0:
+		http.Error(w, injected.msg, injected.status)
+		return true
+	case injected.code != 0:
+		writeJSON(w, provision.KeyResponse{Code: injected.code, Msg: injected.msg})
+		return true
+	}
+	return false
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	if s.intercept(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req provision.RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pkgKey, err := s.EncryptMaster.GenerateUserKey(s.PKGUid, s.PKGHid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sessionKey, err := sm9.DecryptASN1(pkgKey, s.PKGUid, req.Random)
+	if err != nil {
+		writeJSON(w, provision.KeyResponse{Code: 1, Msg: "cannot decrypt random: " + err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	d := &device{sessionKey: sessionKey, registered: time.Now()}
+	if previous := s.devices[req.Id]; previous != nil {
+		d.version = previous.version // renewing
+	}
+	s.devices[req.Id] = d
+	s.mu.Unlock()
+	writeJSON(w, provision.KeyResponse{Msg: "ok"})
+}
+
+func (s *Server) keys(w http.ResponseWriter, r *http.Request) {
+	if s.intercept(w, r) {
+		return
+	}
+
+	uid := r.URL.Query().Get("id")
+	body, _ := ioutil.ReadAll(r.Body)
+	_, verifyErr := provision.VerifyRequest(r, body, s.SignMaster.Public(), time.Minute)
+
+	s.mu.Lock()
+	if verifyErr == nil {
+		s.signedRequestCount++
+	}
+	requireSignature, tamper := s.requireSignature, s.tamper
+	d := s.devices[uid]
+	var (
+		sessionKey []byte
+		issued     bool
+		resp       = provision.KeyResponse{Msg: "ok"}
+	)
+	if d != nil {
+		d.queries++
+		sessionKey = d.sessionKey
+		issued = time.Since(d.registered) >= s.issueDelay
+		if issued {
+			if d.issuedAt.IsZero() {
+				d.version++
+				d.issuedAt = time.Now().UTC()
+			}
+			resp.Data.Version = d.version
+			resp.Data.IssuedAt = d.issuedAt
+			if s.keyLifetime > 0 {
+				resp.Data.ExpiresAt = d.issuedAt.Add(s.keyLifetime)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	switch {
+	case requireSignature && verifyErr != nil:
+		http.Error(w, verifyErr.Error(), http.StatusUnauthorized)
+		return
+	case d == nil:
+		writeJSON(w, provision.KeyResponse{Code: 2, Msg: "device not registered"})
+		return
+	case !issued:
+		writeJSON(w, provision.KeyResponse{Msg: "pending"})
+		return
+	}
+
+	encKey, signKey, err := s.masters.Issue([]byte(uid), s.Hid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	encEnvelope, err := seal(sessionKey, encKey, provision.AdditionalData(uid, provision.KeyTypeEncrypt))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	signEnvelope, err := seal(sessionKey, signKey, provision.AdditionalData(uid, provision.KeyTypeSign))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if tamper {
+		signEnvelope.Ciphertext = flipLastHexDigit(signEnvelope.Ciphertext)
+	}
+
+	resp.Data.EncryptKey, resp.Data.SignKey = encEnvelope, signEnvelope
+	writeJSON(w, resp)
+}
+
+// seal marshals the key and seals it in an envelope
+func seal(sessionKey []byte, key interface{ MarshalASN1() ([]byte, error) }, aad []byte) (*provision.Envelope, error) {
+	der, err := key.MarshalASN1()
+	if err != nil {
+		return nil, err
+	}
+	return provision.Seal(sessionKey, der, aad)
+}
+
+func flipLastHexDigit(s string) string {
+	last := s[len(s)-1]
+	if last == '0' {
+		last = '1'
+	} else {
+		last = '0'
+	}
+	return s[:len(s)-1] + string(last)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
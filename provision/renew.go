@@ -0,0 +1,88 @@
+package provision
+
+import (
+	"context"
+	"time"
+
+	"github.com/opensvn/auth-client"
+)
+
+// defaultRenewBefore is how long before expiry keys are renewed when their lifetime is unknown
+const defaultRenewBefore = time.Hour
+
+// Renewer provisions new keys for a device before its current ones expire. Requests made whilst renewing are signed
+// with the current keys.
+type Renewer struct {
+	Provisioner *Provisioner
+	Request     Request
+	Before      time.Duration // how long before expiry to renew (defaults to a fifth of the keys' lifetime)
+	Retry       Backoff       // waits between failed renewal attempts
+
+	// OnRenewed is called with a copy of the user holding the new keys, which are also given hex encoded. It should
+	// persist them and swap the user into the client, see client.Client.UpdateUser. If it returns an error the renewal
+	// is retried.
+	OnRenewed func(user *client.User, keys *Keys) error
+}
+
+// Run renews the keys of user each time they near expiry, until the context is cancelled. It returns immediately, with
+// a nil error, if the keys do not expire.
+func (r *Renewer) Run(ctx context.Context, user *client.User) error {
+	current := user
+	for !current.ExpiresAt.IsZero() {
+		at := r.renewAt(current)
+		r.logger().Info("key renewal scheduled", "uid", string(current.Uid), "version", current.KeyVersion, "at", at)
+		if err := sleep(ctx, time.Until(at)); err != nil {
+			return err
+		}
+
+		next, err := r.renew(ctx, current)
+		if err != nil {
+			return err
+		}
+		current = next
+	}
+
+	r.logger().Info("keys do not expire, renewal disabled", "uid", string(current.Uid))
+	return nil
+}
+
+// renew provisions new keys, retrying until it succeeds or the context is cancelled
+func (r *Renewer) renew(ctx context.Context, current *client.User) (*client.User, error) {
+	b := r.Retry.withDefaults()
+	var wait time.Duration
+	for {
+		next := *current
+		keys, err := r.Provisioner.Provision(ctx, &next, r.Request)
+		if err == nil && r.OnRenewed != nil {
+			err = r.OnRenewed(&next, keys)
+		}
+		if err == nil {
+			return &next, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		wait = b.next(wait)
+		r.logger().Warn("key renewal failed, retrying", "err", err, "retry_in", wait, "expired", current.Expired())
+		if err := sleep(ctx, b.jittered(wait)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// renewAt returns when the keys of user should be renewed
+func (r *Renewer) renewAt(user *client.User) time.Time {
+	before := r.Before
+	if before <= 0 {
+		before = defaultRenewBefore
+		if !user.IssuedAt.IsZero() && user.ExpiresAt.After(user.IssuedAt) {
+			before = user.ExpiresAt.Sub(user.IssuedAt) / 5
+		}
+	}
+	return user.ExpiresAt.Add(-before)
+}
+
+func (r *Renewer) logger() client.Logger {
+	return r.Provisioner.logger()
+}
@@ -0,0 +1,76 @@
+package provision_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opensvn/auth-client"
+	"github.com/opensvn/auth-client/provision"
+	"github.com/opensvn/auth-client/provision/provisiontest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenewer(t *testing.T) {
+	t.Run("renews before expiry", func(t *testing.T) {
+		srv := provisiontest.NewServer()
+		defer srv.Close()
+		srv.SetKeyLifetime(300 * time.Millisecond)
+
+		p := newProvisioner(srv)
+		user := client.NewUser(srv.UserConfig("device1"))
+		keys, err := p.Provision(context.Background(), user, provision.Request{Uid: "device1"})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, keys.Version)
+		assert.Equal(t, 1, user.KeyVersion)
+		assert.Equal(t, keys.ExpiresAt, user.ExpiresAt)
+
+		renewed := make(chan *client.User, 4)
+		var failures int32
+		r := &provision.Renewer{
+			Provisioner: p,
+			Request:     provision.Request{Uid: "device1"},
+			Before:      200 * time.Millisecond,
+			Retry:       provision.Backoff{Initial: time.Millisecond, Multiplier: 1},
+			OnRenewed: func(u *client.User, keys *provision.Keys) error {
+				// A failure to persist the keys is retried
+				if atomic.AddInt32(&failures, 1) == 1 {
+					return errors.New("disk full")
+				}
+				assert.Equal(t, u.KeyVersion, keys.Version)
+				renewed <- u
+				return nil
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- r.Run(ctx, user) }()
+
+		select {
+		case u := <-renewed:
+			assert.Nil(t, u.Validate())
+			assert.Greater(t, u.KeyVersion, user.KeyVersion)
+			assert.True(t, u.ExpiresAt.After(user.ExpiresAt))
+			assert.Greater(t, srv.SignedRequests(), 0) // renewal requests are signed with the current keys
+		case <-time.After(5 * time.Second):
+			t.Fatal("keys not renewed")
+		}
+
+		cancel()
+		assert.Equal(t, context.Canceled, <-done)
+	})
+
+	t.Run("keys without expiry", func(t *testing.T) {
+		srv := provisiontest.NewServer()
+		defer srv.Close()
+		conf, err := srv.IssuedUserConfig("device1")
+		assert.Nil(t, err)
+
+		r := &provision.Renewer{Provisioner: newProvisioner(srv), Request: provision.Request{Uid: "device1"}}
+		assert.Nil(t, r.Run(context.Background(), client.NewUser(conf)))
+		assert.False(t, srv.Registered("device1"))
+	})
+}
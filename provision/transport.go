@@ -0,0 +1,180 @@
+package provision
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emmansun/gmsm/sm3"
+	"github.com/emmansun/gmsm/sm9"
+	"github.com/opensvn/auth-client"
+)
+
+// Headers carrying the SM9 signature of requests made once the device holds a sign key, see VerifyRequest
+const (
+	HeaderUid       = "X-SM9-Uid"
+	HeaderHid       = "X-SM9-Hid"
+	HeaderTimestamp = "X-SM9-Timestamp"
+	HeaderSignature = "X-SM9-Signature"
+)
+
+// TLSOptions configures how the RA and platform are authenticated over https (and how the device authenticates to
+// them if a client certificate is given)
+type TLSOptions struct {
+	CAFile     string   // PEM bundle of CAs trusted in place of the system roots
+	Pins       []string // hex SHA-256 digests of trusted SubjectPublicKeyInfos; one must appear in the server's chain
+	CertFile   string   // PEM client certificate
+	KeyFile    string   // PEM private key of the client certificate
+	ServerName string   // overrides the name verified against the server certificate
+}
+
+// NewHTTPClient creates an http client for the RA and platform that applies opts to https connections
+func NewHTTPClient(opts TLSOptions, timeout time.Duration) (*http.Client, error) {
+	tlsCfg := &tls.Config{ServerName: opts.ServerName, MinVersion: tls.VersionTLS12}
+
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(opts.Pins) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range opts.Pins {
+			digest, err := ParsePin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins[hex.EncodeToString(digest)] = true
+		}
+		// Runs after normal chain verification, so pinning narrows rather than replaces the trusted set
+		tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[hex.EncodeToString(digest[:])] {
+					return nil
+				}
+			}
+			return errors.New("server certificate chain does not match any pinned key")
+		}
+	}
+
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// ParsePin parses a pin of TLSOptions, the hex SHA-256 digest of a SubjectPublicKeyInfo. The digest may be in either
+// case and its bytes may be separated by colons, as openssl prints fingerprints.
+func ParsePin(pin string) ([]byte, error) {
+	digest, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	if err != nil || len(digest) != sha256.Size {
+		return nil, fmt.Errorf("invalid pin %q: expected a hex SHA-256 digest", pin)
+	}
+	return digest, nil
+}
+
+// endpoint joins an address and path. Addresses without a scheme are taken to be plain http for compatibility with
+// configurations predating https support.
+func endpoint(addr, path string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/") + path
+}
+
+// ErrInsecureToken is returned instead of sending the bearer token to an RA or platform address that is not https
+var ErrInsecureToken = errors.New("bearer token must only be sent over https")
+
+// authenticate adds the bearer token, if configured, and the SM9 signature, if signer holds a sign key. The token is
+// refused over plain http, where anyone on the path could read and replay it.
+func (p *Provisioner) authenticate(req *http.Request, body []byte, signer *client.User) error {
+	if p.BearerToken != "" {
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("%s: %w", req.URL.Redacted(), ErrInsecureToken)
+		}
+		req.Header.Set("Authorization", "Bearer "+p.BearerToken)
+	}
+	if signer == nil || signer.GetSignPrivateKey() == nil {
+		return nil
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sig, err := signer.Sign(signedContent(req.Method, req.URL.RequestURI(), timestamp, body))
+	if err != nil {
+		return fmt.Errorf("sign request: %w", err)
+	}
+	req.Header.Set(HeaderUid, string(signer.Uid))
+	req.Header.Set(HeaderHid, client.FormatHid(signer.Hid))
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, hex.EncodeToString(sig))
+	return nil
+}
+
+// signedContent returns the bytes covered by a request signature: the method, request URI, timestamp and SM3 digest
+// of the body, separated by newlines
+func signedContent(method, requestURI, timestamp string, body []byte) []byte {
+	digest := sm3.Sum(body)
+	return []byte(method + "\n" + requestURI + "\n" + timestamp + "\n" + hex.EncodeToString(digest[:]))
+}
+
+// VerifyRequest checks the SM9 signature added to a request by a Provisioner, returning the signer's uid. It is meant
+// for RA and platform implementations; body is the request body, which the caller has already read.
+func VerifyRequest(req *http.Request, body []byte, pub *sm9.SignMasterPublicKey, maxSkew time.Duration) (string, error) {
+	uid := req.Header.Get(HeaderUid)
+	timestamp := req.Header.Get(HeaderTimestamp)
+	if uid == "" || timestamp == "" || req.Header.Get(HeaderSignature) == "" {
+		return "", errors.New("request is not signed")
+	}
+
+	hid, err := client.ParseHid(req.Header.Get(HeaderHid))
+	if err == nil {
+		err = client.ValidateSignHid(hid)
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid hid header: %w", err)
+	}
+	sig, err := hex.DecodeString(req.Header.Get(HeaderSignature))
+	if err != nil {
+		return "", errors.New("signature is not hex encoded")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errors.New("invalid timestamp header")
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > maxSkew || skew < -maxSkew {
+		return "", fmt.Errorf("timestamp outside the permitted skew of %s", maxSkew)
+	}
+
+	digest := sm3.Sum(signedContent(req.Method, req.URL.RequestURI(), timestamp, body))
+	if !sm9.VerifyASN1(pub, []byte(uid), hid, digest[:], sig) {
+		return "", errors.New("invalid signature")
+	}
+	return uid, nil
+}
@@ -0,0 +1,121 @@
+package provision
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpoint(t *testing.T) {
+	assert.Equal(t, "http://192.168.8.140:8184/register", endpoint("192.168.8.140:8184", "/register"))
+	assert.Equal(t, "https://ra.example.com/register", endpoint("https://ra.example.com/", "/register"))
+	assert.Equal(t, "https://ra.example.com/api/register", endpoint("https://ra.example.com/api", "/register"))
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // rejected handshakes are expected
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.Nil(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+	digest := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	pin := hex.EncodeToString(digest[:])
+
+	get := func(opts TLSOptions) error {
+		c, err := NewHTTPClient(opts, time.Second)
+		assert.Nil(t, err)
+		resp, err := c.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	t.Run("untrusted", func(t *testing.T) {
+		assert.NotNil(t, get(TLSOptions{}))
+	})
+
+	t.Run("ca file", func(t *testing.T) {
+		assert.Nil(t, get(TLSOptions{CAFile: caFile}))
+	})
+
+	t.Run("pinned", func(t *testing.T) {
+		assert.Nil(t, get(TLSOptions{CAFile: caFile, Pins: []string{pin}}))
+
+		// as openssl prints fingerprints
+		var fingerprint []string
+		for i := 0; i < len(pin); i += 2 {
+			fingerprint = append(fingerprint, strings.ToUpper(pin[i:i+2]))
+		}
+		assert.Nil(t, get(TLSOptions{CAFile: caFile, Pins: []string{strings.Join(fingerprint, ":")}}))
+	})
+
+	t.Run("pin mismatch", func(t *testing.T) {
+		other := sha256.Sum256([]byte("other key"))
+		assert.NotNil(t, get(TLSOptions{CAFile: caFile, Pins: []string{hex.EncodeToString(other[:])}}))
+	})
+
+	t.Run("invalid pin", func(t *testing.T) {
+		_, err := NewHTTPClient(TLSOptions{Pins: []string{"abc"}}, 0)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestRequestAuthentication(t *testing.T) {
+	masters := newTestMasters(t)
+	user := masters.user(t, "device1", true)
+
+	var (
+		authorization string
+		verifiedUid   string
+		verifyErr     error
+	)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		authorization = r.Header.Get("Authorization")
+		verifiedUid, verifyErr = VerifyRequest(r, body, masters.Sign.Public(), time.Minute)
+	}))
+	defer srv.Close()
+
+	p := New(srv.URL, srv.URL)
+	p.HTTPClient = srv.Client()
+	p.BearerToken = "secret"
+
+	_, err := p.post(context.Background(), srv.URL+"/register?x=1", []byte(`{"id":"device1"}`), user)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer secret", authorization)
+	assert.Nil(t, verifyErr)
+	assert.Equal(t, "device1", verifiedUid)
+
+	// Without a sign key the request is not signed
+	_, err = p.post(context.Background(), srv.URL+"/register", nil, masters.user(t, "device1", false))
+	assert.Nil(t, err)
+	assert.EqualError(t, verifyErr, "request is not signed")
+
+	// A signature by another identity's key does not verify
+	other := newTestMasters(t).user(t, "device1", true)
+	_, err = p.post(context.Background(), srv.URL+"/register", nil, other)
+	assert.Nil(t, err)
+	assert.EqualError(t, verifyErr, "invalid signature")
+
+	// The bearer token is not sent over plain http
+	authorization = ""
+	_, err = p.post(context.Background(), "http://"+srv.Listener.Addr().String()+"/register", nil, user)
+	assert.True(t, errors.Is(err, ErrInsecureToken))
+	assert.False(t, Retryable(err))
+	assert.Equal(t, "", authorization)
+}
@@ -3,6 +3,10 @@ package client
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.golang/paho"
@@ -12,68 +16,140 @@ import (
 type Sm9Auth struct {
 	Random1 string
 	Server  *User
+	Logger  Logger // if nil the client's logger is used
 	client  *Client
+
+	mu        sync.Mutex
+	connected time.Time // when the last CONNECT was built
+	started   bool      // whether the broker has begun an AUTH exchange since
 }
 
 func NewSm9Auth(c *Client) *Sm9Auth {
 	return &Sm9Auth{client: c}
 }
 
+// connecting records that a CONNECT packet is being built, from which a handshake is timed
+func (s *Sm9Auth) connecting() {
+	s.mu.Lock()
+	s.connected = time.Now()
+	s.started = false
+	s.mu.Unlock()
+}
+
+// begin records that the broker has sent the first AUTH packet of a handshake
+func (s *Sm9Auth) begin() {
+	s.mu.Lock()
+	s.started = true
+	s.mu.Unlock()
+}
+
+// finish records the outcome of the handshake in progress. It does nothing, and returns false, if the broker has not
+// begun one, as when the connection is refused or lost before the first AUTH packet.
+func (s *Sm9Auth) finish(ok bool) bool {
+	s.mu.Lock()
+	started, connected := s.started, s.connected
+	s.started = false
+	s.mu.Unlock()
+
+	if !started {
+		return false
+	}
+	s.client.Metrics.handshake(ok, time.Since(connected))
+	return true
+}
+
+// logger returns the Logger the authenticator should use
+func (s *Sm9Auth) logger() Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return s.client.logger()
+}
+
 func (s *Sm9Auth) Authenticate(a *paho.Auth) *paho.Auth {
 	reauth := &paho.Auth{
 		Properties: &paho.AuthProperties{
-			AuthMethod: "sm9",
+			AuthMethod: AuthMethodSM9,
 		},
 		ReasonCode: packets.AuthReauthenticate,
 	}
+	failed := func(msg string, err error) *paho.Auth {
+		s.logger().Warn("sm9 authentication failed: "+msg, "err", err)
+		s.finish(false)
+		s.client.emit(Event{Type: EventAuthFailed, Err: fmt.Errorf("%s: %w", msg, err)})
+		return reauth
+	}
+
+	s.begin()
+	s.client.emit(Event{Type: EventAuthStarted})
+	if a.Properties == nil {
+		return failed("auth packet has no properties", errors.New("missing properties"))
+	}
 
+	var err error
 	s.Server = &User{}
-	s.Server.Uid = []byte(a.Properties.User.Get("uid"))
-	buf, err := hex.DecodeString(a.Properties.User.Get("hid"))
+	s.Server.Uid = []byte(a.Properties.User.Get(PropertyUid))
+	s.logger().Debug("sm9 authentication challenge received", "server_uid", string(s.Server.Uid))
+	s.Server.Hid, err = ParseHid(a.Properties.User.Get(PropertyHid))
+	if err == nil {
+		err = ValidateEncryptHid(s.Server.Hid)
+	}
 	if err != nil {
-		return reauth
+		return failed("invalid server hid", err)
 	}
-	s.Server.Hid = buf[0]
 
-	buf, err = hex.DecodeString(string(a.Properties.AuthData))
+	buf, err := hex.DecodeString(string(a.Properties.AuthData))
 	if err != nil {
-		return reauth
+		return failed("auth data is not hex encoded", err)
 	}
 
-	decrypted, err := sm9.DecryptASN1(s.client.User.GetEncryptPrivateKey(), s.client.User.Uid, buf)
+	user := s.client.user()
+	switch {
+	case user == nil || user.GetEncryptPrivateKey() == nil:
+		// e.g. not yet provisioned
+		return failed("cannot decrypt challenge", errors.New("encrypt private key missing"))
+	case user.GetEncryptMasterPublicKey() == nil:
+		return failed("cannot encrypt response", errors.New("encrypt master public key missing"))
+	}
+	decrypted, err := sm9.DecryptASN1(user.GetEncryptPrivateKey(), user.Uid, buf)
 	if err != nil {
-		return reauth
+		return failed("cannot decrypt challenge", err)
 	}
 
 	random1 := decrypted[:len(decrypted)/2]
 	if s.Random1 != hex.EncodeToString(random1) {
-		return reauth
+		return failed("server did not return our random", errors.New("random1 mismatch"))
 	}
 
 	random2 := decrypted[len(decrypted)/2:]
-	buf, err = sm9.EncryptASN1(rand.Reader, s.client.User.GetEncryptMasterPublicKey(), s.Server.Uid, s.Server.Hid, random2)
+	buf, err = sm9.EncryptASN1(rand.Reader, user.GetEncryptMasterPublicKey(), s.Server.Uid, s.Server.Hid, random2)
 	if err != nil {
-		return reauth
+		return failed("cannot encrypt response", err)
 	}
 
 	return &paho.Auth{
 		Properties: &paho.AuthProperties{
-			AuthMethod: "sm9",
+			AuthMethod: AuthMethodSM9,
 			AuthData:   []byte(hex.EncodeToString(buf)),
 		},
 		ReasonCode: packets.AuthContinueAuthentication,
 	}
 }
 
-func (s *Sm9Auth) Authenticated() {}
+func (s *Sm9Auth) Authenticated() {
+	s.finish(true)
+	s.logger().Info("sm9 authentication succeeded")
+}
 
 func (s *Sm9Auth) GetRandom1(expectedLen int) string {
 	buf := make([]byte, expectedLen)
 	_, err := rand.Read(buf)
 	if err != nil {
+		s.logger().Error("cannot generate random", "err", err)
 		return ""
 	}
 
 	s.Random1 = hex.EncodeToString(buf)
+	s.connecting() // the random is generated as the CONNECT packet is built
 	return s.Random1
 }
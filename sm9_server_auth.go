@@ -0,0 +1,170 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/emmansun/gmsm/sm9"
+)
+
+// Names used in the SM9 enhanced authentication exchange
+const (
+	AuthMethodSM9      = "sm9"        // authentication method of the CONNECT and AUTH packets
+	PropertyUid        = "uid"        // user property carrying the identity of the sender
+	PropertyHid        = "hid"        // user property carrying the hid data encrypted to the sender uses, see FormatHid
+	PropertyDeviceName = "deviceName" // user property of the CONNECT naming the device
+)
+
+// ServerAuthHook is the interface through which a broker runs an MQTT v5 enhanced authentication exchange. When a
+// CONNECT carrying AuthMethod arrives, the broker calls OnConnect with its properties and sends the returned AUTH. Each
+// AUTH the client sends back is passed to the exchange's OnAuth; the broker sends the AUTH returned or, once OnAuth
+// returns nil, a successful CONNACK. On any error the broker refuses the connection with CONNACK Not authorized.
+type ServerAuthHook interface {
+	AuthMethod() string
+	OnConnect(props *packets.Properties) (ServerAuthExchange, *packets.Auth, error)
+}
+
+// ServerAuthExchange is the state of one enhanced authentication exchange
+type ServerAuthExchange interface {
+	OnAuth(auth *packets.Auth) (*packets.Auth, error)
+	Identity() (uid string, hid byte) // the identity claimed by the client, authenticated once OnAuth returns nil
+}
+
+// ServerAuthenticator is the server half of the handshake performed by Sm9Auth. It encrypts the client's random1,
+// followed by a random2 of its own, to the identity in the CONNECT; the client proves it holds the private key for
+// that identity by decrypting them and returning random2, encrypted to the server.
+//
+// A ServerAuthenticator is safe for concurrent use provided Server is not modified.
+type ServerAuthenticator struct {
+	Server    *User                                               // identity of the broker; its encrypt private key is required
+	Authorize func(uid string, hid byte, deviceName string) error // if set, may refuse a device before it is challenged
+	Logger    Logger                                              // defaults to discarding all records
+}
+
+// NewServerAuthenticator creates a ServerAuthenticator for the broker identity
+func NewServerAuthenticator(server *User) (*ServerAuthenticator, error) {
+	if server == nil || server.GetEncryptPrivateKey() == nil || server.GetEncryptMasterPublicKey() == nil {
+		return nil, errors.New("server encrypt private key and encrypt master public key required")
+	}
+	return &ServerAuthenticator{Server: server}, nil
+}
+
+func (a *ServerAuthenticator) logger() Logger {
+	if a.Logger == nil {
+		return NopLogger()
+	}
+	return a.Logger
+}
+
+// AuthMethod returns the authentication method handled
+func (a *ServerAuthenticator) AuthMethod() string {
+	return AuthMethodSM9
+}
+
+// OnConnect reads the client identity and random1 from the CONNECT properties and returns the challenge
+func (a *ServerAuthenticator) OnConnect(props *packets.Properties) (ServerAuthExchange, *packets.Auth, error) {
+	if props == nil || props.AuthMethod != AuthMethodSM9 {
+		return nil, nil, errors.New("authentication method is not sm9")
+	}
+
+	e := &sm9Exchange{server: a.Server, uid: userProperty(props.User, PropertyUid)}
+	if e.uid == "" {
+		return nil, nil, errors.New("uid missing")
+	}
+	hid, err := ParseHid(userProperty(props.User, PropertyHid))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ValidateEncryptHid(hid); err != nil {
+		return nil, nil, err
+	}
+	e.hid = hid
+
+	if a.Authorize != nil {
+		if err := a.Authorize(e.uid, e.hid, userProperty(props.User, PropertyDeviceName)); err != nil {
+			a.logger().Warn("sm9 client refused", "uid", e.uid, "err", err)
+			return nil, nil, err
+		}
+	}
+
+	random1, err := hex.DecodeString(string(props.AuthData))
+	if err != nil || len(random1) == 0 {
+		return nil, nil, errors.New("auth data is not a hex encoded random")
+	}
+	e.random2 = make([]byte, len(random1))
+	if _, err := rand.Read(e.random2); err != nil {
+		return nil, nil, err
+	}
+
+	challenge, err := sm9.EncryptASN1(rand.Reader, a.Server.GetEncryptMasterPublicKey(), []byte(e.uid), e.hid, append(random1, e.random2...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("encrypt challenge: %w", err)
+	}
+
+	a.logger().Debug("sm9 challenge sent", "uid", e.uid)
+	return e, &packets.Auth{
+		ReasonCode: packets.AuthContinueAuthentication,
+		Properties: &packets.Properties{
+			AuthMethod: AuthMethodSM9,
+			AuthData:   []byte(hex.EncodeToString(challenge)),
+			User: []packets.User{
+				{Key: PropertyUid, Value: string(a.Server.Uid)},
+				{Key: PropertyHid, Value: FormatHid(a.Server.Identity().EncryptionHid())},
+			},
+		},
+	}, nil
+}
+
+// sm9Exchange is a handshake awaiting the client's response
+type sm9Exchange struct {
+	server  *User
+	uid     string
+	hid     byte
+	random2 []byte
+	done    bool
+}
+
+// OnAuth checks the client returned random2, completing the exchange
+func (e *sm9Exchange) OnAuth(auth *packets.Auth) (*packets.Auth, error) {
+	switch {
+	case e.done:
+		return nil, errors.New("authentication already completed")
+	case auth == nil || auth.Properties == nil:
+		return nil, errors.New("auth packet has no properties")
+	case auth.ReasonCode != packets.AuthContinueAuthentication:
+		return nil, fmt.Errorf("client abandoned the handshake with reason code %#x", auth.ReasonCode)
+	}
+
+	buf, err := hex.DecodeString(string(auth.Properties.AuthData))
+	if err != nil {
+		return nil, errors.New("auth data is not hex encoded")
+	}
+	random2, err := sm9.DecryptASN1(e.server.GetEncryptPrivateKey(), e.server.Uid, buf)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt response: %w", err)
+	}
+	if subtle.ConstantTimeCompare(random2, e.random2) != 1 {
+		return nil, errors.New("client did not return our random")
+	}
+
+	e.done = true
+	return nil, nil
+}
+
+// Identity returns the identity claimed in the CONNECT
+func (e *sm9Exchange) Identity() (string, byte) {
+	return e.uid, e.hid
+}
+
+func userProperty(props []packets.User, key string) string {
+	for _, u := range props {
+		if u.Key == key {
+			return u.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/opensvn/auth-client/sm9test"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestPair issues keys for a device and a broker under the same master keys
+func newTestPair(t *testing.T) (device, server *User) {
+	m, err := sm9test.NewMasters()
+	assert.Nil(t, err)
+	return NewUser(issueTestUserConfig(t, m, "device1", 1)), NewUser(issueTestUserConfig(t, m, "broker", 1))
+}
+
+// connectProperties returns the properties of the CONNECT the client would send
+func connectProperties(c *Client) *packets.Properties {
+	return &packets.Properties{
+		AuthMethod: AuthMethodSM9,
+		AuthData:   []byte(c.AuthHandler.GetRandom1(8)),
+		User: []packets.User{
+			{Key: PropertyUid, Value: string(c.User.Uid)},
+			{Key: PropertyHid, Value: hex.EncodeToString([]byte{c.User.Hid})},
+			{Key: PropertyDeviceName, Value: "test device"},
+		},
+	}
+}
+
+func TestServerAuthenticator(t *testing.T) {
+	device, server := newTestPair(t)
+	c := &Client{User: device, Logger: NopLogger()}
+	c.AuthHandler = NewSm9Auth(c)
+
+	_, err := NewServerAuthenticator(&User{})
+	assert.NotNil(t, err)
+	a, err := NewServerAuthenticator(server)
+	assert.Nil(t, err)
+	var hook ServerAuthHook = a
+	assert.Equal(t, "sm9", hook.AuthMethod())
+
+	t.Run("success", func(t *testing.T) {
+		exchange, challenge, err := hook.OnConnect(connectProperties(c))
+		assert.Nil(t, err)
+
+		reply := c.AuthHandler.Authenticate(paho.AuthFromPacketAuth(challenge))
+		assert.Equal(t, byte(packets.AuthContinueAuthentication), reply.ReasonCode)
+		assert.Equal(t, "broker", string(c.AuthHandler.Server.Uid))
+
+		next, err := exchange.OnAuth(reply.Packet())
+		assert.Nil(t, err)
+		assert.Nil(t, next)
+		uid, hid := exchange.Identity()
+		assert.Equal(t, "device1", uid)
+		assert.Equal(t, byte(1), hid)
+
+		// The exchange cannot be replayed
+		_, err = exchange.OnAuth(reply.Packet())
+		assert.NotNil(t, err)
+	})
+
+	t.Run("wrong response", func(t *testing.T) {
+		exchange, _, err := hook.OnConnect(connectProperties(c))
+		assert.Nil(t, err)
+
+		// A response to a different challenge does not authenticate
+		_, other, err := hook.OnConnect(connectProperties(c))
+		assert.Nil(t, err)
+		reply := c.AuthHandler.Authenticate(paho.AuthFromPacketAuth(other))
+		_, err = exchange.OnAuth(reply.Packet())
+		assert.NotNil(t, err)
+	})
+
+	t.Run("abandoned", func(t *testing.T) {
+		exchange, _, err := hook.OnConnect(connectProperties(c))
+		assert.Nil(t, err)
+		_, err = exchange.OnAuth(&packets.Auth{ReasonCode: packets.AuthReauthenticate, Properties: &packets.Properties{}})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("invalid connect", func(t *testing.T) {
+		props := connectProperties(c)
+		props.AuthMethod = "password"
+		_, _, err := hook.OnConnect(props)
+		assert.NotNil(t, err)
+
+		props = connectProperties(c)
+		props.User[1].Value = "zz"
+		_, _, err = hook.OnConnect(props)
+		assert.NotNil(t, err)
+
+		props = connectProperties(c)
+		props.AuthData = nil
+		_, _, err = hook.OnConnect(props)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		refused := errors.New("unknown device")
+		a := &ServerAuthenticator{Server: server, Authorize: func(uid string, hid byte, deviceName string) error {
+			assert.Equal(t, "test device", deviceName)
+			return refused
+		}}
+		_, _, err := a.OnConnect(connectProperties(c))
+		assert.Equal(t, refused, err)
+	})
+}
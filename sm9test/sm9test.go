@@ -0,0 +1,93 @@
+// Package sm9test issues SM9 keys for tests: master key pairs playing the part of the key generation centre, and the
+// hex encoded keys a client.UserConfig holds. It depends only on gmsm, so that the tests of every package, the client
+// package's own included, can use it.
+package sm9test
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/emmansun/gmsm/sm9"
+)
+
+// Keys are the keys of one identity, hex encoded ASN.1 as in the fields of client.UserConfig of the same names
+type Keys struct {
+	EncryptPrivateKey      string
+	SignPrivateKey         string
+	EncryptMasterPublicKey string
+	SignMasterPublicKey    string
+}
+
+// Masters holds freshly generated master key pairs. The master keys are not safe for concurrent use (marshalling
+// normalises points in place), so the public keys are encoded once by NewMasters; the fields must not be modified.
+type Masters struct {
+	Encrypt *sm9.EncryptMasterPrivateKey
+	Sign    *sm9.SignMasterPrivateKey
+
+	EncryptMasterPublicKey string // hex encoded ASN.1
+	SignMasterPublicKey    string // hex encoded ASN.1
+}
+
+// NewMasters generates a pair of encrypt and sign master keys
+func NewMasters() (*Masters, error) {
+	enc, err := sm9.GenerateEncryptMasterKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate encrypt master key: %w", err)
+	}
+	sign, err := sm9.GenerateSignMasterKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate sign master key: %w", err)
+	}
+	m := &Masters{Encrypt: enc, Sign: sign}
+	if m.EncryptMasterPublicKey, err = HexASN1(enc.Public()); err != nil {
+		return nil, err
+	}
+	if m.SignMasterPublicKey, err = HexASN1(sign.Public()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Issue generates the private keys of uid with hid
+func (m *Masters) Issue(uid []byte, hid byte) (*sm9.EncryptPrivateKey, *sm9.SignPrivateKey, error) {
+	encKey, err := m.Encrypt.GenerateUserKey(uid, hid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("issue encrypt key: %w", err)
+	}
+	signKey, err := m.Sign.GenerateUserKey(uid, hid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("issue sign key: %w", err)
+	}
+	return encKey, signKey, nil
+}
+
+// Public returns the master public keys alone, i.e. what a device holds before it is provisioned
+func (m *Masters) Public() *Keys {
+	return &Keys{EncryptMasterPublicKey: m.EncryptMasterPublicKey, SignMasterPublicKey: m.SignMasterPublicKey}
+}
+
+// Keys issues the private keys of uid with hid and returns them encoded along with the master public keys
+func (m *Masters) Keys(uid string, hid byte) (*Keys, error) {
+	encKey, signKey, err := m.Issue([]byte(uid), hid)
+	if err != nil {
+		return nil, err
+	}
+	keys := m.Public()
+	if keys.EncryptPrivateKey, err = HexASN1(encKey); err != nil {
+		return nil, err
+	}
+	if keys.SignPrivateKey, err = HexASN1(signKey); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// HexASN1 returns the hex encoded ASN.1 form of a key
+func HexASN1(key interface{ MarshalASN1() ([]byte, error) }) (string, error) {
+	der, err := key.MarshalASN1()
+	if err != nil {
+		return "", fmt.Errorf("marshal key: %w", err)
+	}
+	return hex.EncodeToString(der), nil
+}
@@ -1,29 +1,59 @@
 package client
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/emmansun/gmsm/sm3"
 	"github.com/emmansun/gmsm/sm9"
 )
 
 type UserConfig struct {
 	Uid                    string `yaml:"uid"`
-	Hid                    byte   `yaml:"hid"`
+	Hid                    byte   `yaml:"hid"`                       // hid of the sign keys, HidSign
+	EncryptHid             byte   `yaml:"encrypt_hid,omitempty"`     // hid of the encrypt keys, if not Hid
+	IdentitySuffix         string `yaml:"identity_suffix,omitempty"` // appended to uid in the identity keys are issued for, e.g. a validity period
 	EncryptPrivateKey      string `yaml:"encrypt_private_key"`
 	SignPrivateKey         string `yaml:"sign_private_key"`
 	EncryptMasterPublicKey string `yaml:"encrypt_master_public_key"`
 	SignMasterPublicKey    string `yaml:"sign_master_public_key"`
+
+	// Set from the platform's response when the private keys are issued (zero if it does not say)
+	KeyVersion int       `yaml:"key_version,omitempty"`
+	IssuedAt   time.Time `yaml:"issued_at,omitempty"`
+	ExpiresAt  time.Time `yaml:"expires_at,omitempty"` // the keys must be renewed before this time
+}
+
+// Identity returns the identity described by the configuration
+func (conf *UserConfig) Identity() Identity {
+	return Identity{Uid: conf.Uid, Suffix: conf.IdentitySuffix, SignHid: conf.Hid, EncryptHid: conf.EncryptHid}
 }
 
+// ErrKeysExpired is returned by User.Validate once the private keys have passed their expiry
+var ErrKeysExpired = errors.New("private keys have expired")
+
 type User struct {
-	Uid                    []byte
-	Hid                    byte
+	Uid                    []byte // the identity the keys are issued for, including any suffix
+	IdentitySuffix         string // the end of Uid that is the identity suffix, if any
+	Hid                    byte   // hid of the sign keys
+	EncryptHid             byte   // hid of the encrypt keys, if not Hid
+	KeyVersion             int
+	IssuedAt               time.Time
+	ExpiresAt              time.Time // zero if the keys do not expire
 	encryptPrivateKey      *sm9.EncryptPrivateKey
 	signPrivateKey         *sm9.SignPrivateKey
 	encryptMasterPublicKey *sm9.EncryptMasterPublicKey
 	signMasterPublicKey    *sm9.SignMasterPublicKey
 }
 
+// NewUser creates the user described by conf, nil if its master public keys are missing or invalid. Private keys that
+// are missing or invalid are left unset, and the uid and hids are taken as they are; use NewUserWithError to find out
+// whether a configuration is usable.
 func NewUser(conf *UserConfig) *User {
 	if conf == nil {
 		return nil
@@ -33,7 +63,7 @@ func NewUser(conf *UserConfig) *User {
 		return nil
 	}
 
-	u := &User{Uid: []byte(conf.Uid), Hid: conf.Hid}
+	u := newUser(conf)
 	err := u.SetEncryptMasterPublicKey(conf.EncryptMasterPublicKey)
 	if err != nil {
 		return nil
@@ -50,6 +80,122 @@ func NewUser(conf *UserConfig) *User {
 	return u
 }
 
+// newUser returns the user described by conf without any of its keys
+func newUser(conf *UserConfig) *User {
+	id := conf.Identity()
+	return &User{
+		Uid:            id.ID(),
+		IdentitySuffix: id.Suffix,
+		Hid:            id.SignHid,
+		EncryptHid:     id.EncryptHid,
+		KeyVersion:     conf.KeyVersion,
+		IssuedAt:       conf.IssuedAt,
+		ExpiresAt:      conf.ExpiresAt,
+	}
+}
+
+// UserOptions controls how NewUserWithError treats the configuration
+type UserOptions struct {
+	RequirePrivateKeys bool // report missing private keys as errors rather than leaving them unset
+}
+
+// ErrFieldMissing is the error of a FieldError for a required field left empty
+var ErrFieldMissing = errors.New("required but not set")
+
+// FieldError reports a UserConfig field that could not be used, identified by its yaml key
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// NewUserWithError creates the user described by conf, returning a *FieldError naming the first field that is missing
+// or cannot be parsed. Private keys may be left empty unless opts require them, so that they can be provisioned, but
+// are always parsed if present.
+func NewUserWithError(conf *UserConfig, opts UserOptions) (*User, error) {
+	if conf == nil {
+		return nil, errors.New("user configuration missing")
+	}
+
+	u, errs := parseUser(conf, opts)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return u, nil
+}
+
+// CheckUserConfig returns a *FieldError for every field of conf that NewUserWithError would reject, in the order of
+// the fields, or nil if conf is usable
+func CheckUserConfig(conf *UserConfig, opts UserOptions) []*FieldError {
+	if conf == nil {
+		return nil
+	}
+	_, errs := parseUser(conf, opts)
+	return errs
+}
+
+// parseUser creates the user described by conf, checking every field rather than stopping at the first that is
+// missing or cannot be parsed
+func parseUser(conf *UserConfig, opts UserOptions) (*User, []*FieldError) {
+	var errs []*FieldError
+	id := conf.Identity()
+	u := newUser(conf)
+	if conf.Uid == "" {
+		errs = append(errs, &FieldError{Field: "uid", Err: ErrFieldMissing})
+	}
+	if err := ValidateSignHid(id.SignHid); err != nil {
+		errs = append(errs, &FieldError{Field: "hid", Err: err})
+	}
+	if id.EncryptHid != 0 {
+		// otherwise the sign hid is used, checked above
+		if err := ValidateEncryptHid(id.EncryptHid); err != nil {
+			errs = append(errs, &FieldError{Field: "encrypt_hid", Err: err})
+		}
+	}
+
+	fields := []struct {
+		name     string
+		value    string
+		set      func(string) error
+		required bool
+	}{
+		{"encrypt_master_public_key", conf.EncryptMasterPublicKey, u.SetEncryptMasterPublicKey, true},
+		{"sign_master_public_key", conf.SignMasterPublicKey, u.SetSignMasterPublicKey, true},
+		{"encrypt_private_key", conf.EncryptPrivateKey, u.SetEncryptPrivateKey, opts.RequirePrivateKeys},
+		{"sign_private_key", conf.SignPrivateKey, u.SetSignPrivateKey, opts.RequirePrivateKeys},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			if f.required {
+				errs = append(errs, &FieldError{Field: f.name, Err: ErrFieldMissing})
+			}
+			continue
+		}
+		if err := f.set(f.value); err != nil {
+			errs = append(errs, &FieldError{Field: f.name, Err: err})
+		}
+	}
+
+	return u, errs
+}
+
+// Identity returns the identity of the user, with the uid and suffix that make up Uid apart
+func (u *User) Identity() Identity {
+	return Identity{
+		Uid:        strings.TrimSuffix(string(u.Uid), u.IdentitySuffix),
+		Suffix:     u.IdentitySuffix,
+		SignHid:    u.Hid,
+		EncryptHid: u.EncryptHid,
+	}
+}
+
 func (u *User) GetEncryptPrivateKey() *sm9.EncryptPrivateKey {
 	return u.encryptPrivateKey
 }
@@ -129,3 +275,63 @@ func (u *User) SetSignMasterPublicKey(signMasterPublicKey string) error {
 	u.signMasterPublicKey = key
 	return nil
 }
+
+// Sign returns the ASN.1 encoded SM9 signature of the SM3 digest of msg
+func (u *User) Sign(msg []byte) ([]byte, error) {
+	if u.signPrivateKey == nil || u.signMasterPublicKey == nil {
+		return nil, errors.New("sign private key and sign master public key required")
+	}
+
+	// Parsed private keys do not carry their master public key, which signing needs
+	u.signPrivateKey.SetMasterPublicKey(u.signMasterPublicKey)
+	digest := sm3.Sum(msg)
+	return sm9.SignASN1(rand.Reader, u.signPrivateKey, digest[:])
+}
+
+// Expired reports whether the private keys have passed their expiry
+func (u *User) Expired() bool {
+	return !u.ExpiresAt.IsZero() && !time.Now().Before(u.ExpiresAt)
+}
+
+// Validate checks that the private keys were issued for the user's uid and hid under the master public keys. A random
+// challenge is signed and verified, then encrypted and decrypted; either round trip failing means a key is wrong.
+// Keys past their expiry are reported with ErrKeysExpired.
+func (u *User) Validate() error {
+	switch {
+	case u.signPrivateKey == nil:
+		return errors.New("sign private key missing")
+	case u.encryptPrivateKey == nil:
+		return errors.New("encrypt private key missing")
+	case u.signMasterPublicKey == nil:
+		return errors.New("sign master public key missing")
+	case u.encryptMasterPublicKey == nil:
+		return errors.New("encrypt master public key missing")
+	case u.Expired():
+		return fmt.Errorf("%w at %s", ErrKeysExpired, u.ExpiresAt.Format(time.RFC3339))
+	}
+
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+
+	sig, err := u.Sign(challenge)
+	if err != nil {
+		return fmt.Errorf("sign with sign private key: %w", err)
+	}
+	digest := sm3.Sum(challenge)
+	if !sm9.VerifyASN1(u.signMasterPublicKey, u.Uid, u.Hid, digest[:], sig) {
+		return errors.New("sign private key does not match the uid, hid and sign master public key")
+	}
+
+	ciphertext, err := sm9.EncryptASN1(rand.Reader, u.encryptMasterPublicKey, u.Uid, u.Identity().EncryptionHid(), challenge)
+	if err != nil {
+		return fmt.Errorf("encrypt to uid: %w", err)
+	}
+	plaintext, err := sm9.DecryptASN1(u.encryptPrivateKey, u.Uid, ciphertext)
+	if err != nil || !bytes.Equal(plaintext, challenge) {
+		return errors.New("encrypt private key does not match the uid, hid and encrypt master public key")
+	}
+
+	return nil
+}
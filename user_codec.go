@@ -0,0 +1,501 @@
+package client
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emmansun/gmsm/sm3"
+	"github.com/emmansun/gmsm/sm4"
+	"github.com/emmansun/gmsm/sm9"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// KeyType identifies one of a user's keys for import and export
+type KeyType int
+
+const (
+	SignPrivateKeyType KeyType = iota
+	EncryptPrivateKeyType
+	SignMasterPublicKeyType
+	EncryptMasterPublicKeyType
+)
+
+// KeyTypes lists every key type, private keys first
+var KeyTypes = []KeyType{SignPrivateKeyType, EncryptPrivateKeyType, SignMasterPublicKeyType, EncryptMasterPublicKeyType}
+
+func (t KeyType) String() string {
+	switch t {
+	case SignPrivateKeyType:
+		return "sign private key"
+	case EncryptPrivateKeyType:
+		return "encrypt private key"
+	case SignMasterPublicKeyType:
+		return "sign master public key"
+	case EncryptMasterPublicKeyType:
+		return "encrypt master public key"
+	}
+	return fmt.Sprintf("KeyType(%d)", int(t))
+}
+
+// Private reports whether the key type is one of the private keys
+func (t KeyType) Private() bool {
+	return t == SignPrivateKeyType || t == EncryptPrivateKeyType
+}
+
+// PEM block types of the keys, as used by GmSSL and later releases of gmsm
+const (
+	PEMSignPrivateKey         = "SM9 SIGN PRIVATE KEY"
+	PEMEncryptPrivateKey      = "SM9 ENC PRIVATE KEY"
+	PEMSignMasterPublicKey    = "SM9 SIGN MASTER PUBLIC KEY"
+	PEMEncryptMasterPublicKey = "SM9 ENC MASTER PUBLIC KEY"
+	PEMEncryptedPrivateKey    = "ENCRYPTED PRIVATE KEY" // PKCS#8 EncryptedPrivateKeyInfo
+)
+
+// PEMType returns the PEM block type of the key type
+func (t KeyType) PEMType() string {
+	switch t {
+	case SignPrivateKeyType:
+		return PEMSignPrivateKey
+	case EncryptPrivateKeyType:
+		return PEMEncryptPrivateKey
+	case SignMasterPublicKeyType:
+		return PEMSignMasterPublicKey
+	case EncryptMasterPublicKeyType:
+		return PEMEncryptMasterPublicKey
+	}
+	return ""
+}
+
+func keyTypeFromPEM(blockType string) (KeyType, bool) {
+	for _, t := range KeyTypes {
+		if t.PEMType() == blockType {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// ParseKeyType parses a key type named as by String with hyphens for spaces, e.g. sign-private-key
+func ParseKeyType(s string) (KeyType, error) {
+	name := strings.ReplaceAll(strings.ToLower(s), "-", " ")
+	for _, t := range KeyTypes {
+		if t.String() == name {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown key type %q (expected sign-private-key, encrypt-private-key, sign-master-public-key or encrypt-master-public-key)", s)
+}
+
+// KeyFormat is an encoding of a single key
+type KeyFormat int
+
+const (
+	KeyFormatHex    KeyFormat = iota // hex encoded ASN.1, as in UserConfig
+	KeyFormatDER                     // raw ASN.1
+	KeyFormatBase64                  // standard base64 encoded ASN.1
+	KeyFormatPEM                     // PEM block of the key's PEMType
+)
+
+var keyFormatNames = map[string]KeyFormat{
+	"hex":    KeyFormatHex,
+	"der":    KeyFormatDER,
+	"base64": KeyFormatBase64,
+	"pem":    KeyFormatPEM,
+}
+
+// ParseKeyFormat parses a key format name: hex, der, base64 or pem
+func ParseKeyFormat(s string) (KeyFormat, error) {
+	f, ok := keyFormatNames[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown key format %q (expected hex, der, base64 or pem)", s)
+	}
+	return f, nil
+}
+
+// MarshalKey returns the ASN.1 encoding of the key
+func (u *User) MarshalKey(t KeyType) ([]byte, error) {
+	var m interface{ MarshalASN1() ([]byte, error) }
+	switch t {
+	case SignPrivateKeyType:
+		if u.signPrivateKey != nil {
+			m = u.signPrivateKey
+		}
+	case EncryptPrivateKeyType:
+		if u.encryptPrivateKey != nil {
+			m = u.encryptPrivateKey
+		}
+	case SignMasterPublicKeyType:
+		if u.signMasterPublicKey != nil {
+			m = u.signMasterPublicKey
+		}
+	case EncryptMasterPublicKeyType:
+		if u.encryptMasterPublicKey != nil {
+			m = u.encryptMasterPublicKey
+		}
+	default:
+		return nil, fmt.Errorf("unknown key type %v", t)
+	}
+	if m == nil {
+		return nil, fmt.Errorf("%v missing", t)
+	}
+	return m.MarshalASN1()
+}
+
+// UnmarshalKey sets the key from its ASN.1 encoding
+func (u *User) UnmarshalKey(t KeyType, der []byte) error {
+	switch t {
+	case SignPrivateKeyType:
+		key := new(sm9.SignPrivateKey)
+		if err := key.UnmarshalASN1(der); err != nil {
+			return fmt.Errorf("%v: %w", t, err)
+		}
+		u.signPrivateKey = key
+	case EncryptPrivateKeyType:
+		key := new(sm9.EncryptPrivateKey)
+		if err := key.UnmarshalASN1(der); err != nil {
+			return fmt.Errorf("%v: %w", t, err)
+		}
+		u.encryptPrivateKey = key
+	case SignMasterPublicKeyType:
+		key := new(sm9.SignMasterPublicKey)
+		if err := key.UnmarshalASN1(der); err != nil {
+			return fmt.Errorf("%v: %w", t, err)
+		}
+		u.signMasterPublicKey = key
+	case EncryptMasterPublicKeyType:
+		key := new(sm9.EncryptMasterPublicKey)
+		if err := key.UnmarshalASN1(der); err != nil {
+			return fmt.Errorf("%v: %w", t, err)
+		}
+		u.encryptMasterPublicKey = key
+	default:
+		return fmt.Errorf("unknown key type %v", t)
+	}
+	return nil
+}
+
+// ExportKey returns the key in the format
+func (u *User) ExportKey(t KeyType, f KeyFormat) ([]byte, error) {
+	der, err := u.MarshalKey(t)
+	if err != nil {
+		return nil, err
+	}
+	switch f {
+	case KeyFormatHex:
+		return []byte(hex.EncodeToString(der)), nil
+	case KeyFormatDER:
+		return der, nil
+	case KeyFormatBase64:
+		return []byte(base64.StdEncoding.EncodeToString(der)), nil
+	case KeyFormatPEM:
+		return pem.EncodeToMemory(&pem.Block{Type: t.PEMType(), Bytes: der}), nil
+	}
+	return nil, fmt.Errorf("unknown key format %d", int(f))
+}
+
+// ImportKey sets the key from data in the format. Surrounding whitespace is ignored in text formats, and a PEM block
+// must be of the key's PEMType.
+func (u *User) ImportKey(t KeyType, f KeyFormat, data []byte) error {
+	var (
+		der []byte
+		err error
+	)
+	switch f {
+	case KeyFormatHex:
+		der, err = hex.DecodeString(string(bytes.TrimSpace(data)))
+	case KeyFormatDER:
+		der = data
+	case KeyFormatBase64:
+		der, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	case KeyFormatPEM:
+		block, _ := pem.Decode(data)
+		switch {
+		case block == nil:
+			err = errors.New("no PEM block found")
+		case block.Type != t.PEMType():
+			err = fmt.Errorf("PEM block is %q, expected %q", block.Type, t.PEMType())
+		default:
+			der = block.Bytes
+		}
+	default:
+		err = fmt.Errorf("unknown key format %d", int(f))
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %w", t, err)
+	}
+	return u.UnmarshalKey(t, der)
+}
+
+// ExportPEM returns every key the user holds as a sequence of PEM blocks. If password is not empty the private keys
+// are exported as password protected PKCS#8 containers (see MarshalEncryptedKey).
+func (u *User) ExportPEM(password []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, t := range u.HeldKeys() {
+		block := &pem.Block{Type: t.PEMType()}
+		var err error
+		if t.Private() && len(password) > 0 {
+			block.Type = PEMEncryptedPrivateKey
+			block.Bytes, err = u.MarshalEncryptedKey(t, password)
+		} else {
+			block.Bytes, err = u.MarshalKey(t)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := pem.Encode(&buf, block); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// ImportPEM sets the keys found in the PEM blocks of data, as written by ExportPEM. Password is needed for encrypted
+// private keys. Blocks of other types are ignored; an error is returned if none is a key.
+func (u *User) ImportPEM(data []byte, password []byte) error {
+	found := false
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type == PEMEncryptedPrivateKey {
+			if len(password) == 0 {
+				return errors.New("password required for encrypted private key")
+			}
+			if err := u.UnmarshalEncryptedKey(block.Bytes, password); err != nil {
+				return err
+			}
+			found = true
+			continue
+		}
+		if t, ok := keyTypeFromPEM(block.Type); ok {
+			if err := u.UnmarshalKey(t, block.Bytes); err != nil {
+				return err
+			}
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("no SM9 keys found in PEM data")
+	}
+	return nil
+}
+
+// HeldKeys returns the types of the keys the user holds
+func (u *User) HeldKeys() []KeyType {
+	var types []KeyType
+	if u.signPrivateKey != nil {
+		types = append(types, SignPrivateKeyType)
+	}
+	if u.encryptPrivateKey != nil {
+		types = append(types, EncryptPrivateKeyType)
+	}
+	if u.signMasterPublicKey != nil {
+		types = append(types, SignMasterPublicKeyType)
+	}
+	if u.encryptMasterPublicKey != nil {
+		types = append(types, EncryptMasterPublicKeyType)
+	}
+	return types
+}
+
+// MarshalConfig returns the configuration the user can be recreated from with NewUser. The uid and identity suffix
+// are written apart, as they were configured.
+func (u *User) MarshalConfig() (*UserConfig, error) {
+	id := u.Identity()
+	conf := &UserConfig{
+		Uid:            id.Uid,
+		Hid:            u.Hid,
+		EncryptHid:     u.EncryptHid,
+		IdentitySuffix: id.Suffix,
+		KeyVersion:     u.KeyVersion,
+		IssuedAt:       u.IssuedAt,
+		ExpiresAt:      u.ExpiresAt,
+	}
+	fields := map[KeyType]*string{
+		SignPrivateKeyType:         &conf.SignPrivateKey,
+		EncryptPrivateKeyType:      &conf.EncryptPrivateKey,
+		SignMasterPublicKeyType:    &conf.SignMasterPublicKey,
+		EncryptMasterPublicKeyType: &conf.EncryptMasterPublicKey,
+	}
+	for _, t := range u.HeldKeys() {
+		der, err := u.MarshalKey(t)
+		if err != nil {
+			return nil, err
+		}
+		*fields[t] = hex.EncodeToString(der)
+	}
+	return conf, nil
+}
+
+// Password protected private keys are PKCS#8 EncryptedPrivateKeyInfo structures (RFC 5958) using PBES2 (RFC 8018)
+// with PBKDF2-HMAC-SM3 and SM4-CBC. The encrypted PrivateKeyInfo identifies the key by its SM9 algorithm OID
+// (GM/T 0006) and holds the key's ASN.1 encoding.
+var (
+	oidSM9Sign    = asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 302, 1}
+	oidSM9Encrypt = asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 302, 3}
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSM3    = asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 401, 2}
+	oidSM4CBC     = asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 104, 2}
+)
+
+// KeyIterations is the PBKDF2 iteration count of password protected keys
+const KeyIterations = 10000
+
+// ErrIncorrectPassword is returned when a password protected key cannot be decrypted
+var ErrIncorrectPassword = errors.New("incorrect password")
+
+type privateKeyInfo struct {
+	Version    int
+	Algorithm  pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// MarshalEncryptedKey returns the private key as a PKCS#8 EncryptedPrivateKeyInfo protected by password
+func (u *User) MarshalEncryptedKey(t KeyType, password []byte) ([]byte, error) {
+	if !t.Private() {
+		return nil, fmt.Errorf("%v is not a private key", t)
+	}
+	if len(password) == 0 {
+		return nil, errors.New("password required")
+	}
+	der, err := u.MarshalKey(t)
+	if err != nil {
+		return nil, err
+	}
+	oid := oidSM9Sign
+	if t == EncryptPrivateKeyType {
+		oid = oidSM9Encrypt
+	}
+	plaintext, err := asn1.Marshal(privateKeyInfo{Algorithm: pkix.AlgorithmIdentifier{Algorithm: oid}, PrivateKey: der})
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	iv := make([]byte, sm4.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := sm4.NewCipher(pbkdf2.Key(password, salt, KeyIterations, sm4.BlockSize, sm3.New))
+	if err != nil {
+		return nil, err
+	}
+	padding := sm4.BlockSize - len(plaintext)%sm4.BlockSize
+	plaintext = append(plaintext, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: KeyIterations,
+		KeyLength:      sm4.BlockSize,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACSM3, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	schemeParams, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidSM4CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		EncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: schemeParams}},
+		EncryptedData:       ciphertext,
+	})
+}
+
+// UnmarshalEncryptedKey sets the private key held in a PKCS#8 EncryptedPrivateKeyInfo protected by password, as
+// written by MarshalEncryptedKey
+func (u *User) UnmarshalEncryptedKey(der []byte, password []byte) error {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return fmt.Errorf("encrypted private key: %w", err)
+	}
+	if !info.EncryptionAlgorithm.Algorithm.Equal(oidPBES2) {
+		return fmt.Errorf("encrypted private key: unsupported encryption %v, expected PBES2", info.EncryptionAlgorithm.Algorithm)
+	}
+	var scheme pbes2Params
+	if _, err := asn1.Unmarshal(info.EncryptionAlgorithm.Parameters.FullBytes, &scheme); err != nil {
+		return fmt.Errorf("encrypted private key: invalid PBES2 parameters: %w", err)
+	}
+	if !scheme.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) || !scheme.EncryptionScheme.Algorithm.Equal(oidSM4CBC) {
+		return errors.New("encrypted private key: only PBKDF2 with SM4-CBC is supported")
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(scheme.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return fmt.Errorf("encrypted private key: invalid PBKDF2 parameters: %w", err)
+	}
+	if !kdf.PRF.Algorithm.Equal(oidHMACSM3) || kdf.IterationCount <= 0 {
+		return errors.New("encrypted private key: only PBKDF2 with HMAC-SM3 is supported")
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(scheme.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != sm4.BlockSize {
+		return errors.New("encrypted private key: invalid SM4-CBC iv")
+	}
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%sm4.BlockSize != 0 {
+		return errors.New("encrypted private key: invalid ciphertext length")
+	}
+
+	block, err := sm4.NewCipher(pbkdf2.Key(password, kdf.Salt, kdf.IterationCount, sm4.BlockSize, sm3.New))
+	if err != nil {
+		return err
+	}
+	plaintext := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, info.EncryptedData)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > sm4.BlockSize || !bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return ErrIncorrectPassword
+	}
+
+	var key privateKeyInfo
+	if _, err := asn1.Unmarshal(plaintext[:len(plaintext)-padding], &key); err != nil {
+		return ErrIncorrectPassword
+	}
+	switch {
+	case key.Algorithm.Algorithm.Equal(oidSM9Sign):
+		return u.UnmarshalKey(SignPrivateKeyType, key.PrivateKey)
+	case key.Algorithm.Algorithm.Equal(oidSM9Encrypt):
+		return u.UnmarshalKey(EncryptPrivateKeyType, key.PrivateKey)
+	}
+	return fmt.Errorf("encrypted private key: unsupported algorithm %v", key.Algorithm.Algorithm)
+}
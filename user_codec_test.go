@@ -0,0 +1,102 @@
+package client
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserKeyFormats(t *testing.T) {
+	conf := newTestUserConfig(t, "device1", 1)
+	u := NewUser(conf)
+
+	for _, f := range []string{"hex", "der", "base64", "PEM"} {
+		format, err := ParseKeyFormat(f)
+		assert.Nil(t, err)
+		for _, typ := range KeyTypes {
+			data, err := u.ExportKey(typ, format)
+			assert.Nil(t, err)
+
+			imported := &User{Uid: u.Uid, Hid: u.Hid}
+			assert.Nil(t, imported.ImportKey(typ, format, data), "%s %v", f, typ)
+			der, err := imported.MarshalKey(typ)
+			assert.Nil(t, err)
+			want, _ := u.MarshalKey(typ)
+			assert.Equal(t, want, der)
+		}
+	}
+
+	hexKey, err := u.ExportKey(SignPrivateKeyType, KeyFormatHex)
+	assert.Nil(t, err)
+	assert.Equal(t, conf.SignPrivateKey, string(hexKey))
+
+	pemKey, err := u.ExportKey(SignPrivateKeyType, KeyFormatPEM)
+	assert.Nil(t, err)
+	block, _ := pem.Decode(pemKey)
+	assert.Equal(t, "SM9 SIGN PRIVATE KEY", block.Type)
+	assert.EqualError(t, u.ImportKey(EncryptPrivateKeyType, KeyFormatPEM, pemKey),
+		`encrypt private key: PEM block is "SM9 SIGN PRIVATE KEY", expected "SM9 ENC PRIVATE KEY"`)
+
+	_, err = ParseKeyFormat("jwk")
+	assert.NotNil(t, err)
+	typ, err := ParseKeyType("Encrypt-Master-Public-Key")
+	assert.Nil(t, err)
+	assert.Equal(t, EncryptMasterPublicKeyType, typ)
+	_, err = ParseKeyType("sign")
+	assert.NotNil(t, err)
+	assert.Equal(t, KeyTypes, u.HeldKeys())
+	assert.Empty(t, (&User{}).HeldKeys())
+	_, err = (&User{}).ExportKey(SignPrivateKeyType, KeyFormatHex)
+	assert.EqualError(t, err, "sign private key missing")
+}
+
+func TestUserPEMBundle(t *testing.T) {
+	u := NewUser(newTestUserConfig(t, "device1", 1))
+
+	t.Run("plain", func(t *testing.T) {
+		bundle, err := u.ExportPEM(nil)
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(bundle, []byte(PEMEncryptedPrivateKey)))
+
+		imported := &User{Uid: u.Uid, Hid: u.Hid}
+		assert.Nil(t, imported.ImportPEM(bundle, nil))
+		assert.Nil(t, imported.Validate())
+	})
+
+	t.Run("password protected", func(t *testing.T) {
+		bundle, err := u.ExportPEM([]byte("secret"))
+		assert.Nil(t, err)
+		assert.Equal(t, 2, bytes.Count(bundle, []byte("BEGIN "+PEMEncryptedPrivateKey)))
+
+		imported := &User{Uid: u.Uid, Hid: u.Hid}
+		assert.EqualError(t, imported.ImportPEM(bundle, nil), "password required for encrypted private key")
+		assert.True(t, errors.Is((&User{}).ImportPEM(bundle, []byte("guess")), ErrIncorrectPassword))
+		assert.Nil(t, imported.ImportPEM(bundle, []byte("secret")))
+		assert.Nil(t, imported.Validate())
+	})
+
+	t.Run("no keys", func(t *testing.T) {
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}})
+		assert.EqualError(t, (&User{}).ImportPEM(data, nil), "no SM9 keys found in PEM data")
+	})
+}
+
+func TestUserMarshalConfig(t *testing.T) {
+	conf := newTestUserConfig(t, "device1", 1)
+	conf.KeyVersion = 4
+	conf.ExpiresAt = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	got, err := NewUser(conf).MarshalConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, conf, got)
+
+	conf.SignPrivateKey = ""
+	conf.EncryptPrivateKey = ""
+	got, err = NewUser(conf).MarshalConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, conf, got)
+}
@@ -1,8 +1,11 @@
 package client
 
 import (
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/opensvn/auth-client/sm9test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -46,4 +49,166 @@ func TestNewUser(t *testing.T) {
 		assert.NotNil(t, u.GetEncryptMasterPublicKey())
 		assert.NotNil(t, u.GetSignMasterPublicKey())
 	})
+
+	t.Run("uid and hid unchecked", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", 1)
+		conf.Uid = ""
+		conf.Hid = 9
+		u := NewUser(conf)
+		assert.NotNil(t, u, "NewUser leaves checking the identity to NewUserWithError")
+		assert.Equal(t, byte(9), u.Hid)
+		_, err := NewUserWithError(conf, UserOptions{})
+		assert.NotNil(t, err)
+	})
+}
+
+func TestNewUserWithError(t *testing.T) {
+	fieldErr := func(t *testing.T, err error, field string) *FieldError {
+		var fe *FieldError
+		assert.True(t, errors.As(err, &fe), "%v", err)
+		if fe != nil {
+			assert.Equal(t, field, fe.Field)
+		}
+		return fe
+	}
+
+	t.Run("nil config", func(t *testing.T) {
+		u, err := NewUserWithError(nil, UserOptions{})
+		assert.Nil(t, u)
+		assert.EqualError(t, err, "user configuration missing")
+	})
+
+	t.Run("missing uid", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", 1)
+		conf.Uid = ""
+		_, err := NewUserWithError(conf, UserOptions{})
+		assert.True(t, errors.Is(err, ErrFieldMissing))
+		fieldErr(t, err, "uid")
+	})
+
+	t.Run("missing master public key", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", 1)
+		conf.SignMasterPublicKey = ""
+		_, err := NewUserWithError(conf, UserOptions{})
+		assert.EqualError(t, err, "sign_master_public_key: required but not set")
+	})
+
+	t.Run("invalid keys", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", 1)
+		conf.EncryptMasterPublicKey = "xyz"
+		_, err := NewUserWithError(conf, UserOptions{})
+		fieldErr(t, err, "encrypt_master_public_key")
+
+		conf = newTestUserConfig(t, "device1", 1)
+		conf.SignPrivateKey = "0342"
+		u, err := NewUserWithError(conf, UserOptions{})
+		assert.Nil(t, u)
+		fieldErr(t, err, "sign_private_key")
+
+		assert.NotNil(t, NewUser(conf), "NewUser leaves invalid private keys unset")
+		assert.NotNil(t, NewUser(conf).GetEncryptPrivateKey())
+		assert.Nil(t, NewUser(conf).GetSignPrivateKey())
+	})
+
+	t.Run("every field checked", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", 1)
+		assert.Nil(t, CheckUserConfig(conf, UserOptions{}))
+
+		conf.Hid = 9
+		conf.EncryptMasterPublicKey = "xyz"
+		conf.SignMasterPublicKey = ""
+		var fields []string
+		for _, fe := range CheckUserConfig(conf, UserOptions{}) {
+			fields = append(fields, fe.Field)
+		}
+		assert.Equal(t, []string{"hid", "encrypt_master_public_key", "sign_master_public_key"}, fields)
+		_, err := NewUserWithError(conf, UserOptions{})
+		fieldErr(t, err, "hid")
+	})
+
+	t.Run("private keys", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", 1)
+		u, err := NewUserWithError(conf, UserOptions{RequirePrivateKeys: true})
+		assert.Nil(t, err)
+		assert.Nil(t, u.Validate())
+
+		conf.EncryptPrivateKey = ""
+		u, err = NewUserWithError(conf, UserOptions{})
+		assert.Nil(t, err)
+		assert.Nil(t, u.GetEncryptPrivateKey())
+
+		_, err = NewUserWithError(conf, UserOptions{RequirePrivateKeys: true})
+		assert.EqualError(t, err, "encrypt_private_key: required but not set")
+	})
+}
+
+// newTestUserConfig issues keys for uid under freshly generated master keys
+func newTestUserConfig(t *testing.T, uid string, hid byte) *UserConfig {
+	m, err := sm9test.NewMasters()
+	assert.Nil(t, err)
+	return issueTestUserConfig(t, m, uid, hid)
+}
+
+// issueTestUserConfig issues keys for uid under the master keys m
+func issueTestUserConfig(t *testing.T, m *sm9test.Masters, uid string, hid byte) *UserConfig {
+	keys, err := m.Keys(uid, hid)
+	assert.Nil(t, err)
+	return &UserConfig{
+		Uid:                    uid,
+		Hid:                    hid,
+		EncryptPrivateKey:      keys.EncryptPrivateKey,
+		SignPrivateKey:         keys.SignPrivateKey,
+		EncryptMasterPublicKey: keys.EncryptMasterPublicKey,
+		SignMasterPublicKey:    keys.SignMasterPublicKey,
+	}
+}
+
+func TestUserValidate(t *testing.T) {
+	t.Run("valid keys", func(t *testing.T) {
+		u := NewUser(newTestUserConfig(t, "device1", 1))
+		assert.Nil(t, u.Validate())
+	})
+
+	t.Run("keys issued for another uid", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", 1)
+		conf.Uid = "device2"
+		u := NewUser(conf)
+		assert.NotNil(t, u.Validate())
+	})
+
+	t.Run("keys issued under other master keys", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", 1)
+		other := newTestUserConfig(t, "device1", 1)
+		conf.SignPrivateKey = other.SignPrivateKey
+		u := NewUser(conf)
+		assert.EqualError(t, u.Validate(), "sign private key does not match the uid, hid and sign master public key")
+
+		conf = newTestUserConfig(t, "device1", 1)
+		conf.EncryptPrivateKey = other.EncryptPrivateKey
+		u = NewUser(conf)
+		assert.EqualError(t, u.Validate(), "encrypt private key does not match the uid, hid and encrypt master public key")
+	})
+
+	t.Run("missing private keys", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", 1)
+		conf.SignPrivateKey = ""
+		u := NewUser(conf)
+		assert.EqualError(t, u.Validate(), "sign private key missing")
+	})
+
+	t.Run("expired keys", func(t *testing.T) {
+		conf := newTestUserConfig(t, "device1", 1)
+		conf.KeyVersion = 3
+		conf.IssuedAt = time.Now().Add(-2 * time.Hour)
+		conf.ExpiresAt = time.Now().Add(time.Hour)
+		u := NewUser(conf)
+		assert.Equal(t, 3, u.KeyVersion)
+		assert.Equal(t, conf.ExpiresAt, u.ExpiresAt)
+		assert.False(t, u.Expired())
+		assert.Nil(t, u.Validate())
+
+		u.ExpiresAt = time.Now().Add(-time.Hour)
+		assert.True(t, u.Expired())
+		assert.True(t, errors.Is(u.Validate(), ErrKeysExpired))
+	})
 }